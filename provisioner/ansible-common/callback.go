@@ -0,0 +1,78 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+// Package ansiblecommon contains the code shared by the ansible and
+// ansible-local provisioners.
+package ansiblecommon
+
+import (
+	"bytes"
+	_ "embed"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CallbackPluginName is the name under which the packer callback plugin is
+// enabled in Ansible.
+const CallbackPluginName = "packer"
+
+// CallbackPluginFile is the file name of the packer callback plugin inside
+// its plugin directory.
+const CallbackPluginFile = CallbackPluginName + ".py"
+
+//go:embed callback_plugins/packer.py
+var callbackPlugin []byte
+
+// CallbackPlugin returns the source of the packer callback plugin, ready to
+// be uploaded to a remote machine.
+func CallbackPlugin() io.Reader {
+	return bytes.NewReader(callbackPlugin)
+}
+
+// WriteCallbackPlugin writes the packer callback plugin into dir.
+func WriteCallbackPlugin(dir string) error {
+	return os.WriteFile(filepath.Join(dir, CallbackPluginFile), callbackPlugin, 0644)
+}
+
+// CallbackEnvVars returns the environment variables that make Ansible load
+// the packer callback plugin from dir. The callbacks and callback plugin
+// directories that env, in which the last value of a variable wins, already
+// sets are kept.
+func CallbackEnvVars(dir string, env []string) []string {
+	plugins := dir
+	if v := lookupEnv(env, "ANSIBLE_CALLBACK_PLUGINS"); v != "" {
+		plugins += ":" + v
+	}
+	var callbacks []string
+	seen := map[string]bool{CallbackPluginName: true}
+	// Ansible < 2.11 only reads ANSIBLE_CALLBACK_WHITELIST, later versions
+	// read both.
+	for _, name := range []string{"ANSIBLE_CALLBACKS_ENABLED", "ANSIBLE_CALLBACK_WHITELIST"} {
+		for _, callback := range strings.Split(lookupEnv(env, name), ",") {
+			callback = strings.TrimSpace(callback)
+			if callback != "" && !seen[callback] {
+				seen[callback] = true
+				callbacks = append(callbacks, callback)
+			}
+		}
+	}
+	enabled := strings.Join(append(callbacks, CallbackPluginName), ",")
+	return []string{
+		"ANSIBLE_CALLBACK_PLUGINS=" + plugins,
+		"ANSIBLE_CALLBACKS_ENABLED=" + enabled,
+		"ANSIBLE_CALLBACK_WHITELIST=" + enabled,
+	}
+}
+
+// lookupEnv returns the last value of the variable name in env.
+func lookupEnv(env []string, name string) string {
+	value := ""
+	for _, v := range env {
+		if n, val, ok := strings.Cut(v, "="); ok && n == name {
+			value = val
+		}
+	}
+	return value
+}
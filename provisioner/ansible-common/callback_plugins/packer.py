@@ -0,0 +1,91 @@
+# Copyright IBM Corp. 2013, 2025
+# SPDX-License-Identifier: MPL-2.0
+
+from __future__ import (absolute_import, division, print_function)
+__metaclass__ = type
+
+import json
+import platform
+import time
+
+from ansible.plugins.callback import CallbackBase
+from ansible.release import __version__ as ansible_version
+
+DOCUMENTATION = '''
+    callback: packer
+    type: notification
+    short_description: report playbook events to packer
+    description:
+        - This callback writes one JSON document per play, task and host result
+          to stdout so that packer can report progress and results.
+    author: Packer Community
+    version_added: na
+    requirements:
+      - enable in configuration
+'''
+
+EVENT_PREFIX = 'PACKER_ANSIBLE_EVENT '
+
+
+class CallbackModule(CallbackBase):
+    CALLBACK_VERSION = 2.0
+    CALLBACK_TYPE = 'notification'
+    CALLBACK_NAME = 'packer'
+    CALLBACK_NEEDS_ENABLED = True
+    CALLBACK_NEEDS_WHITELIST = True
+
+    def __init__(self, display=None):
+        super(CallbackModule, self).__init__(display=display)
+        self._play = ''
+
+    def _emit(self, event, **fields):
+        fields['event'] = event
+        fields['time'] = time.time()
+        line = json.dumps(fields, sort_keys=True, default=str)
+        self._display.display(EVENT_PREFIX + line, screen_only=True)
+
+    def _result(self, status, result, **fields):
+        res = result._result
+        msg = res.get('msg') or res.get('stderr') or ''
+        if not isinstance(msg, (type(u''), type(''))):
+            msg = json.dumps(msg, sort_keys=True, default=str)
+        self._emit('result',
+                   status=status,
+                   play=self._play,
+                   task=result._task.get_name().strip(),
+                   host=result._host.get_name(),
+                   changed=bool(res.get('changed', False)),
+                   msg=msg,
+                   **fields)
+
+    def v2_playbook_on_start(self, playbook):
+        self._emit('playbook_start', playbook=playbook._file_name,
+                   ansible_version=ansible_version,
+                   python_version=platform.python_version())
+
+    def v2_playbook_on_play_start(self, play):
+        self._play = play.get_name().strip()
+        self._emit('play_start', play=self._play)
+
+    def v2_playbook_on_task_start(self, task, is_conditional):
+        self._emit('task_start', play=self._play, task=task.get_name().strip())
+
+    def v2_playbook_on_handler_task_start(self, task):
+        self._emit('task_start', play=self._play, task=task.get_name().strip())
+
+    def v2_runner_on_ok(self, result):
+        self._result('ok', result)
+
+    def v2_runner_on_failed(self, result, ignore_errors=False):
+        self._result('failed', result, ignore_errors=ignore_errors)
+
+    def v2_runner_on_skipped(self, result):
+        self._result('skipped', result)
+
+    def v2_runner_on_unreachable(self, result):
+        self._result('unreachable', result)
+
+    def v2_playbook_on_stats(self, stats):
+        hosts = sorted(stats.processed.keys())
+        summary = dict((host, stats.summarize(host)) for host in hosts)
+        self._emit('stats', stats=summary, custom_stats=stats.custom)
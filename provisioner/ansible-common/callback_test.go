@@ -0,0 +1,29 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblecommon
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCallbackEnvVars(t *testing.T) {
+	assert.Equal(t, []string{
+		"ANSIBLE_CALLBACK_PLUGINS=/tmp/plugins",
+		"ANSIBLE_CALLBACKS_ENABLED=packer",
+		"ANSIBLE_CALLBACK_WHITELIST=packer",
+	}, CallbackEnvVars("/tmp/plugins", []string{"HOME=/root"}))
+
+	assert.Equal(t, []string{
+		"ANSIBLE_CALLBACK_PLUGINS=/tmp/plugins:/opt/callbacks",
+		"ANSIBLE_CALLBACKS_ENABLED=profile_tasks,timer,junit,packer",
+		"ANSIBLE_CALLBACK_WHITELIST=profile_tasks,timer,junit,packer",
+	}, CallbackEnvVars("/tmp/plugins", []string{
+		"ANSIBLE_CALLBACKS_ENABLED=timer",
+		"ANSIBLE_CALLBACK_PLUGINS=/opt/callbacks",
+		"ANSIBLE_CALLBACKS_ENABLED=profile_tasks, timer,packer",
+		"ANSIBLE_CALLBACK_WHITELIST=junit",
+	}), "the callbacks set by the user should be kept")
+}
@@ -0,0 +1,135 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblecommon
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Exit statuses of ansible-playbook, as documented by Ansible.
+const (
+	ExitCodeError           = 1
+	ExitCodeHostFailed      = 2
+	ExitCodeHostUnreachable = 3
+	ExitCodeParserError     = 4
+	ExitCodeBadOptions      = 5
+	ExitCodeInterrupted     = 99
+	ExitCodeUnexpected      = 250
+)
+
+// ExitError is returned when ansible-playbook exits with a non-zero status.
+// It is wrapped by one of the more specific error types below when the
+// status is one documented by Ansible, so that callers can tell failures
+// apart with errors.As.
+type ExitError struct {
+	ExitCode int
+	// What the exit status means.
+	Reason string
+	// The last task that failed without its errors being ignored, if known.
+	FailedTask *FailedTask
+	// The last error reported by Ansible itself rather than by a task, such
+	// as a parser error, if known.
+	Message string
+	// How the failure may be fixed.
+	Hint string
+}
+
+func (e *ExitError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "ansible-playbook exited with status %d (%s)", e.ExitCode, e.Reason)
+	if e.Message != "" {
+		fmt.Fprintf(&b, ": %s", e.Message)
+	}
+	if t := e.FailedTask; t != nil {
+		fmt.Fprintf(&b, ", last failed task: %q on %s", t.Task, t.Host)
+		if t.Msg != "" {
+			fmt.Fprintf(&b, ": %s", t.Msg)
+		}
+	}
+	if e.Hint != "" {
+		fmt.Fprintf(&b, ". %s", e.Hint)
+	}
+	return b.String()
+}
+
+// GeneralError is returned when ansible-playbook exits with status 1.
+type GeneralError struct{ ExitError }
+
+// HostFailedError is returned when ansible-playbook exits with status 2
+// because one or more hosts failed.
+type HostFailedError struct{ ExitError }
+
+// HostUnreachableError is returned when one or more hosts were unreachable.
+// ansible-playbook documents status 3 for this but exits with status 4 in
+// practice, so status 4 is reported as a HostUnreachableError when the
+// output showed an unreachable host.
+type HostUnreachableError struct{ ExitError }
+
+// ParserError is returned when ansible-playbook exits with status 4 and
+// no host was unreachable.
+type ParserError struct{ ExitError }
+
+// BadOptionsError is returned when ansible-playbook exits with status 5
+// because of bad or incomplete options.
+type BadOptionsError struct{ ExitError }
+
+// InterruptedError is returned when ansible-playbook exits with status 99
+// because it was interrupted.
+type InterruptedError struct{ ExitError }
+
+// UnexpectedError is returned when ansible-playbook exits with status 250
+// because of an unexpected error.
+type UnexpectedError struct{ ExitError }
+
+func (e *GeneralError) Unwrap() error         { return &e.ExitError }
+func (e *HostFailedError) Unwrap() error      { return &e.ExitError }
+func (e *HostUnreachableError) Unwrap() error { return &e.ExitError }
+func (e *ParserError) Unwrap() error          { return &e.ExitError }
+func (e *BadOptionsError) Unwrap() error      { return &e.ExitError }
+func (e *InterruptedError) Unwrap() error     { return &e.ExitError }
+func (e *UnexpectedError) Unwrap() error      { return &e.ExitError }
+
+// NewExitError returns the error matching the exit status of
+// ansible-playbook. failedTask is the last task that failed, if known, and
+// unreachable tells whether any host was unreachable.
+func NewExitError(exitCode int, failedTask *FailedTask, unreachable bool) error {
+	return newExitError(ExitError{ExitCode: exitCode, FailedTask: failedTask}, unreachable)
+}
+
+func newExitError(e ExitError, unreachable bool) error {
+	exitCode := e.ExitCode
+	switch {
+	case exitCode == ExitCodeError:
+		e.Reason = "error"
+		e.Hint = "Check the Ansible output above for the cause, adding `-vvv` to `extra_arguments` shows more details."
+		return &GeneralError{e}
+	case exitCode == ExitCodeHostFailed:
+		e.Reason = "one or more hosts failed"
+		e.Hint = "Fix the failed task, or set `ignore_errors` on it if the failure is expected."
+		return &HostFailedError{e}
+	case exitCode == ExitCodeHostUnreachable || (exitCode == ExitCodeParserError && unreachable):
+		e.Reason = "one or more hosts were unreachable"
+		e.Hint = "Make sure the guest accepts connections from Ansible, or add a `retry` block to retry the playbook while the guest boots."
+		return &HostUnreachableError{e}
+	case exitCode == ExitCodeParserError:
+		e.Reason = "parser error"
+		e.Hint = "Check the syntax of the playbook and the inventory, for example with `ansible-playbook --syntax-check`."
+		return &ParserError{e}
+	case exitCode == ExitCodeBadOptions:
+		e.Reason = "bad or incomplete options"
+		e.Hint = "Check `extra_arguments` and the other options passed to ansible-playbook."
+		return &BadOptionsError{e}
+	case exitCode == ExitCodeInterrupted:
+		e.Reason = "interrupted"
+		return &InterruptedError{e}
+	case exitCode == ExitCodeUnexpected:
+		e.Reason = "unexpected error"
+		e.Hint = "This is likely a bug in Ansible or one of its plugins, adding `-vvv` to `extra_arguments` shows the traceback."
+		return &UnexpectedError{e}
+	default:
+		e.Reason = "unknown failure"
+		return &e
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblecommon
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewExitError(t *testing.T) {
+	testcases := []struct {
+		exitCode    int
+		unreachable bool
+		check       func(error) bool
+	}{
+		{1, false, func(err error) bool { var e *GeneralError; return errors.As(err, &e) }},
+		{2, false, func(err error) bool { var e *HostFailedError; return errors.As(err, &e) }},
+		{3, false, func(err error) bool { var e *HostUnreachableError; return errors.As(err, &e) }},
+		{4, true, func(err error) bool { var e *HostUnreachableError; return errors.As(err, &e) }},
+		{4, false, func(err error) bool { var e *ParserError; return errors.As(err, &e) }},
+		{5, false, func(err error) bool { var e *BadOptionsError; return errors.As(err, &e) }},
+		{99, false, func(err error) bool { var e *InterruptedError; return errors.As(err, &e) }},
+		{250, false, func(err error) bool { var e *UnexpectedError; return errors.As(err, &e) }},
+		{42, false, func(err error) bool { _, ok := errors.Unwrap(err).(*ExitError); return ok }},
+	}
+
+	for _, tc := range testcases {
+		t.Run(fmt.Sprintf("exit status %d", tc.exitCode), func(t *testing.T) {
+			err := fmt.Errorf("Error executing Ansible: %w", NewExitError(tc.exitCode, nil, tc.unreachable))
+			if !tc.check(err) {
+				t.Fatalf("unexpected error type %T", errors.Unwrap(err))
+			}
+			var exitErr *ExitError
+			if !errors.As(err, &exitErr) {
+				t.Fatal("every error should unwrap to an ExitError")
+			}
+			assert.Equal(t, tc.exitCode, exitErr.ExitCode)
+		})
+	}
+}
+
+func TestExitError_Error(t *testing.T) {
+	err := NewExitError(2, &FailedTask{Play: "web", Task: "install nginx", Host: "default", Msg: "No package matching 'nginx'"}, false)
+	assert.Equal(t, `ansible-playbook exited with status 2 (one or more hosts failed), `+
+		`last failed task: "install nginx" on default: No package matching 'nginx'. `+
+		"Fix the failed task, or set `ignore_errors` on it if the failure is expected.", err.Error())
+}
+
+func TestEventUi_ExitError(t *testing.T) {
+	ui := &EventUi{Ui: &recordingUi{}}
+	ui.Error("ansible-playbook: error: unrecognized arguments: --frobnicate")
+	err := ui.ExitError(ExitCodeBadOptions)
+	var e *BadOptionsError
+	if !errors.As(err, &e) {
+		t.Fatalf("unexpected error type %T", err)
+	}
+	assert.Equal(t, "ansible-playbook exited with status 5 (bad or incomplete options): "+
+		"unrecognized arguments: --frobnicate. Check `extra_arguments` and the other options passed to ansible-playbook.", err.Error())
+
+	ui = &EventUi{Ui: &recordingUi{}}
+	ui.Say(EventPrefix + `{"event":"playbook_start","playbook":"site.yml"}`)
+	ui.Error("[ERROR]: the role 'web' was not found")
+	err = ui.ExitError(ExitCodeParserError)
+	var p *ParserError
+	if !errors.As(err, &p) {
+		t.Fatalf("unexpected error type %T", err)
+	}
+	assert.Equal(t, "the role 'web' was not found", p.Message, "errors should be found once events have been seen")
+}
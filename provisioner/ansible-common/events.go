@@ -0,0 +1,320 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblecommon
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// EventPrefix marks the output lines written by the packer callback plugin.
+const EventPrefix = "PACKER_ANSIBLE_EVENT "
+
+// Event is a single event reported by the packer callback plugin.
+type Event struct {
+	// One of playbook_start, play_start, task_start, result or stats.
+	Event string `json:"event"`
+	// Seconds since the epoch at which the event was emitted.
+	Time float64 `json:"time"`
+
+	// Set on the playbook_start event.
+	Playbook       string `json:"playbook,omitempty"`
+	AnsibleVersion string `json:"ansible_version,omitempty"`
+	PythonVersion  string `json:"python_version,omitempty"`
+
+	Play string `json:"play,omitempty"`
+	Task string `json:"task,omitempty"`
+
+	// Set on result events. Status is one of ok, failed, skipped or
+	// unreachable.
+	Host         string `json:"host,omitempty"`
+	Status       string `json:"status,omitempty"`
+	Changed      bool   `json:"changed,omitempty"`
+	IgnoreErrors bool   `json:"ignore_errors,omitempty"`
+	Msg          string `json:"msg,omitempty"`
+
+	// Set on the stats event, emitted once at the end of the run.
+	Stats       map[string]HostStats   `json:"stats,omitempty"`
+	CustomStats map[string]interface{} `json:"custom_stats,omitempty"`
+
+	raw string
+}
+
+// HostStats is the play recap of a single host.
+type HostStats struct {
+	Ok          int `json:"ok"`
+	Changed     int `json:"changed"`
+	Unreachable int `json:"unreachable"`
+	Failures    int `json:"failures"`
+	Skipped     int `json:"skipped"`
+	Rescued     int `json:"rescued"`
+	Ignored     int `json:"ignored"`
+}
+
+func (s HostStats) String() string {
+	return fmt.Sprintf("ok=%d changed=%d unreachable=%d failed=%d skipped=%d rescued=%d ignored=%d",
+		s.Ok, s.Changed, s.Unreachable, s.Failures, s.Skipped, s.Rescued, s.Ignored)
+}
+
+// ParseEvent parses an output line written by the packer callback plugin.
+// It returns false if line isn't an event.
+func ParseEvent(line string) (*Event, bool) {
+	if !strings.HasPrefix(line, EventPrefix) {
+		return nil, false
+	}
+	raw := strings.TrimPrefix(line, EventPrefix)
+	ev := &Event{raw: raw}
+	if err := json.Unmarshal([]byte(raw), ev); err != nil {
+		log.Printf("[WARN] could not parse ansible event %q: %s", raw, err)
+		return nil, false
+	}
+	return ev, true
+}
+
+// playCounts sums up the task results of a single play.
+type playCounts struct {
+	ok, changed, failed, skipped, unreachable int
+}
+
+func (c *playCounts) add(ev *Event) {
+	switch ev.Status {
+	case "ok":
+		c.ok++
+		if ev.Changed {
+			c.changed++
+		}
+	case "failed":
+		c.failed++
+	case "skipped":
+		c.skipped++
+	case "unreachable":
+		c.unreachable++
+	}
+}
+
+var (
+	rawPlayRe    = regexp.MustCompile(`^PLAY \[(.*)\] \*+$`)
+	rawTaskRe    = regexp.MustCompile(`^(?:TASK|RUNNING HANDLER) \[(.*)\] \*+$`)
+	rawFailureRe = regexp.MustCompile(`^(?:fatal|failed): \[([^\]]+)\].*?: (FAILED|UNREACHABLE)! => (.*)$`)
+	// Errors of Ansible itself, such as parser errors, and of its command
+	// line parser.
+	rawErrorRe = regexp.MustCompile(`^(?:ERROR!|\[ERROR\]:|ansible-playbook: error:) (.+)$`)
+	// The color codes Ansible wraps its output in, for example when
+	// ANSIBLE_FORCE_COLOR is set.
+	ansiEscapeRe = regexp.MustCompile(`\x1b\[[0-9;]*[A-Za-z]`)
+)
+
+// QuietUi wraps a packersdk.Ui and only logs the output sent to it, for the
+// runs of Ansible made by Packer itself rather than by the playbooks.
+type QuietUi struct {
+	packersdk.Ui
+}
+
+func (u *QuietUi) Say(message string)        { log.Printf("ansible: %s", message) }
+func (u *QuietUi) Message(message string)    { log.Printf("ansible: %s", message) }
+func (u *QuietUi) Error(message string)      { log.Printf("ansible: %s", message) }
+func (u *QuietUi) Machine(string, ...string) {}
+
+// EventUi wraps a packersdk.Ui and intercepts the output lines written by
+// the packer callback plugin. Every event is sent to Machine.
+//
+// When Structured is set, Ansible's raw output is only written to the log,
+// and to the wrapped Ui if ShowRaw is set, while a concise line is shown for
+// every play and task result.
+//
+// EventUi also keeps track of the last failed task, from the events or, when
+// the callback plugin isn't enabled, from the output of Ansible's default
+// callback, and of the last error reported by Ansible itself, such as a
+// parser error.
+type EventUi struct {
+	packersdk.Ui
+
+	Structured bool
+	ShowRaw    bool
+	// OnEvent, if set, is called with every event.
+	OnEvent func(*Event)
+
+	mu     sync.Mutex
+	play   string
+	counts *playCounts
+
+	sawEvents                bool
+	rawPlay, rawTask         string
+	lastFailure, prevFailure *FailedTask
+	unreachable, prevUnreach bool
+	lastError                string
+}
+
+// LastFailure returns the last task that failed without its errors being
+// ignored, if any, and whether any host was unreachable.
+func (u *EventUi) LastFailure() (*FailedTask, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.lastFailure, u.unreachable
+}
+
+// ExitError returns the error matching the exit status of ansible-playbook,
+// with the last failed task and the last error reported by Ansible.
+func (u *EventUi) ExitError(exitCode int) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return newExitError(ExitError{
+		ExitCode:   exitCode,
+		FailedTask: u.lastFailure,
+		Message:    u.lastError,
+	}, u.unreachable)
+}
+
+func (u *EventUi) Say(line string) {
+	u.handle(line, u.Ui.Say)
+}
+
+// Error handles the lines Ansible writes to stderr like those of stdout,
+// writing the raw ones to the wrapped Ui as errors.
+func (u *EventUi) Error(line string) {
+	u.handle(line, u.Ui.Error)
+}
+
+// handle handles a single output line, writing it with show if it is raw
+// output that should be shown.
+func (u *EventUi) handle(line string, show func(string)) {
+	ev, ok := ParseEvent(line)
+	if !ok {
+		u.scanRaw(line)
+		if !u.Structured || u.ShowRaw {
+			show(line)
+		} else {
+			log.Printf("ansible: %s", line)
+		}
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.sawEvents = true
+	if ev.Event == "result" && (ev.Status == "failed" || ev.Status == "unreachable") && !ev.IgnoreErrors {
+		u.lastFailure = &FailedTask{Play: ev.Play, Task: ev.Task, Host: ev.Host, Msg: ev.Msg}
+		if ev.Status == "unreachable" {
+			u.unreachable = true
+		}
+	}
+
+	u.Ui.Machine("ansible-event", ev.Event, ev.raw)
+	if u.OnEvent != nil {
+		u.OnEvent(ev)
+	}
+	if u.Structured {
+		u.render(ev)
+	}
+}
+
+// scanRaw looks for errors of Ansible in a raw output line and for failed
+// tasks in a line written by Ansible's default callback, which it ignores
+// once events have been seen. Color codes are ignored.
+func (u *EventUi) scanRaw(line string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	line = ansiEscapeRe.ReplaceAllString(line, "")
+	if m := rawErrorRe.FindStringSubmatch(line); m != nil {
+		u.lastError = m[1]
+		return
+	}
+	if u.sawEvents {
+		return
+	}
+	if m := rawPlayRe.FindStringSubmatch(line); m != nil {
+		u.rawPlay = m[1]
+		return
+	}
+	if m := rawTaskRe.FindStringSubmatch(line); m != nil {
+		u.rawTask = m[1]
+		return
+	}
+	if line == "...ignoring" {
+		u.lastFailure, u.unreachable = u.prevFailure, u.prevUnreach
+		return
+	}
+	m := rawFailureRe.FindStringSubmatch(line)
+	if m == nil {
+		return
+	}
+	failure := &FailedTask{Play: u.rawPlay, Task: u.rawTask, Host: m[1]}
+	var result struct {
+		Msg interface{} `json:"msg"`
+	}
+	if err := json.Unmarshal([]byte(m[3]), &result); err == nil {
+		if msg, ok := result.Msg.(string); ok {
+			failure.Msg = msg
+		} else if result.Msg != nil {
+			b, _ := json.Marshal(result.Msg)
+			failure.Msg = string(b)
+		}
+	}
+	u.prevFailure, u.lastFailure = u.lastFailure, failure
+	u.prevUnreach = u.unreachable
+	if m[2] == "UNREACHABLE" {
+		u.unreachable = true
+	}
+}
+
+func (u *EventUi) render(ev *Event) {
+	switch ev.Event {
+	case "play_start":
+		u.finishPlay()
+		u.play = ev.Play
+		u.counts = &playCounts{}
+		u.Ui.Say(fmt.Sprintf("PLAY [%s]", ev.Play))
+	case "result":
+		if u.counts != nil {
+			u.counts.add(ev)
+		}
+		status := ev.Status
+		if status == "ok" && ev.Changed {
+			status = "changed"
+		}
+		line := fmt.Sprintf("  %s: [%s] %s", status, ev.Host, ev.Task)
+		if ev.Status == "failed" || ev.Status == "unreachable" {
+			if ev.Msg != "" {
+				line = fmt.Sprintf("%s: %s", line, ev.Msg)
+			}
+			if !ev.IgnoreErrors {
+				u.Ui.Error(line)
+				return
+			}
+			line += " (ignored)"
+		}
+		u.Ui.Say(line)
+	case "stats":
+		u.finishPlay()
+		hosts := make([]string, 0, len(ev.Stats))
+		for host := range ev.Stats {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+		u.Ui.Say("PLAY RECAP")
+		for _, host := range hosts {
+			u.Ui.Say(fmt.Sprintf("  %s: %s", host, ev.Stats[host]))
+		}
+	}
+}
+
+// finishPlay shows the task counts of the current play, if any.
+func (u *EventUi) finishPlay() {
+	if u.counts == nil {
+		return
+	}
+	c := u.counts
+	u.Ui.Say(fmt.Sprintf("PLAY [%s] finished: ok=%d changed=%d failed=%d skipped=%d unreachable=%d",
+		u.play, c.ok, c.changed, c.failed, c.skipped, c.unreachable))
+	u.counts = nil
+}
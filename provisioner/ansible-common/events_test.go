@@ -0,0 +1,158 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblecommon
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingUi struct {
+	packersdk.Ui
+	said    []string
+	errors  []string
+	machine []string
+}
+
+func (u *recordingUi) Say(s string)   { u.said = append(u.said, s) }
+func (u *recordingUi) Error(s string) { u.errors = append(u.errors, s) }
+func (u *recordingUi) Machine(t string, args ...string) {
+	u.machine = append(u.machine, fmt.Sprintf("%s %s", t, strings.Join(args, " ")))
+}
+
+func TestParseEvent(t *testing.T) {
+	ev, ok := ParseEvent(EventPrefix + `{"event":"result","status":"failed","host":"default","task":"install","msg":"boom","time":1.5}`)
+	if !ok {
+		t.Fatal("should parse event")
+	}
+	assert.Equal(t, "result", ev.Event)
+	assert.Equal(t, "failed", ev.Status)
+	assert.Equal(t, "default", ev.Host)
+	assert.Equal(t, "install", ev.Task)
+	assert.Equal(t, "boom", ev.Msg)
+
+	for _, line := range []string{
+		"TASK [install] ****",
+		EventPrefix + "not json",
+	} {
+		if _, ok := ParseEvent(line); ok {
+			t.Fatalf("%q should not parse as an event", line)
+		}
+	}
+}
+
+func TestEventUi_Structured(t *testing.T) {
+	rec := &recordingUi{}
+	ui := &EventUi{Ui: rec, Structured: true}
+
+	for _, line := range []string{
+		EventPrefix + `{"event":"play_start","play":"web"}`,
+		"TASK [install] ****",
+		EventPrefix + `{"event":"task_start","play":"web","task":"install"}`,
+		EventPrefix + `{"event":"result","status":"ok","changed":true,"host":"default","task":"install"}`,
+		EventPrefix + `{"event":"result","status":"skipped","host":"default","task":"configure"}`,
+		EventPrefix + `{"event":"result","status":"failed","host":"default","task":"check","msg":"nope","ignore_errors":true}`,
+		EventPrefix + `{"event":"result","status":"failed","host":"default","task":"start","msg":"boom"}`,
+		EventPrefix + `{"event":"stats","stats":{"default":{"ok":1,"changed":1,"failures":1,"skipped":1,"ignored":1}}}`,
+	} {
+		ui.Say(line)
+	}
+
+	assert.Equal(t, []string{
+		"PLAY [web]",
+		"  changed: [default] install",
+		"  skipped: [default] configure",
+		"  failed: [default] check: nope (ignored)",
+		"PLAY [web] finished: ok=1 changed=1 failed=2 skipped=1 unreachable=0",
+		"PLAY RECAP",
+		"  default: ok=1 changed=1 unreachable=0 failed=1 skipped=1 rescued=0 ignored=1",
+	}, rec.said)
+	assert.Equal(t, []string{"  failed: [default] start: boom"}, rec.errors)
+	assert.Len(t, rec.machine, 7)
+	assert.True(t, strings.HasPrefix(rec.machine[0], "ansible-event play_start {"))
+}
+
+func TestEventUi_Raw(t *testing.T) {
+	rec := &recordingUi{}
+	ui := &EventUi{Ui: rec, Structured: true, ShowRaw: true}
+	ui.Say("TASK [install] ****")
+	assert.Equal(t, []string{"TASK [install] ****"}, rec.said)
+
+	rec = &recordingUi{}
+	ui = &EventUi{Ui: rec}
+	ui.Say("TASK [install] ****")
+	ui.Say(EventPrefix + `{"event":"play_start","play":"web"}`)
+	assert.Equal(t, []string{"TASK [install] ****"}, rec.said,
+		"events should be hidden when structured output is disabled")
+	assert.Len(t, rec.machine, 1)
+}
+
+func TestEventUi_Error(t *testing.T) {
+	rec := &recordingUi{}
+	ui := &EventUi{Ui: rec, Structured: true}
+	ui.Error("ERROR! the playbook: site.yml could not be found")
+	assert.Empty(t, rec.said)
+	assert.Empty(t, rec.errors, "raw stderr should be hidden in structured output")
+
+	rec = &recordingUi{}
+	ui = &EventUi{Ui: rec}
+	ui.Say("TASK [install] ****")
+	ui.Error(`fatal: [default]: FAILED! => {"msg": "boom"}`)
+	ui.Error(EventPrefix + `{"event":"play_start","play":"web"}`)
+	assert.Equal(t, []string{"TASK [install] ****"}, rec.said)
+	assert.Equal(t, []string{`fatal: [default]: FAILED! => {"msg": "boom"}`}, rec.errors)
+	assert.Len(t, rec.machine, 1)
+	failure, _ := ui.LastFailure()
+	assert.Equal(t, &FailedTask{Task: "install", Host: "default", Msg: "boom"}, failure,
+		"stderr should be scanned for failures")
+}
+
+func TestEventUi_LastFailure(t *testing.T) {
+	rec := &recordingUi{}
+	ui := &EventUi{Ui: rec}
+	for _, line := range []string{
+		"PLAY [web] *********************************************************************",
+		"TASK [check] *******************************************************************",
+		`fatal: [default]: FAILED! => {"changed": false, "msg": "nope"}`,
+		"...ignoring",
+		"TASK [install nginx] ***********************************************************",
+		`fatal: [default]: FAILED! => {"changed": false, "msg": "No package matching 'nginx'"}`,
+		"PLAY RECAP *********************************************************************",
+	} {
+		ui.Say(line)
+	}
+	failure, unreachable := ui.LastFailure()
+	assert.Equal(t, &FailedTask{Play: "web", Task: "install nginx", Host: "default", Msg: "No package matching 'nginx'"}, failure)
+	assert.False(t, unreachable)
+	assert.Len(t, rec.said, 7, "raw output should be passed through")
+
+	ui = &EventUi{Ui: &recordingUi{}}
+	ui.Say("TASK [Gathering Facts] *********************************************************")
+	ui.Say(`fatal: [default]: UNREACHABLE! => {"changed": false, "msg": "Failed to connect to the host via ssh", "unreachable": true}`)
+	failure, unreachable = ui.LastFailure()
+	assert.Equal(t, "Gathering Facts", failure.Task)
+	assert.True(t, unreachable)
+
+	ui = &EventUi{Ui: &recordingUi{}}
+	ui.Say("\x1b[0;33mTASK [Gathering Facts] *****\x1b[0m")
+	ui.Say("\x1b[1;31mfatal: [default]: UNREACHABLE! => {\"changed\": false, \"msg\": \"timed out\", \"unreachable\": true}\x1b[0m")
+	ui.Error("\x1b[0;31mERROR! Unexpected Exception, this is probably a bug\x1b[0m")
+	failure, unreachable = ui.LastFailure()
+	assert.Equal(t, &FailedTask{Task: "Gathering Facts", Host: "default", Msg: "timed out"}, failure,
+		"color codes should be ignored")
+	assert.True(t, unreachable)
+	assert.Equal(t, "Unexpected Exception, this is probably a bug", ui.lastError)
+
+	ui = &EventUi{Ui: &recordingUi{}}
+	ui.Say(EventPrefix + `{"event":"playbook_start","playbook":"site.yml"}`)
+	ui.Say(EventPrefix + `{"event":"result","status":"failed","play":"web","task":"start","host":"default","msg":"boom"}`)
+	ui.Say(`fatal: [default]: FAILED! => {"msg": "raw"}`)
+	failure, _ = ui.LastFailure()
+	assert.Equal(t, &FailedTask{Play: "web", Task: "start", Host: "default", Msg: "boom"}, failure,
+		"events should be preferred over the raw output")
+}
@@ -0,0 +1,119 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblecommon
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// FactsPlaybookFile is the name of the playbook gathering the facts written
+// to facts_output_file.
+const FactsPlaybookFile = "packer-facts.yml"
+
+// factsCachePrefix is the prefix of the files of the fact cache, so that
+// they are found whatever prefix the Ansible configuration sets.
+const factsCachePrefix = "packer-facts-"
+
+// FactsPlaybook returns a playbook which only gathers the facts of host,
+// run once the playbooks are done so that the facts are the final ones.
+func FactsPlaybook(host string) []byte {
+	// A JSON string is a valid YAML scalar.
+	h, _ := json.Marshal(host)
+	return []byte(fmt.Sprintf("- hosts: %s\n  gather_facts: true\n  tasks: []\n", h))
+}
+
+// playbookOptions are the options of ansible-playbook that FactsArgs drops,
+// and whether they take a value.
+var playbookOptions = map[string]bool{
+	"-t": true, "--tags": true,
+	"-l": true, "--limit": true,
+	"-C": false, "--check": false,
+	"-D": false, "--diff": false,
+	"--skip-tags":     true,
+	"--start-at-task": true,
+	"--step":          false,
+}
+
+// FactsArgs returns the arguments of extra_arguments that the closing
+// playbook gathering the facts runs with, so that it reaches the host like
+// the playbooks did. Only the options selecting what the playbooks run or
+// how, --tags, --skip-tags, --limit, --start-at-task, --check, --diff and
+// --step, are dropped.
+func FactsArgs(extraArgs []string) []string {
+	var args []string
+	for i := 0; i < len(extraArgs); i++ {
+		arg := extraArgs[i]
+		name, _, hasValue := strings.Cut(arg, "=")
+		if !strings.HasPrefix(arg, "--") {
+			name, hasValue = arg, false
+		}
+		takesValue, ok := playbookOptions[name]
+		if !ok {
+			args = append(args, arg)
+			continue
+		}
+		if takesValue && !hasValue {
+			i++
+		}
+	}
+	return args
+}
+
+// FactsCacheEnvVars returns the environment variables that make Ansible
+// cache the gathered facts as JSON files in dir.
+func FactsCacheEnvVars(dir string) []string {
+	return []string{
+		"ANSIBLE_CACHE_PLUGIN=jsonfile",
+		"ANSIBLE_CACHE_PLUGIN_CONNECTION=" + dir,
+		"ANSIBLE_CACHE_PLUGIN_PREFIX=" + factsCachePrefix,
+	}
+}
+
+// FactsCacheFile returns the name of the file of the facts of host in the
+// fact cache.
+func FactsCacheFile(host string) string {
+	return factsCachePrefix + host
+}
+
+// FactsHost returns the host of facts_output_file when the playbooks ran on
+// the hosts of a user inventory file: host if they ran on it, else the only
+// host they ran on. provisioned holds the hosts of the play recaps.
+func FactsHost(host string, provisioned map[string]bool) (string, error) {
+	if provisioned[host] {
+		return host, nil
+	}
+	hosts := make([]string, 0, len(provisioned))
+	for h := range provisioned {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	switch len(hosts) {
+	case 1:
+		return hosts[0], nil
+	case 0:
+		return "", fmt.Errorf("facts_output_file: the playbooks ran on no host")
+	default:
+		return "", fmt.Errorf("facts_output_file: the playbooks ran on several hosts "+
+			"(%s) and none of them is %s", strings.Join(hosts, ", "), host)
+	}
+}
+
+// WriteFactsFile writes the facts cached by Ansible to path, as an indented
+// JSON object with the sensitive values masked by redactor.
+func WriteFactsFile(path string, cached []byte, redactor *Redactor) error {
+	var facts map[string]interface{}
+	if err := json.Unmarshal(cached, &facts); err != nil {
+		return fmt.Errorf("invalid fact cache: %s", err)
+	}
+	b, err := json.MarshalIndent(facts, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = []byte(redactor.String(string(b)))
+	return os.WriteFile(path, append(b, '\n'), 0644)
+}
@@ -0,0 +1,92 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblecommon
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestFactsPlaybook(t *testing.T) {
+	for _, host := range []string{"default", "127.0.0.1", "web: {a}"} {
+		var plays []map[string]interface{}
+		if err := yaml.Unmarshal(FactsPlaybook(host), &plays); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		assert.Equal(t, []map[string]interface{}{
+			{"hosts": host, "gather_facts": true, "tasks": []interface{}{}},
+		}, plays)
+	}
+}
+
+func TestFactsHost(t *testing.T) {
+	host, err := FactsHost("default", map[string]bool{"default": true, "db": true})
+	assert.NoError(t, err)
+	assert.Equal(t, "default", host)
+
+	host, err = FactsHost("default", map[string]bool{"web": true})
+	assert.NoError(t, err)
+	assert.Equal(t, "web", host)
+
+	_, err = FactsHost("default", map[string]bool{})
+	assert.Error(t, err)
+
+	_, err = FactsHost("default", map[string]bool{"web": true, "db": true})
+	assert.EqualError(t, err, "facts_output_file: the playbooks ran on several hosts (db, web) and none of them is default")
+}
+
+func TestFactsArgs(t *testing.T) {
+	args := FactsArgs([]string{
+		"--tags", "web",
+		"-e", "ansible_python_interpreter=/usr/bin/python3",
+		"--limit=default",
+		"--ssh-extra-args", "-o ProxyJump=bastion",
+		"-C",
+		"--extra-vars=ansible_winrm_scheme=http",
+		"-b", "--become-exe", "doas",
+		"--skip-tags", "slow", "--start-at-task=install", "--diff", "--step",
+		"-M", "./library",
+		"-v",
+		"--vault-password-file=pwfile",
+	})
+	assert.Equal(t, []string{
+		"-e", "ansible_python_interpreter=/usr/bin/python3",
+		"--ssh-extra-args", "-o ProxyJump=bastion",
+		"--extra-vars=ansible_winrm_scheme=http",
+		"-b", "--become-exe", "doas",
+		"-M", "./library",
+		"-v",
+		"--vault-password-file=pwfile",
+	}, args, "unknown options should be kept")
+	assert.Empty(t, FactsArgs(nil))
+}
+
+func TestWriteFactsFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "facts.json")
+	err := WriteFactsFile(file, []byte(`{"ansible_distribution":"Ubuntu","ansible_processor_vcpus":2}`), nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	assert.Equal(t, "{\n  \"ansible_distribution\": \"Ubuntu\",\n  \"ansible_processor_vcpus\": 2\n}\n", string(b))
+
+	assert.Error(t, WriteFactsFile(file, []byte("not json"), nil))
+
+	err = WriteFactsFile(file, []byte(`{"ansible_env":{"DB_PASSWORD":"hun\"ter2"}}`), NewRedactor(`hun"ter2`))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	b, err = os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	assert.JSONEq(t, `{"ansible_env": {"DB_PASSWORD": "<sensitive>"}}`, string(b))
+}
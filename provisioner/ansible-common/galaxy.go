@@ -0,0 +1,331 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblecommon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"gopkg.in/yaml.v3"
+)
+
+// Kinds of galaxy requirements.
+const (
+	GalaxyRoles       = "roles"
+	GalaxyCollections = "collections"
+)
+
+var (
+	// The source control systems of roles.
+	galaxyRoleSCMs = map[string]bool{"": true, "git": true, "hg": true}
+	// The source types of collections.
+	galaxyCollectionTypes = map[string]bool{
+		"": true, "galaxy": true, "git": true, "url": true, "file": true, "dir": true, "subdirs": true,
+	}
+)
+
+// GalaxyRequirement is a role or a collection of a galaxy requirements file.
+type GalaxyRequirement struct {
+	// The name of the role, or the name or the source of the collection.
+	Name string `yaml:"name,omitempty"`
+	// The source of the role.
+	Src     string `yaml:"src,omitempty"`
+	Version string `yaml:"version,omitempty"`
+	// The source control system of the role.
+	SCM string `yaml:"scm,omitempty"`
+	// The source type of the collection.
+	Type string `yaml:"type,omitempty"`
+	// The Galaxy server of the collection.
+	Source string `yaml:"source,omitempty"`
+	// Other keys, passed as is to ansible-galaxy.
+	Extra map[string]interface{} `yaml:",inline"`
+}
+
+// String returns the name of the requirement and its version, if any.
+func (r GalaxyRequirement) String() string {
+	name := r.Name
+	if name == "" {
+		name = r.Src
+	}
+	if r.Version != "" {
+		return fmt.Sprintf("%s (%s)", name, r.Version)
+	}
+	return name
+}
+
+// GalaxyRequirements are the roles and collections of a galaxy requirements
+// file.
+type GalaxyRequirements struct {
+	Roles       []GalaxyRequirement `yaml:"roles,omitempty"`
+	Collections []GalaxyRequirement `yaml:"collections,omitempty"`
+}
+
+// ParseGalaxyFile parses and validates the galaxy requirements file at path,
+// in either the format listing roles only or the format with `roles` and
+// `collections` keys. The files included by roles are read too, relative to
+// the directory of path.
+func ParseGalaxyFile(path string) (*GalaxyRequirements, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	reqs := &GalaxyRequirements{}
+	if len(doc.Content) == 0 {
+		return reqs, nil
+	}
+
+	root := doc.Content[0]
+	switch root.Kind {
+	case yaml.SequenceNode:
+		reqs.Roles, err = parseGalaxyRoles(path, root, map[string]bool{})
+	case yaml.MappingNode:
+		for i := 0; i < len(root.Content) && err == nil; i += 2 {
+			key, value := root.Content[i], root.Content[i+1]
+			switch key.Value {
+			case GalaxyRoles:
+				reqs.Roles, err = parseGalaxyRoles(path, value, map[string]bool{})
+			case GalaxyCollections:
+				reqs.Collections, err = parseGalaxyCollections(path, value)
+			default:
+				err = fmt.Errorf("%s:%d: unknown key %q, expected roles or collections", path, key.Line, key.Value)
+			}
+		}
+	default:
+		err = fmt.Errorf("%s:%d: expected a list of roles or a map of roles and collections", path, root.Line)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return reqs, nil
+}
+
+func parseGalaxyRoles(path string, node *yaml.Node, included map[string]bool) ([]GalaxyRequirement, error) {
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+		return nil, nil
+	}
+	if node.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("%s:%d: roles must be a list", path, node.Line)
+	}
+	var roles []GalaxyRequirement
+	for _, n := range node.Content {
+		var role GalaxyRequirement
+		switch n.Kind {
+		case yaml.ScalarNode:
+			// src,version,name
+			parts := strings.Split(n.Value, ",")
+			for len(parts) < 3 {
+				parts = append(parts, "")
+			}
+			role = GalaxyRequirement{Src: strings.TrimSpace(parts[0]), Version: strings.TrimSpace(parts[1]), Name: strings.TrimSpace(parts[2])}
+		case yaml.MappingNode:
+			var include struct {
+				Include string `yaml:"include"`
+			}
+			if err := n.Decode(&include); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", path, n.Line, err)
+			}
+			if include.Include != "" {
+				incRoles, err := parseGalaxyInclude(path, include.Include, included)
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: %s", path, n.Line, err)
+				}
+				roles = append(roles, incRoles...)
+				continue
+			}
+			if err := n.Decode(&role); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", path, n.Line, err)
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: a role must be a string or a map", path, n.Line)
+		}
+
+		if role.Src == "" && role.Name == "" {
+			return nil, fmt.Errorf("%s:%d: a role must have a src or a name", path, n.Line)
+		}
+		if !galaxyRoleSCMs[role.SCM] {
+			return nil, fmt.Errorf("%s:%d: role %s: unknown scm %q, expected git or hg", path, n.Line, role, role.SCM)
+		}
+		if role.Type != "" {
+			return nil, fmt.Errorf("%s:%d: role %s: type is only valid for collections, use scm", path, n.Line, role)
+		}
+		roles = append(roles, role)
+	}
+	return roles, nil
+}
+
+func parseGalaxyInclude(path, include string, included map[string]bool) ([]GalaxyRequirement, error) {
+	if !filepath.IsAbs(include) {
+		include = filepath.Join(filepath.Dir(path), include)
+	}
+	if included[include] {
+		return nil, fmt.Errorf("%s is included recursively", include)
+	}
+	included[include] = true
+	defer delete(included, include)
+
+	b, err := os.ReadFile(include)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %s", include, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	return parseGalaxyRoles(include, doc.Content[0], included)
+}
+
+func parseGalaxyCollections(path string, node *yaml.Node) ([]GalaxyRequirement, error) {
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+		return nil, nil
+	}
+	if node.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("%s:%d: collections must be a list", path, node.Line)
+	}
+	var collections []GalaxyRequirement
+	for _, n := range node.Content {
+		var collection GalaxyRequirement
+		switch n.Kind {
+		case yaml.ScalarNode:
+			collection.Name = n.Value
+		case yaml.MappingNode:
+			if err := n.Decode(&collection); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", path, n.Line, err)
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: a collection must be a string or a map", path, n.Line)
+		}
+
+		if collection.Name == "" {
+			return nil, fmt.Errorf("%s:%d: a collection must have a name", path, n.Line)
+		}
+		if !galaxyCollectionTypes[collection.Type] {
+			return nil, fmt.Errorf("%s:%d: collection %s: unknown type %q, expected one of galaxy, git, url, file, dir or subdirs",
+				path, n.Line, collection, collection.Type)
+		}
+		if collection.SCM != "" || collection.Src != "" {
+			return nil, fmt.Errorf("%s:%d: collection %s: scm and src are only valid for roles, use type and name", path, n.Line, collection)
+		}
+		collections = append(collections, collection)
+	}
+	return collections, nil
+}
+
+// YAML renders the requirements as a requirements file with `roles` and
+// `collections` keys, with the included files inlined.
+func (r *GalaxyRequirements) YAML() ([]byte, error) {
+	return yaml.Marshal(r)
+}
+
+// GalaxyStep is an ansible-galaxy execution installing the roles or the
+// collections of a requirements file.
+type GalaxyStep struct {
+	// GalaxyRoles or GalaxyCollections.
+	Kind    string
+	Entries []GalaxyRequirement
+	// The arguments of ansible-galaxy installing the entries from file.
+	Args []string
+}
+
+// Steps returns the ansible-galaxy executions installing the requirements,
+// from their requirements file at file.
+func (r *GalaxyRequirements) Steps(file string) []GalaxyStep {
+	var steps []GalaxyStep
+	if len(r.Roles) > 0 {
+		steps = append(steps, GalaxyStep{
+			Kind:    GalaxyRoles,
+			Entries: r.Roles,
+			Args:    []string{"install", "-r", file},
+		})
+	}
+	if len(r.Collections) > 0 {
+		steps = append(steps, GalaxyStep{
+			Kind:    GalaxyCollections,
+			Entries: r.Collections,
+			Args:    []string{"collection", "install", "-r", file},
+		})
+	}
+	return steps
+}
+
+// LocalSources returns the paths of the requirements installed from the
+// filesystem, as ansible-galaxy resolves them: the roles whose src is a
+// file:// URL or an existing path, and the collections of type dir, file or
+// subdirs, or without a type and whose name is an existing path.
+func (r *GalaxyRequirements) LocalSources() []string {
+	var paths []string
+	for _, role := range r.Roles {
+		if role.SCM != "" {
+			continue
+		}
+		if path := strings.TrimPrefix(role.Src, "file://"); path != role.Src {
+			paths = append(paths, path)
+		} else if isLocalPath(role.Src) {
+			paths = append(paths, role.Src)
+		}
+	}
+	for _, collection := range r.Collections {
+		switch collection.Type {
+		case "dir", "file", "subdirs":
+			paths = append(paths, collection.Name)
+		case "":
+			if isLocalPath(collection.Name) {
+				paths = append(paths, collection.Name)
+			}
+		}
+	}
+	return paths
+}
+
+func isLocalPath(path string) bool {
+	if path == "" || strings.Contains(path, "://") {
+		return false
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+var (
+	// - geerlingguy.docker (6.1.0) was installed successfully
+	galaxyRoleInstalledRe = regexp.MustCompile(`^- (\S+) \(([^)]*)\) was installed successfully`)
+	// community.general:8.2.0 was installed successfully
+	galaxyCollectionInstalledRe = regexp.MustCompile(`^(\S+):(\S+) was installed successfully`)
+)
+
+// GalaxyUi wraps a packersdk.Ui and reports each role or collection as
+// ansible-galaxy installs it.
+type GalaxyUi struct {
+	packersdk.Ui
+	Step GalaxyStep
+}
+
+// Start reports the entries about to be installed.
+func (u *GalaxyUi) Start() {
+	names := make([]string, len(u.Step.Entries))
+	for i, e := range u.Step.Entries {
+		names[i] = e.String()
+	}
+	u.Ui.Say(fmt.Sprintf("Installing %d %s: %s", len(names), u.Step.Kind, strings.Join(names, ", ")))
+}
+
+func (u *GalaxyUi) Say(line string) {
+	u.Ui.Say(line)
+	re := galaxyRoleInstalledRe
+	if u.Step.Kind == GalaxyCollections {
+		re = galaxyCollectionInstalledRe
+	}
+	if m := re.FindStringSubmatch(strings.TrimSpace(line)); m != nil {
+		u.Ui.Message(fmt.Sprintf("Installed %s %s (%s)", strings.TrimSuffix(u.Step.Kind, "s"), m[1], m[2]))
+	}
+}
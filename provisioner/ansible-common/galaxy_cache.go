@@ -0,0 +1,119 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblecommon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// GalaxyCache is a directory of galaxy installs reused across builds. Each
+// entry is a directory named after its key, with the installed roles and
+// collections in its GalaxyRoles and GalaxyCollections subdirectories.
+type GalaxyCache struct {
+	Dir string
+}
+
+// GalaxyCacheKey returns the key of the install of requirements by the
+// ansible-galaxy printing galaxyVersion with `--version`, with the extra
+// flags and the environment env. Only the ANSIBLE_GALAXY_ variables of env,
+// which select the galaxy servers and their tokens, are part of the key.
+// The files under the local sources of the requirements, see
+// GalaxyRequirements.LocalSources, are keyed by their name, size and
+// modification time, so that a change to them is installed again.
+func GalaxyCacheKey(requirements []byte, galaxyVersion string, flags, env, localSources []string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "requirements=%q\n", requirements)
+	fmt.Fprintf(h, "version=%q\n", galaxyVersion)
+	for _, flag := range flags {
+		fmt.Fprintf(h, "flag=%q\n", flag)
+	}
+	// The last value of a variable wins.
+	galaxyEnv := map[string]string{}
+	for _, v := range env {
+		if name, value, _ := strings.Cut(v, "="); strings.HasPrefix(name, "ANSIBLE_GALAXY_") {
+			galaxyEnv[name] = value
+		}
+	}
+	names := make([]string, 0, len(galaxyEnv))
+	for name := range galaxyEnv {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "env=%q %q\n", name, galaxyEnv[name])
+	}
+	for _, source := range localSources {
+		fmt.Fprintf(h, "source=%q\n", source)
+		err := filepath.WalkDir(source, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() {
+				fmt.Fprintf(h, "file=%q %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+			}
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return "", fmt.Errorf("galaxy cache key: %s", err)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+// Entry returns the directory of the entry of key.
+func (c *GalaxyCache) Entry(key string) string {
+	return filepath.Join(c.Dir, key)
+}
+
+// Get returns the directory of the entry of key and whether it exists.
+// Entries are only created complete, by Fill.
+func (c *GalaxyCache) Get(key string) (string, bool) {
+	dir := c.Entry(key)
+	info, err := os.Stat(dir)
+	return dir, err == nil && info.IsDir()
+}
+
+// Fill creates the entry of key, calling install to install the requirements
+// in a temporary directory which is then renamed to the entry. If another
+// build created the entry in the meantime, its entry is kept.
+func (c *GalaxyCache) Fill(key string, install func(dir string) error) (string, error) {
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return "", err
+	}
+	tmpDir, err := os.MkdirTemp(c.Dir, ".tmp-"+key+"-")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	for _, kind := range []string{GalaxyRoles, GalaxyCollections} {
+		if err := os.Mkdir(filepath.Join(tmpDir, kind), 0755); err != nil {
+			return "", err
+		}
+	}
+
+	if err := install(tmpDir); err != nil {
+		return "", err
+	}
+	dir := c.Entry(key)
+	if err := os.Rename(tmpDir, dir); err != nil {
+		if _, ok := c.Get(key); ok {
+			return dir, nil
+		}
+		return "", err
+	}
+	return dir, nil
+}
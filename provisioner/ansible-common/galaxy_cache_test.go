@@ -0,0 +1,119 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblecommon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGalaxyCacheKey(t *testing.T) {
+	cacheKey := func(requirements, version string, flags, env []string) string {
+		key, err := GalaxyCacheKey([]byte(requirements), version, flags, env, nil)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return key
+	}
+
+	key := cacheKey("roles:\n  - src: geerlingguy.docker\n", "ansible-galaxy [core 2.16.3]", nil, nil)
+	assert.Len(t, key, 16)
+	assert.Equal(t, key, cacheKey("roles:\n  - src: geerlingguy.docker\n", "ansible-galaxy [core 2.16.3]", nil, nil))
+
+	for _, other := range []string{
+		cacheKey("roles:\n  - src: geerlingguy.java\n", "ansible-galaxy [core 2.16.3]", nil, nil),
+		cacheKey("roles:\n  - src: geerlingguy.docker\n", "ansible-galaxy [core 2.17.0]", nil, nil),
+		cacheKey("roles:\n  - src: geerlingguy.docker\n", "ansible-galaxy [core 2.16.3]", []string{"-f"}, nil),
+		cacheKey("roles:\n  - src: geerlingguy.docker\n", "ansible-galaxy [core 2.16.3]", nil,
+			[]string{"ANSIBLE_GALAXY_SERVER=https://galaxy.example.com"}),
+	} {
+		assert.NotEqual(t, key, other)
+	}
+
+	env := []string{"ANSIBLE_GALAXY_SERVER_LIST=internal", "ANSIBLE_GALAXY_SERVER_INTERNAL_TOKEN=one"}
+	key = cacheKey("roles:\n  - src: geerlingguy.docker\n", "ansible-galaxy [core 2.16.3]", nil, env)
+	assert.Equal(t, key, cacheKey("roles:\n  - src: geerlingguy.docker\n", "ansible-galaxy [core 2.16.3]", nil,
+		append([]string{"HOME=/root"}, env...)), "only the galaxy variables should be part of the key")
+	assert.NotEqual(t, key, cacheKey("roles:\n  - src: geerlingguy.docker\n", "ansible-galaxy [core 2.16.3]", nil,
+		append(env, "ANSIBLE_GALAXY_SERVER_INTERNAL_TOKEN=two")), "the last value of a variable should be part of the key")
+}
+
+func TestGalaxyCacheKey_LocalSources(t *testing.T) {
+	role := filepath.Join(t.TempDir(), "web")
+	task := filepath.Join(role, "tasks", "main.yml")
+	if err := os.MkdirAll(filepath.Dir(task), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := os.WriteFile(task, []byte("- debug: msg=one\n"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	requirements := []byte("roles:\n  - src: " + role + "\n")
+	key, err := GalaxyCacheKey(requirements, "ansible-galaxy [core 2.16.3]", nil, nil, []string{role})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	same, _ := GalaxyCacheKey(requirements, "ansible-galaxy [core 2.16.3]", nil, nil, []string{role})
+	assert.Equal(t, key, same)
+
+	if err := os.WriteFile(task, []byte("- debug: msg=two, changed\n"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	changed, err := GalaxyCacheKey(requirements, "ansible-galaxy [core 2.16.3]", nil, nil, []string{role})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	assert.NotEqual(t, key, changed, "a change to a local role should change the key")
+
+	// ansible-galaxy reports the missing sources itself.
+	_, err = GalaxyCacheKey(requirements, "ansible-galaxy [core 2.16.3]", nil, nil, []string{filepath.Join(role, "missing")})
+	assert.NoError(t, err)
+}
+
+func TestGalaxyCache_Fill(t *testing.T) {
+	cache := &GalaxyCache{Dir: filepath.Join(t.TempDir(), "galaxy")}
+
+	_, ok := cache.Get("abc")
+	assert.False(t, ok)
+
+	_, err := cache.Fill("abc", func(dir string) error {
+		assert.DirExists(t, filepath.Join(dir, GalaxyRoles))
+		assert.DirExists(t, filepath.Join(dir, GalaxyCollections))
+		return fmt.Errorf("galaxy is down")
+	})
+	assert.EqualError(t, err, "galaxy is down")
+	_, ok = cache.Get("abc")
+	assert.False(t, ok, "a failed install should not be cached")
+
+	dir, err := cache.Fill("abc", func(dir string) error {
+		return os.Mkdir(filepath.Join(dir, GalaxyRoles, "geerlingguy.docker"), 0755)
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	assert.Equal(t, cache.Entry("abc"), dir)
+	got, ok := cache.Get("abc")
+	assert.True(t, ok)
+	assert.Equal(t, dir, got)
+	assert.DirExists(t, filepath.Join(dir, GalaxyRoles, "geerlingguy.docker"))
+
+	// The entry filled first by a concurrent build is kept.
+	dir, err = cache.Fill("abc", func(dir string) error {
+		return os.Mkdir(filepath.Join(dir, GalaxyRoles, "geerlingguy.java"), 0755)
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	assert.DirExists(t, filepath.Join(dir, GalaxyRoles, "geerlingguy.docker"))
+
+	entries, err := os.ReadDir(cache.Dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	assert.Len(t, entries, 1, "temporary directories should be removed")
+}
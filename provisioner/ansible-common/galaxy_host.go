@@ -0,0 +1,76 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblecommon
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// RunHostGalaxy runs the ansible-galaxy command with args and the
+// environment env on the machine running Packer. Its output is shown in ui
+// line by line, and it is stopped like StopOnCancel with the given grace
+// periods once ctx is done.
+func RunHostGalaxy(ctx context.Context, ui packersdk.Ui, command string, args, env []string, interruptGrace, terminateGrace time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cmd := exec.Command(command, args...)
+	cmd.Env = env
+	SetProcessGroup(cmd)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	wg := sync.WaitGroup{}
+	repeat := func(r io.ReadCloser) {
+		reader := bufio.NewReader(r)
+		for {
+			line, err := reader.ReadString('\n')
+			if line != "" {
+				line = strings.TrimRightFunc(line, unicode.IsSpace)
+				ui.Say(line)
+			}
+			if err != nil {
+				if err != io.EOF {
+					ui.Error(err.Error())
+				}
+				break
+			}
+		}
+		wg.Done()
+	}
+	wg.Add(2)
+	go repeat(stdout)
+	go repeat(stderr)
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	stop := StopOnCancel(ctx, ui, cmd.Process, interruptGrace, terminateGrace)
+	wg.Wait()
+	err = cmd.Wait()
+	stop()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("Non-zero exit status: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !windows
+// +build !windows
+
+package ansiblecommon
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunHostGalaxy(t *testing.T) {
+	galaxy := filepath.Join(t.TempDir(), "ansible-galaxy")
+	started := filepath.Join(t.TempDir(), "started")
+	script := fmt.Sprintf("#!/bin/sh\ntouch %q\necho \"install $* $GALAXY_TOKEN\"\necho 'warning' >&2\nexit \"$EXIT\"\n", started)
+	if err := os.WriteFile(galaxy, []byte(script), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	out := new(bytes.Buffer)
+	ui := &packersdk.BasicUi{Reader: new(bytes.Buffer), Writer: out, ErrorWriter: out}
+	err := RunHostGalaxy(context.Background(), ui, galaxy, []string{"install", "-r", "requirements.yml"},
+		[]string{"GALAXY_TOKEN=token", "EXIT=0"}, time.Second, time.Second)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	assert.Contains(t, out.String(), "install install -r requirements.yml token\n")
+	assert.Contains(t, out.String(), "warning\n")
+
+	err = RunHostGalaxy(context.Background(), ui, galaxy, nil, []string{"EXIT=2"}, time.Second, time.Second)
+	assert.EqualError(t, err, "Non-zero exit status: exit status 2")
+
+	os.Remove(started)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = RunHostGalaxy(ctx, ui, galaxy, nil, []string{"EXIT=0"}, time.Second, time.Second)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.NoFileExists(t, started, "ansible-galaxy should not start once cancelled")
+}
+
+func TestRunHostGalaxy_CancelChildren(t *testing.T) {
+	// The background child ignores the signals like the forked workers of
+	// Ansible may, and keeps the output pipes open.
+	galaxy := filepath.Join(t.TempDir(), "ansible-galaxy")
+	script := "#!/bin/sh\ntrap '' INT TERM\nsleep 30 &\necho started\nwait\n"
+	if err := os.WriteFile(galaxy, []byte(script), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- RunHostGalaxy(ctx, packersdk.TestUi(t), galaxy, nil, nil, 50*time.Millisecond, 50*time.Millisecond)
+	}()
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(10 * time.Second):
+		t.Fatal("ansible-galaxy was not stopped along with its children")
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblecommon
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeGalaxyFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return path
+}
+
+func TestParseGalaxyFile(t *testing.T) {
+	dir := t.TempDir()
+	writeGalaxyFile(t, dir, "more-roles.yml", `
+- src: https://github.com/example/ansible-role-nginx.git
+  scm: git
+  version: v2.0.0
+  name: nginx
+`)
+
+	testcases := []struct {
+		name     string
+		content  string
+		expected GalaxyRequirements
+	}{
+		{
+			name: "roles list",
+			content: `
+# roles:
+- geerlingguy.docker
+- geerlingguy.java,2.3.0,java
+- include: more-roles.yml
+`,
+			expected: GalaxyRequirements{
+				Roles: []GalaxyRequirement{
+					{Src: "geerlingguy.docker"},
+					{Src: "geerlingguy.java", Version: "2.3.0", Name: "java"},
+					{Src: "https://github.com/example/ansible-role-nginx.git", SCM: "git", Version: "v2.0.0", Name: "nginx"},
+				},
+			},
+		},
+		{
+			name: "roles and collections",
+			content: `---
+# collections:
+#   - community.docker
+roles:
+    - name: geerlingguy.docker
+      version: 6.1.0
+collections:
+  - community.general
+  - name: https://github.com/example/collection.git
+    type: git
+    version: main
+  - name: example.private
+    source: https://galaxy.example.com
+    signatures:
+      - file:///keys/example.asc
+`,
+			expected: GalaxyRequirements{
+				Roles: []GalaxyRequirement{
+					{Name: "geerlingguy.docker", Version: "6.1.0"},
+				},
+				Collections: []GalaxyRequirement{
+					{Name: "community.general"},
+					{Name: "https://github.com/example/collection.git", Type: "git", Version: "main"},
+					{Name: "example.private", Source: "https://galaxy.example.com", Extra: map[string]interface{}{
+						"signatures": []interface{}{"file:///keys/example.asc"},
+					}},
+				},
+			},
+		},
+		{
+			name:     "collections only",
+			content:  "collections:\n  - community.general\nroles:\n",
+			expected: GalaxyRequirements{Collections: []GalaxyRequirement{{Name: "community.general"}}},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeGalaxyFile(t, dir, "requirements.yml", tc.content)
+			reqs, err := ParseGalaxyFile(path)
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			assert.Equal(t, tc.expected, *reqs)
+
+			// The rendered requirements parse back to the same requirements.
+			b, err := reqs.YAML()
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			reqs, err = ParseGalaxyFile(writeGalaxyFile(t, t.TempDir(), "requirements.yml", string(b)))
+			if err != nil {
+				t.Fatalf("err: %s\n%s", err, b)
+			}
+			assert.Equal(t, tc.expected, *reqs)
+		})
+	}
+}
+
+func TestParseGalaxyFile_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	writeGalaxyFile(t, dir, "self.yml", "- include: self.yml\n")
+
+	testcases := []struct {
+		name          string
+		content       string
+		expectedError string
+	}{
+		{"unknown key", "roles: []\nplaybooks: []\n", `requirements.yml:2: unknown key "playbooks"`},
+		{"role without src", "- version: 1.0.0\n", "requirements.yml:1: a role must have a src or a name"},
+		{"unknown scm", "- src: example.role\n  scm: svn\n", `role example.role: unknown scm "svn"`},
+		{"collection without name", "collections:\n  - version: 1.0.0\n", "requirements.yml:2: a collection must have a name"},
+		{"unknown type", "collections:\n  - name: example.col\n    type: svn\n", `collection example.col: unknown type "svn"`},
+		{"collection with src", "collections:\n  - name: example.col\n    src: example.col\n", "scm and src are only valid for roles"},
+		{"missing include", "- include: missing.yml\n", "missing.yml: no such file"},
+		{"recursive include", "- include: self.yml\n", "is included recursively"},
+		{"not a list", "roles: geerlingguy.docker\n", "roles must be a list"},
+		{"invalid yaml", "roles: [\n", "requirements.yml: yaml:"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseGalaxyFile(writeGalaxyFile(t, dir, "requirements.yml", tc.content))
+			if err == nil {
+				t.Fatal("should have error")
+			}
+			assert.Contains(t, err.Error(), tc.expectedError)
+		})
+	}
+}
+
+func TestGalaxyRequirements_Steps(t *testing.T) {
+	reqs := &GalaxyRequirements{
+		Roles:       []GalaxyRequirement{{Src: "geerlingguy.docker"}},
+		Collections: []GalaxyRequirement{{Name: "community.general", Version: ">=8.0.0"}},
+	}
+	steps := reqs.Steps("requirements.yml")
+	assert.Equal(t, []GalaxyStep{
+		{Kind: GalaxyRoles, Entries: reqs.Roles, Args: []string{"install", "-r", "requirements.yml"}},
+		{Kind: GalaxyCollections, Entries: reqs.Collections, Args: []string{"collection", "install", "-r", "requirements.yml"}},
+	}, steps)
+
+	assert.Empty(t, (&GalaxyRequirements{}).Steps("requirements.yml"))
+}
+
+func TestGalaxyRequirements_LocalSources(t *testing.T) {
+	dir := t.TempDir()
+	role := filepath.Join(dir, "web")
+	if err := os.Mkdir(role, 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	tarball := writeGalaxyFile(t, dir, "db.tar.gz", "")
+	collection := filepath.Join(dir, "my.collection")
+
+	reqs := &GalaxyRequirements{
+		Roles: []GalaxyRequirement{
+			{Src: "geerlingguy.docker"},
+			{Src: "https://github.com/geerlingguy/ansible-role-java", SCM: "git"},
+			{Src: role},
+			{Src: "file://" + tarball},
+			{Src: filepath.Join(dir, "missing")},
+		},
+		Collections: []GalaxyRequirement{
+			{Name: "community.general"},
+			{Name: collection, Type: "dir"},
+			{Name: tarball},
+			{Name: "https://example.com/my-collection.tar.gz", Type: "url"},
+		},
+	}
+	assert.Equal(t, []string{role, tarball, collection, tarball}, reqs.LocalSources())
+	assert.Empty(t, (&GalaxyRequirements{}).LocalSources())
+}
+
+func TestGalaxyUi(t *testing.T) {
+	out := new(bytes.Buffer)
+	basicUi := &packersdk.BasicUi{Reader: new(bytes.Buffer), Writer: out, ErrorWriter: out}
+
+	ui := &GalaxyUi{Ui: basicUi, Step: GalaxyStep{
+		Kind:    GalaxyCollections,
+		Entries: []GalaxyRequirement{{Name: "community.general", Version: "8.2.0"}, {Name: "community.docker"}},
+	}}
+	ui.Start()
+	ui.Say("Installing 'community.general:8.2.0' to '/root/.ansible/collections/ansible_collections/community/general'")
+	ui.Say("community.general:8.2.0 was installed successfully")
+	ui.Say("- geerlingguy.docker (6.1.0) was installed successfully")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, "Installing 2 collections: community.general (8.2.0), community.docker", lines[0])
+	assert.Contains(t, out.String(), "Installed collection community.general (8.2.0)")
+	assert.NotContains(t, out.String(), "Installed collection geerlingguy.docker", "role lines should not be reported as collections")
+
+	out.Reset()
+	ui = &GalaxyUi{Ui: basicUi, Step: GalaxyStep{Kind: GalaxyRoles, Entries: []GalaxyRequirement{{Src: "geerlingguy.docker"}}}}
+	ui.Say("- geerlingguy.docker (6.1.0) was installed successfully")
+	assert.Contains(t, out.String(), "Installed role geerlingguy.docker (6.1.0)")
+}
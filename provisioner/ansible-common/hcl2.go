@@ -0,0 +1,92 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblecommon
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/zclconf/go-cty/cty"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+// DynamicAttributes makes the given attributes of spec accept values of any
+// type, such as maps of booleans, numbers, lists and nested maps, which the
+// generated HCL2 specs only accept as maps of strings.
+//
+// The configuration must then be passed through DecodeDynamicValues before
+// being decoded.
+func DynamicAttributes(spec hcldec.ObjectSpec, names ...string) hcldec.ObjectSpec {
+	for _, name := range names {
+		spec[name] = &hcldec.AttrSpec{Name: name, Type: cty.DynamicPseudoType, Required: false}
+	}
+	return spec
+}
+
+// DecodeDynamicValues converts the HCL2 values in raws into maps, so that
+// config.Decode decodes them with mapstructure. config.Decode would otherwise
+// first decode HCL2 values into the flat configuration, which fails for
+// attributes of any type. Like config.Decode, it resets target to its zero
+// value if raws hold HCL2 values, as a provisioner may be prepared twice.
+func DecodeDynamicValues(target interface{}, raws []interface{}) error {
+	for i, raw := range raws {
+		cval, ok := raw.(cty.Value)
+		if !ok {
+			continue
+		}
+		b, err := ctyjson.SimpleJSONValue{Value: cval}.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal(b, &m); err != nil {
+			return err
+		}
+		raws[i] = m
+
+		t := reflect.ValueOf(target).Elem()
+		t.Set(reflect.Zero(t.Type()))
+	}
+	return nil
+}
+
+// NormalizeValue returns v with the whole numbers decoded as float64, as done
+// when decoding JSON or HCL2, turned back into integers. This keeps them
+// from being written as floats, such as 1e+07, to YAML or JSON files.
+func NormalizeValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v)
+		}
+		return v
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = NormalizeValue(e)
+		}
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			out[k] = NormalizeValue(e)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// GroupChildrenSpec returns the HCL2 spec of a map of child groups by
+// parent group name, which the generated HCL2 specs can't express.
+func GroupChildrenSpec(name string) hcldec.Spec {
+	return &hcldec.AttrSpec{Name: name, Type: cty.Map(cty.List(cty.String)), Required: false}
+}
+
+// ExtraVarsJSON serializes extra variables for `ansible-playbook -e @file`.
+func ExtraVarsJSON(vars map[string]interface{}) ([]byte, error) {
+	return json.Marshal(NormalizeValue(vars))
+}
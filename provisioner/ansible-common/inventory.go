@@ -0,0 +1,240 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblecommon
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Inventory describes an inventory of a single host, generated by Packer.
+type Inventory struct {
+	// The alias of the host.
+	Host string
+	// The variables of the host, including the connection variables.
+	HostVars map[string]interface{}
+	// The groups the host belongs to. A group that has children is replaced
+	// by its leaf groups.
+	Groups []string
+	// The groups that are present but have no host.
+	EmptyGroups []string
+	// The children of the parent groups, by parent group name.
+	GroupChildren map[string][]string
+	// The variables of the groups by group name, including `all`.
+	GroupVars map[string]map[string]interface{}
+}
+
+// Validate checks that the group hierarchy has no cycle and that every
+// group of GroupVars is present.
+func (inv *Inventory) Validate() error {
+	parents := make([]string, 0, len(inv.GroupChildren))
+	for parent := range inv.GroupChildren {
+		parents = append(parents, parent)
+	}
+	sort.Strings(parents)
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := map[string]int{}
+	var visit func(group string, path []string) error
+	visit = func(group string, path []string) error {
+		switch state[group] {
+		case visiting:
+			return fmt.Errorf("group_children: cycle between groups %s", strings.Join(append(path[:len(path):len(path)], group), " -> "))
+		case visited:
+			return nil
+		}
+		state[group] = visiting
+		for _, child := range inv.GroupChildren[group] {
+			if child == "all" {
+				return fmt.Errorf("group_children: all can't be a child group")
+			}
+			if err := visit(child, append(path[:len(path):len(path)], group)); err != nil {
+				return err
+			}
+		}
+		state[group] = visited
+		return nil
+	}
+	for _, parent := range parents {
+		if parent == "all" {
+			return fmt.Errorf("group_children: all can't be a parent group")
+		}
+		if err := visit(parent, nil); err != nil {
+			return err
+		}
+	}
+
+	groups := map[string]bool{"all": true}
+	for _, group := range inv.groups() {
+		groups[group] = true
+	}
+	for group := range inv.GroupVars {
+		if !groups[group] {
+			return fmt.Errorf("group_vars: group %q must be listed in groups, empty_groups or group_children", group)
+		}
+	}
+	return nil
+}
+
+// groups returns every group of the inventory but `all`, in the order in
+// which they are written to INI inventories: the groups of the host first.
+func (inv *Inventory) groups() []string {
+	var groups []string
+	seen := map[string]bool{}
+	add := func(group string) {
+		if !seen[group] {
+			seen[group] = true
+			groups = append(groups, group)
+		}
+	}
+	for _, group := range inv.HostGroups() {
+		add(group)
+	}
+	for _, group := range inv.EmptyGroups {
+		add(group)
+	}
+	for _, parent := range inv.parents() {
+		for _, child := range inv.GroupChildren[parent] {
+			add(child)
+		}
+	}
+	for _, parent := range inv.parents() {
+		add(parent)
+	}
+	return groups
+}
+
+// parents returns the parent groups, sorted.
+func (inv *Inventory) parents() []string {
+	parents := make([]string, 0, len(inv.GroupChildren))
+	for parent, children := range inv.GroupChildren {
+		if len(children) > 0 {
+			parents = append(parents, parent)
+		}
+	}
+	sort.Strings(parents)
+	return parents
+}
+
+// HostGroups returns the leaf groups the host is placed in: the groups of
+// Groups, where parent groups are replaced by their leaf groups.
+func (inv *Inventory) HostGroups() []string {
+	var groups []string
+	seen := map[string]bool{}
+	var add func(group string)
+	add = func(group string) {
+		if seen[group] {
+			return
+		}
+		seen[group] = true
+		children := inv.GroupChildren[group]
+		if len(children) == 0 {
+			groups = append(groups, group)
+			return
+		}
+		for _, child := range children {
+			add(child)
+		}
+	}
+	for _, group := range inv.Groups {
+		add(group)
+	}
+	return groups
+}
+
+// INIGroups renders the groups of the inventory in the INI format, hostLine
+// being the line written in the groups of the host.
+func (inv *Inventory) INIGroups(hostLine string) string {
+	var b strings.Builder
+	hostGroups := map[string]bool{}
+	for _, group := range inv.HostGroups() {
+		hostGroups[group] = true
+	}
+	for _, group := range inv.groups() {
+		if len(inv.GroupChildren[group]) > 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "[%s]\n", group)
+		if hostGroups[group] {
+			b.WriteString(hostLine)
+		}
+	}
+	for _, parent := range inv.parents() {
+		fmt.Fprintf(&b, "[%s:children]\n%s\n", parent, strings.Join(inv.GroupChildren[parent], "\n"))
+	}
+	return b.String()
+}
+
+// yamlGroup is a group in the format of Ansible's yaml inventory plugin.
+type yamlGroup struct {
+	Hosts    map[string]interface{} `yaml:"hosts,omitempty"`
+	Vars     interface{}            `yaml:"vars,omitempty"`
+	Children map[string]*yamlGroup  `yaml:"children,omitempty"`
+}
+
+// YAML renders the inventory in the format of Ansible's yaml inventory
+// plugin. Variables keep their type, and child groups are nested in their
+// parent groups.
+func (inv *Inventory) YAML() ([]byte, error) {
+	if err := inv.Validate(); err != nil {
+		return nil, err
+	}
+
+	all := &yamlGroup{
+		Hosts: map[string]interface{}{inv.Host: normalizeVars(inv.HostVars)},
+		Vars:  normalizeVars(inv.GroupVars["all"]),
+	}
+	groups := map[string]*yamlGroup{}
+	for _, group := range inv.groups() {
+		groups[group] = &yamlGroup{Vars: normalizeVars(inv.GroupVars[group])}
+	}
+	for _, group := range inv.HostGroups() {
+		groups[group].Hosts = map[string]interface{}{inv.Host: nil}
+	}
+	isChild := map[string]bool{}
+	for parent, children := range inv.GroupChildren {
+		for _, child := range children {
+			isChild[child] = true
+			if groups[parent].Children == nil {
+				groups[parent].Children = map[string]*yamlGroup{}
+			}
+			groups[parent].Children[child] = groups[child]
+		}
+	}
+	for name, group := range groups {
+		if isChild[name] {
+			continue
+		}
+		if all.Children == nil {
+			all.Children = map[string]*yamlGroup{}
+		}
+		all.Children[name] = group
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(map[string]*yamlGroup{"all": all}); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// normalizeVars returns nil for empty variables, so that they are omitted.
+func normalizeVars(vars map[string]interface{}) interface{} {
+	if len(vars) == 0 {
+		return nil
+	}
+	return NormalizeValue(vars)
+}
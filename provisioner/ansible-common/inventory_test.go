@@ -0,0 +1,151 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblecommon
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInventory_YAML(t *testing.T) {
+	inv := &Inventory{
+		Host: "default",
+		HostVars: map[string]interface{}{
+			"ansible_host":               "127.0.0.1",
+			"ansible_port":               float64(2222),
+			"ansible_python_interpreter": "/usr/bin/python3",
+			"disks":                      []interface{}{"/dev/sdb", "/dev/sdc"},
+			"swap":                       false,
+			"enabled":                    "yes",
+		},
+		Groups:      []string{"web", "db"},
+		EmptyGroups: []string{"cache"},
+		GroupVars: map[string]map[string]interface{}{
+			"all": {"ntp_server": "pool.ntp.org"},
+			"web": {
+				"http_port": float64(10000000),
+				"tls":       map[string]interface{}{"enabled": true, "ratio": 0.5},
+			},
+			"cache": {"size": float64(64)},
+		},
+	}
+
+	b, err := inv.YAML()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	assert.Equal(t, `all:
+  hosts:
+    default:
+      ansible_host: 127.0.0.1
+      ansible_port: 2222
+      ansible_python_interpreter: /usr/bin/python3
+      disks:
+        - /dev/sdb
+        - /dev/sdc
+      enabled: "yes"
+      swap: false
+  vars:
+    ntp_server: pool.ntp.org
+  children:
+    cache:
+      vars:
+        size: 64
+    db:
+      hosts:
+        default: null
+    web:
+      hosts:
+        default: null
+      vars:
+        http_port: 10000000
+        tls:
+          enabled: true
+          ratio: 0.5
+`, string(b))
+}
+
+func TestInventory_Validate(t *testing.T) {
+	inv := &Inventory{
+		Host:      "default",
+		Groups:    []string{"web"},
+		GroupVars: map[string]map[string]interface{}{"db": {"port": 5432}},
+	}
+	if err := inv.Validate(); err == nil {
+		t.Fatal("group_vars of an unknown group should be rejected")
+	}
+
+	for _, children := range []map[string][]string{
+		{"web": {"web"}},
+		{"linux": {"web"}, "web": {"nginx"}, "nginx": {"linux"}},
+		{"all": {"web"}},
+		{"web": {"all"}},
+	} {
+		inv := &Inventory{Host: "default", GroupChildren: children}
+		if err := inv.Validate(); err == nil {
+			t.Fatalf("group_children %v should be rejected", children)
+		}
+	}
+	if _, err := inv.YAML(); err == nil {
+		t.Fatal("group_vars of an unknown group should be rejected")
+	}
+}
+
+func TestInventory_GroupChildren(t *testing.T) {
+	inv := &Inventory{
+		Host:        "default",
+		Groups:      []string{"linux", "cache"},
+		EmptyGroups: []string{"windows"},
+		GroupChildren: map[string][]string{
+			"linux":   {"web", "db"},
+			"servers": {"linux", "windows"},
+		},
+		GroupVars: map[string]map[string]interface{}{
+			"servers": {"ntp": true},
+		},
+	}
+	assert.Equal(t, []string{"web", "db", "cache"}, inv.HostGroups())
+
+	assert.Equal(t, `[web]
+127.0.0.1
+[db]
+127.0.0.1
+[cache]
+127.0.0.1
+[windows]
+[linux:children]
+web
+db
+[servers:children]
+linux
+windows
+`, inv.INIGroups("127.0.0.1\n"))
+
+	b, err := inv.YAML()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	assert.Equal(t, `all:
+  hosts:
+    default: null
+  children:
+    cache:
+      hosts:
+        default: null
+    servers:
+      vars:
+        ntp: true
+      children:
+        linux:
+          children:
+            db:
+              hosts:
+                default: null
+            web:
+              hosts:
+                default: null
+        windows: {}
+`, string(b))
+}
@@ -0,0 +1,81 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblecommon
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+)
+
+// runStats is the key of the custom stats set for the whole run, rather
+// than per host, by set_stats.
+const runStats = "_run"
+
+// Outputs collects the custom stats set with the set_stats module by the
+// playbooks of a run.
+type Outputs struct {
+	mu     sync.Mutex
+	values map[string]interface{}
+
+	// Masks the sensitive values in the written file.
+	Redactor *Redactor
+}
+
+// NewOutputs returns empty Outputs.
+func NewOutputs() *Outputs {
+	return &Outputs{values: map[string]interface{}{}}
+}
+
+// Record collects the custom stats of the stats event ending a playbook.
+// The stats of the run and of every host are merged in a single map, those
+// of the hosts last in the order of their names, and the stats of a
+// playbook override those of the previous ones.
+func (o *Outputs) Record(ev *Event) {
+	if ev.Event != "stats" {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	keys := make([]string, 0, len(ev.CustomStats))
+	for key := range ev.CustomStats {
+		if key != runStats {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if _, ok := ev.CustomStats[runStats]; ok {
+		keys = append([]string{runStats}, keys...)
+	}
+	for _, key := range keys {
+		stats, _ := ev.CustomStats[key].(map[string]interface{})
+		for name, value := range stats {
+			o.values[name] = value
+		}
+	}
+}
+
+// Values returns the collected custom stats.
+func (o *Outputs) Values() map[string]interface{} {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	values := make(map[string]interface{}, len(o.values))
+	for name, value := range o.values {
+		values[name] = value
+	}
+	return values
+}
+
+// WriteFile writes the collected custom stats to path as a JSON object,
+// with the sensitive values masked.
+func (o *Outputs) WriteFile(path string) error {
+	b, err := json.MarshalIndent(o.Values(), "", "  ")
+	if err != nil {
+		return err
+	}
+	b = []byte(o.Redactor.String(string(b)))
+	return os.WriteFile(path, append(b, '\n'), 0644)
+}
@@ -0,0 +1,75 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblecommon
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutputs(t *testing.T) {
+	o := NewOutputs()
+	for _, line := range []string{
+		EventPrefix + `{"event": "play_start", "play": "site"}`,
+		EventPrefix + `{"event": "stats", "custom_stats": {"_run": {"agent_version": "7.52.0", "hostname": "run"}}}`,
+		EventPrefix + `{"event": "stats", "custom_stats": {` +
+			`"zz": {"hostname": "zz"}, "default": {"hostname": "default", "ports": [80, 443]}, ` +
+			`"_run": {"agent_version": "7.53.0", "hostname": "run"}}}`,
+		EventPrefix + `{"event": "stats", "stats": {"default": {"ok": 1}}}`,
+	} {
+		ev, ok := ParseEvent(line)
+		if !ok {
+			t.Fatalf("invalid event %s", line)
+		}
+		o.Record(ev)
+	}
+	assert.Equal(t, map[string]interface{}{
+		"agent_version": "7.53.0",
+		"hostname":      "zz",
+		"ports":         []interface{}{float64(80), float64(443)},
+	}, o.Values())
+
+	file := filepath.Join(t.TempDir(), "outputs.json")
+	if err := o.WriteFile(file); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	assert.JSONEq(t, `{"agent_version": "7.53.0", "hostname": "zz", "ports": [80, 443]}`, string(b))
+
+	file = filepath.Join(t.TempDir(), "empty.json")
+	if err := NewOutputs().WriteFile(file); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	b, err = os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	assert.Equal(t, "{}\n", string(b))
+}
+
+func TestOutputs_Redactor(t *testing.T) {
+	o := NewOutputs()
+	o.Redactor = NewRedactor(`hun"ter2`)
+	ev, ok := ParseEvent(EventPrefix + `{"event": "stats", "custom_stats": {"_run": {"db_password": "hun\"ter2", "port": 5432}}}`)
+	if !ok {
+		t.Fatal("invalid event")
+	}
+	o.Record(ev)
+
+	file := filepath.Join(t.TempDir(), "outputs.json")
+	if err := o.WriteFile(file); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	assert.JSONEq(t, `{"db_password": "<sensitive>", "port": 5432}`, string(b))
+}
@@ -0,0 +1,64 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblecommon
+
+import (
+	"context"
+	"log"
+	"os"
+	"syscall"
+	"time"
+
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// Default grace periods used when stopping a cancelled Ansible process.
+const (
+	DefaultInterruptGracePeriod = 10 * time.Second
+	DefaultTerminateGracePeriod = 10 * time.Second
+)
+
+// StopOnCancel stops proc once ctx is done: it first sends SIGINT so that
+// Ansible can stop its workers, then SIGTERM after interruptGrace and finally
+// kills the process after terminateGrace. Signals that can't be delivered,
+// such as on Windows, skip straight to the next step. The signals are sent to
+// the whole process group of proc if it was started with SetProcessGroup.
+//
+// The returned function must be called once the process has exited.
+func StopOnCancel(ctx context.Context, ui packersdk.Ui, proc *os.Process, interruptGrace, terminateGrace time.Duration) func() {
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-exited:
+			return
+		case <-ctx.Done():
+		}
+
+		ui.Say("Cancelling Ansible, sending interrupt...")
+		for _, step := range []struct {
+			sig   syscall.Signal
+			grace time.Duration
+		}{
+			{syscall.SIGINT, interruptGrace},
+			{syscall.SIGTERM, terminateGrace},
+		} {
+			if err := signalGroup(proc, step.sig); err != nil {
+				log.Printf("[DEBUG] could not send %s to process %d: %s", step.sig, proc.Pid, err)
+				continue
+			}
+			select {
+			case <-exited:
+				return
+			case <-time.After(step.grace):
+				log.Printf("process %d did not exit within %s of %s", proc.Pid, step.grace, step.sig)
+			}
+		}
+
+		ui.Error("Ansible did not stop in time, killing it")
+		if err := signalGroup(proc, syscall.SIGKILL); err != nil {
+			log.Printf("[DEBUG] could not kill process %d: %s", proc.Pid, err)
+		}
+	}()
+	return func() { close(exited) }
+}
@@ -0,0 +1,33 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !windows
+// +build !windows
+
+package ansiblecommon
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// SetProcessGroup makes cmd start in a process group of its own, so that
+// StopOnCancel also stops the processes it starts, such as the forked
+// workers of Ansible and their ssh connections, which would otherwise keep
+// its output pipes open.
+func SetProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// signalGroup sends sig to the process group led by proc, or to proc alone
+// if it doesn't lead one.
+func signalGroup(proc *os.Process, sig syscall.Signal) error {
+	if err := syscall.Kill(-proc.Pid, sig); err == nil {
+		return nil
+	}
+	return proc.Signal(sig)
+}
@@ -0,0 +1,26 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build windows
+// +build windows
+
+package ansiblecommon
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// SetProcessGroup does nothing on Windows, where StopOnCancel can only kill
+// the process itself.
+func SetProcessGroup(cmd *exec.Cmd) {}
+
+// signalGroup kills proc on SIGKILL. Other signals can't be delivered on
+// Windows.
+func signalGroup(proc *os.Process, sig syscall.Signal) error {
+	if sig == syscall.SIGKILL {
+		return proc.Kill()
+	}
+	return proc.Signal(sig)
+}
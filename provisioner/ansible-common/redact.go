@@ -0,0 +1,138 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblecommon
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// Redacted replaces the sensitive values, like Packer does in its own
+// output.
+const Redacted = "<sensitive>"
+
+// Redactor masks sensitive values in strings. A nil Redactor masks nothing.
+type Redactor struct {
+	values []string
+}
+
+// NewRedactor returns a Redactor of the given values. Empty values are
+// ignored. The values are also masked in their JSON-escaped form, so that
+// they are masked in JSON documents too.
+func NewRedactor(values ...string) *Redactor {
+	seen := map[string]bool{}
+	r := &Redactor{}
+	add := func(v string) {
+		if v != "" && !seen[v] {
+			seen[v] = true
+			r.values = append(r.values, v)
+		}
+	}
+	for _, v := range values {
+		add(v)
+		if b, err := json.Marshal(v); err == nil {
+			add(string(b[1 : len(b)-1]))
+		}
+	}
+	// Mask the longest values first, so that a value containing another one
+	// is fully masked.
+	sort.SliceStable(r.values, func(i, j int) bool {
+		return len(r.values[i]) > len(r.values[j])
+	})
+	return r
+}
+
+// FilterLogs masks values in the logs of the plugin, through the secret
+// filter of the SDK.
+func FilterLogs(values ...string) {
+	var nonEmpty []string
+	for _, v := range values {
+		if v != "" {
+			nonEmpty = append(nonEmpty, v)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return
+	}
+	packersdk.LogSecretFilter.Set(nonEmpty...)
+	if log.Writer() != &packersdk.LogSecretFilter {
+		packersdk.LogSecretFilter.SetOutput(log.Writer())
+		log.SetOutput(&packersdk.LogSecretFilter)
+	}
+}
+
+// String returns s with the sensitive values masked.
+func (r *Redactor) String(s string) string {
+	if r == nil {
+		return s
+	}
+	for _, v := range r.values {
+		s = strings.ReplaceAll(s, v, Redacted)
+	}
+	return s
+}
+
+// Strings returns a copy of ss with the sensitive values masked.
+func (r *Redactor) Strings(ss []string) []string {
+	if ss == nil {
+		return nil
+	}
+	out := make([]string, len(ss))
+	for i, s := range ss {
+		out[i] = r.String(s)
+	}
+	return out
+}
+
+// Error returns err with the sensitive values masked in its message. The
+// returned error wraps err, so that errors.As and errors.Is still work.
+func (r *Redactor) Error(err error) error {
+	if err == nil || r == nil {
+		return err
+	}
+	msg := r.String(err.Error())
+	if msg == err.Error() {
+		return err
+	}
+	return &redactedError{msg: msg, err: err}
+}
+
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string { return e.msg }
+func (e *redactedError) Unwrap() error { return e.err }
+
+// RedactingUi wraps a packersdk.Ui and masks the sensitive values in every
+// line sent to it.
+type RedactingUi struct {
+	packersdk.Ui
+	Redactor *Redactor
+}
+
+func (u *RedactingUi) Ask(query string) (string, error) {
+	return u.Ui.Ask(u.Redactor.String(query))
+}
+
+func (u *RedactingUi) Say(message string) {
+	u.Ui.Say(u.Redactor.String(message))
+}
+
+func (u *RedactingUi) Message(message string) {
+	u.Ui.Message(u.Redactor.String(message))
+}
+
+func (u *RedactingUi) Error(message string) {
+	u.Ui.Error(u.Redactor.String(message))
+}
+
+func (u *RedactingUi) Machine(t string, args ...string) {
+	u.Ui.Machine(t, u.Redactor.Strings(args)...)
+}
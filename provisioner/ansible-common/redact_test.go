@@ -0,0 +1,67 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblecommon
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactor(t *testing.T) {
+	r := NewRedactor("hunter2", "", "hunter2-prod", `pa"ss\word`)
+
+	assert.Equal(t, "password=<sensitive> token=<sensitive>", r.String("password=hunter2 token=hunter2-prod"))
+	assert.Equal(t, `{"msg": "<sensitive>"}`, r.String(`{"msg": "pa\"ss\\word"}`),
+		"JSON-escaped values should be masked")
+	assert.Equal(t, "nothing to hide", r.String("nothing to hide"))
+	assert.Equal(t, "hunter2", (*Redactor)(nil).String("hunter2"))
+
+	err := &HostFailedError{ExitError{ExitCode: 2, Reason: "hunter2 leaked"}}
+	redacted := r.Error(err)
+	assert.NotContains(t, redacted.Error(), "hunter2")
+	var hostFailed *HostFailedError
+	assert.True(t, errors.As(redacted, &hostFailed), "redacted errors should wrap the original error")
+	assert.Nil(t, r.Error(nil))
+}
+
+func TestRedactingUi(t *testing.T) {
+	out := new(bytes.Buffer)
+	ui := &RedactingUi{
+		Ui:       &packersdk.BasicUi{Reader: new(bytes.Buffer), Writer: out, ErrorWriter: out},
+		Redactor: NewRedactor("hunter2"),
+	}
+	ui.Say("say hunter2")
+	ui.Message("message hunter2")
+	ui.Error("error hunter2")
+
+	assert.NotContains(t, out.String(), "hunter2")
+	assert.Equal(t, 3, strings.Count(out.String(), Redacted))
+}
+
+func TestReport_Redactor(t *testing.T) {
+	r := NewReport("")
+	r.Redactor = NewRedactor(`hun"ter2`)
+	r.StartPlaybook("site.yml", []string{"ansible-playbook", "-e", `password=hun"ter2`, "site.yml"})
+	r.Record(&Event{Event: "result", Status: "failed", Play: "web", Task: "start", Host: "default", Msg: `bad password hun"ter2`})
+	r.FinishPlaybook(2, nil)
+	r.Finish(errors.New(`failed with hun"ter2`))
+
+	path := filepath.Join(t.TempDir(), "report.json")
+	if err := r.WriteFile(path); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	assert.NotContains(t, string(b), "ter2")
+	assert.Contains(t, string(b), `"password=<sensitive>"`)
+}
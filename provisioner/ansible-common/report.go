@@ -0,0 +1,146 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblecommon
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Report is the machine-readable summary of an Ansible run written to
+// `report_file`.
+type Report struct {
+	Start           time.Time         `json:"start"`
+	End             time.Time         `json:"end"`
+	DurationSeconds float64           `json:"duration_seconds"`
+	Success         bool              `json:"success"`
+	Error           string            `json:"error,omitempty"`
+	AnsibleVersion  string            `json:"ansible_version,omitempty"`
+	PythonVersion   string            `json:"python_version,omitempty"`
+	Playbooks       []*PlaybookReport `json:"playbooks"`
+	// Redactor masks the sensitive values in the written report.
+	Redactor *Redactor `json:"-"`
+
+	mu sync.Mutex
+}
+
+// PlaybookReport is the summary of a single ansible-playbook execution.
+type PlaybookReport struct {
+	Playbook        string               `json:"playbook"`
+	Command         []string             `json:"command"`
+	Start           time.Time            `json:"start"`
+	End             time.Time            `json:"end"`
+	DurationSeconds float64              `json:"duration_seconds"`
+	ExitCode        int                  `json:"exit_code"`
+	Error           string               `json:"error,omitempty"`
+	Recap           map[string]HostStats `json:"recap,omitempty"`
+	FailedTasks     []FailedTask         `json:"failed_tasks,omitempty"`
+}
+
+// FailedTask is a task that failed, or a host that was unreachable, without
+// its errors being ignored.
+type FailedTask struct {
+	Play string `json:"play"`
+	Task string `json:"task"`
+	Host string `json:"host"`
+	Msg  string `json:"msg,omitempty"`
+}
+
+// NewReport starts a report. ansibleVersion may be empty, in which case the
+// version reported by the packer callback plugin is used.
+func NewReport(ansibleVersion string) *Report {
+	return &Report{
+		Start:          time.Now(),
+		AnsibleVersion: ansibleVersion,
+		Playbooks:      []*PlaybookReport{},
+	}
+}
+
+// StartPlaybook records the start of an ansible-playbook execution. command
+// must already be sanitized.
+func (r *Report) StartPlaybook(playbook string, command []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Playbooks = append(r.Playbooks, &PlaybookReport{
+		Playbook: playbook,
+		Command:  command,
+		Start:    time.Now(),
+	})
+}
+
+// Record adds an event of the current playbook to the report.
+func (r *Report) Record(ev *Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if ev.Event == "playbook_start" && r.AnsibleVersion == "" {
+		r.AnsibleVersion = ev.AnsibleVersion
+	}
+	if ev.Event == "playbook_start" && r.PythonVersion == "" {
+		r.PythonVersion = ev.PythonVersion
+	}
+	if len(r.Playbooks) == 0 {
+		return
+	}
+	pb := r.Playbooks[len(r.Playbooks)-1]
+	switch ev.Event {
+	case "result":
+		if (ev.Status == "failed" || ev.Status == "unreachable") && !ev.IgnoreErrors {
+			pb.FailedTasks = append(pb.FailedTasks, FailedTask{
+				Play: ev.Play,
+				Task: ev.Task,
+				Host: ev.Host,
+				Msg:  ev.Msg,
+			})
+		}
+	case "stats":
+		pb.Recap = ev.Stats
+	}
+}
+
+// FinishPlaybook records the end of the current ansible-playbook execution.
+func (r *Report) FinishPlaybook(exitCode int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.Playbooks) == 0 {
+		return
+	}
+	pb := r.Playbooks[len(r.Playbooks)-1]
+	pb.End = time.Now()
+	pb.DurationSeconds = pb.End.Sub(pb.Start).Seconds()
+	pb.ExitCode = exitCode
+	if err != nil {
+		pb.Error = err.Error()
+	}
+}
+
+// Finish records the end of the run.
+func (r *Report) Finish(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.End = time.Now()
+	r.DurationSeconds = r.End.Sub(r.Start).Seconds()
+	r.Success = err == nil
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+// WriteFile writes the report as JSON to path.
+func (r *Report) WriteFile(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = []byte(r.Redactor.String(string(b)))
+	return os.WriteFile(path, append(b, '\n'), 0644)
+}
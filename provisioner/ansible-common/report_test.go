@@ -0,0 +1,62 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblecommon
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReport(t *testing.T) {
+	r := NewReport("")
+	r.StartPlaybook("site.yml", []string{"ansible-playbook", "-e", "password=*****", "site.yml"})
+	for _, ev := range []*Event{
+		{Event: "playbook_start", Playbook: "site.yml", AnsibleVersion: "2.16.3"},
+		{Event: "result", Status: "failed", Play: "web", Task: "check", Host: "default", Msg: "nope", IgnoreErrors: true},
+		{Event: "result", Status: "failed", Play: "web", Task: "start", Host: "default", Msg: "boom"},
+		{Event: "stats", Stats: map[string]HostStats{"default": {Ok: 3, Failures: 1, Ignored: 1}}},
+	} {
+		r.Record(ev)
+	}
+	r.FinishPlaybook(2, errors.New("exit status 2"))
+	r.Finish(errors.New("Playbook site.yml failed"))
+
+	path := filepath.Join(t.TempDir(), "report.json")
+	if err := r.WriteFile(path); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var got Report
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	assert.False(t, got.Success)
+	assert.Equal(t, "Playbook site.yml failed", got.Error)
+	assert.Equal(t, "2.16.3", got.AnsibleVersion)
+	assert.False(t, got.End.Before(got.Start))
+	if assert.Len(t, got.Playbooks, 1) {
+		pb := got.Playbooks[0]
+		assert.Equal(t, "site.yml", pb.Playbook)
+		assert.Equal(t, []string{"ansible-playbook", "-e", "password=*****", "site.yml"}, pb.Command)
+		assert.Equal(t, 2, pb.ExitCode)
+		assert.Equal(t, "exit status 2", pb.Error)
+		assert.Equal(t, map[string]HostStats{"default": {Ok: 3, Failures: 1, Ignored: 1}}, pb.Recap)
+		assert.Equal(t, []FailedTask{{Play: "web", Task: "start", Host: "default", Msg: "boom"}}, pb.FailedTasks)
+	}
+}
+
+func TestReport_VersionFromGetVersion(t *testing.T) {
+	r := NewReport("2.15.0")
+	r.Record(&Event{Event: "playbook_start", AnsibleVersion: "2.16.3"})
+	assert.Equal(t, "2.15.0", r.AnsibleVersion)
+}
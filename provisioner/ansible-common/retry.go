@@ -0,0 +1,136 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+//go:generate packer-sdc mapstructure-to-hcl2 -type RetryConfig
+//go:generate packer-sdc struct-markdown
+
+package ansiblecommon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// RetryConfig sets how a failed ansible-playbook execution is retried.
+//
+// ```hcl
+//
+//	retry {
+//	  max_attempts = 5
+//	  backoff      = "15s"
+//	  exit_codes   = [2, 4]
+//	}
+//
+// ```
+type RetryConfig struct {
+	// How many times a playbook is run at most, including the first run.
+	// Defaults to `1`, which disables retries.
+	MaxAttempts int `mapstructure:"max_attempts"`
+	// How long to wait before the first retry. The delay doubles on every
+	// following retry, up to `max_backoff`. Defaults to `10s`.
+	Backoff time.Duration `mapstructure:"backoff"`
+	// The longest delay between two attempts. Defaults to `2m`.
+	MaxBackoff time.Duration `mapstructure:"max_backoff"`
+	// The exit codes of ansible-playbook that allow a retry. Defaults to
+	// `[3, 4]`, meaning that only runs where hosts were unreachable are
+	// retried: Ansible documents status 3 for unreachable hosts but
+	// ansible-playbook exits with status 4. Parser errors, which share status
+	// 4, are never retried, as running the same playbook again can't fix
+	// them.
+	ExitCodes []int `mapstructure:"exit_codes"`
+}
+
+// Prepare sets the defaults of c and validates it.
+func (c *RetryConfig) Prepare() []error {
+	var errs []error
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = 1
+	}
+	if c.MaxAttempts < 0 {
+		errs = append(errs, fmt.Errorf("retry.max_attempts must be positive"))
+	}
+	if c.Backoff == 0 {
+		c.Backoff = 10 * time.Second
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = 2 * time.Minute
+	}
+	if c.Backoff < 0 || c.MaxBackoff < 0 {
+		errs = append(errs, fmt.Errorf("retry.backoff and retry.max_backoff can't be negative"))
+	}
+	if len(c.ExitCodes) == 0 {
+		c.ExitCodes = []int{ExitCodeHostUnreachable, ExitCodeParserError}
+	}
+	for _, code := range c.ExitCodes {
+		if code <= 0 {
+			errs = append(errs, fmt.Errorf("retry.exit_codes: %d is not a failure exit code", code))
+		}
+	}
+	return errs
+}
+
+func (c *RetryConfig) retryable(exitCode int) bool {
+	for _, code := range c.ExitCodes {
+		if code == exitCode {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *RetryConfig) backoff(retry int) time.Duration {
+	d := c.Backoff
+	for i := 1; i < retry && d < c.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > c.MaxBackoff {
+		d = c.MaxBackoff
+	}
+	return d
+}
+
+// Run calls fn, which runs name and returns its exit code, until it succeeds,
+// fails with an exit code that isn't retryable or max_attempts is reached.
+// attempt starts at 1.
+func (c *RetryConfig) Run(ctx context.Context, ui packersdk.Ui, name string, fn func(attempt int) (int, error)) error {
+	maxAttempts := c.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	for attempt := 1; ; attempt++ {
+		exitCode, err := fn(attempt)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		var parserErr *ParserError
+		if !c.retryable(exitCode) || errors.As(err, &parserErr) {
+			return err
+		}
+		if attempt >= maxAttempts {
+			if maxAttempts > 1 {
+				ui.Error(fmt.Sprintf("%s failed after %d attempts", name, attempt))
+			}
+			return err
+		}
+
+		reason := "unknown failure"
+		var exitErr *ExitError
+		if errors.As(err, &exitErr) {
+			reason = exitErr.Reason
+		}
+		wait := c.backoff(attempt)
+		ui.Say(fmt.Sprintf("%s exited with status %d (%s), retrying in %s (attempt %d of %d)...",
+			name, exitCode, reason, wait, attempt+1, maxAttempts))
+		log.Printf("retrying %s after error: %s", name, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblecommon
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryConfig_Prepare(t *testing.T) {
+	var c RetryConfig
+	if errs := c.Prepare(); len(errs) != 0 {
+		t.Fatalf("err: %v", errs)
+	}
+	assert.Equal(t, 1, c.MaxAttempts)
+	assert.Equal(t, 10*time.Second, c.Backoff)
+	assert.Equal(t, 2*time.Minute, c.MaxBackoff)
+	assert.Equal(t, []int{ExitCodeHostUnreachable, ExitCodeParserError}, c.ExitCodes)
+
+	c = RetryConfig{MaxAttempts: -1, Backoff: -time.Second, ExitCodes: []int{0}}
+	assert.Len(t, c.Prepare(), 3)
+}
+
+func TestRetryConfig_Backoff(t *testing.T) {
+	c := RetryConfig{Backoff: 10 * time.Second, MaxBackoff: time.Minute}
+	assert.Equal(t, 10*time.Second, c.backoff(1))
+	assert.Equal(t, 20*time.Second, c.backoff(2))
+	assert.Equal(t, 40*time.Second, c.backoff(3))
+	assert.Equal(t, time.Minute, c.backoff(4))
+	assert.Equal(t, time.Minute, c.backoff(10))
+}
+
+func TestRetryConfig_Run(t *testing.T) {
+	testcases := []struct {
+		name           string
+		retryExitCodes []int
+		exitCodes      []int
+		expectedCalls  int
+		expectErr      bool
+	}{
+		{
+			name:          "succeeds",
+			exitCodes:     []int{0},
+			expectedCalls: 1,
+		},
+		{
+			name:          "retries unreachable hosts",
+			exitCodes:     []int{4, 4, 0},
+			expectedCalls: 3,
+		},
+		{
+			name:          "does not retry failed hosts",
+			exitCodes:     []int{2, 0},
+			expectedCalls: 1,
+			expectErr:     true,
+		},
+		{
+			name:          "does not retry parser errors",
+			exitCodes:     []int{-4, 0},
+			expectedCalls: 1,
+			expectErr:     true,
+		},
+		{
+			name:           "does not retry parser errors with exit_codes set",
+			retryExitCodes: []int{2, 4},
+			exitCodes:      []int{-4, 0},
+			expectedCalls:  1,
+			expectErr:      true,
+		},
+		{
+			name:           "does not retry exit codes missing from exit_codes",
+			retryExitCodes: []int{2},
+			exitCodes:      []int{4, 0},
+			expectedCalls:  1,
+			expectErr:      true,
+		},
+		{
+			name:          "stops after max_attempts",
+			exitCodes:     []int{4, 4, 4, 4},
+			expectedCalls: 3,
+			expectErr:     true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := RetryConfig{MaxAttempts: 3, Backoff: time.Millisecond, ExitCodes: tc.retryExitCodes}
+			c.Prepare()
+			ui := &recordingUi{}
+
+			calls := 0
+			err := c.Run(context.Background(), ui, "Playbook site.yml", func(attempt int) (int, error) {
+				calls++
+				assert.Equal(t, calls, attempt)
+				// Negative codes fail without unreachable hosts.
+				code := tc.exitCodes[calls-1]
+				if code < 0 {
+					return -code, NewExitError(-code, nil, false)
+				}
+				if code != 0 {
+					return code, NewExitError(code, nil, true)
+				}
+				return 0, nil
+			})
+			assert.Equal(t, tc.expectErr, err != nil)
+			assert.Equal(t, tc.expectedCalls, calls)
+			for _, line := range ui.said {
+				assert.Contains(t, line, "one or more hosts were unreachable")
+			}
+		})
+	}
+}
+
+func TestRetryConfig_RunCancelled(t *testing.T) {
+	c := RetryConfig{MaxAttempts: 3, Backoff: time.Hour}
+	c.Prepare()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	calls := 0
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Run(ctx, &recordingUi{}, "Playbook site.yml", func(int) (int, error) {
+			calls++
+			return ExitCodeParserError, NewExitError(ExitCodeParserError, nil, true)
+		})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		assert.Equal(t, context.Canceled, err)
+		assert.Equal(t, 1, calls)
+	case <-time.After(5 * time.Second):
+		t.Fatal("backoff did not stop on cancellation")
+	}
+}
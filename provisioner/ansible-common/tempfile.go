@@ -0,0 +1,35 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblecommon
+
+import (
+	"os"
+
+	"github.com/hashicorp/packer-plugin-sdk/tmp"
+)
+
+// WriteTempFile writes content to a new temporary file with the permission
+// bits of mode and returns its path. The mode is set before content is
+// written, so that secrets are never readable by other users.
+func WriteTempFile(pattern string, content []byte, mode os.FileMode) (string, error) {
+	f, err := tmp.File(pattern)
+	if err != nil {
+		return "", err
+	}
+	if err := f.Chmod(mode); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	if _, err := f.Write(content); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
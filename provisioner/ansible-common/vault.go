@@ -0,0 +1,185 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+//go:generate packer-sdc mapstructure-to-hcl2 -type VaultID
+//go:generate packer-sdc struct-markdown
+
+package ansiblecommon
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// VaultConfig sets the passwords Ansible uses to decrypt the vault encrypted
+// files and variables of the playbooks. The passwords are always passed to
+// Ansible through files, never on the command line.
+//
+// ```hcl
+//
+//	vault_password = var.vault_password
+//
+//	vault_ids {
+//	  id       = "prod"
+//	  password = var.prod_vault_password
+//	}
+//
+// ```
+type VaultConfig struct {
+	// A file containing the vault password, or an executable script printing
+	// it, passed to Ansible with `--vault-password-file`.
+	VaultPasswordFile string `mapstructure:"vault_password_file"`
+	// The vault password. It is masked in the output and written to a file
+	// only readable by the user running Ansible, which is removed after the
+	// run.
+	VaultPassword string `mapstructure:"vault_password"`
+	// A shell command printing the vault password, such as
+	// `pass show ansible/vault`. It is run by Ansible through a script written
+	// next to the other vault password files.
+	VaultPasswordCommand string `mapstructure:"vault_password_command"`
+	// Vault identities, passed to Ansible with `--vault-id`. They can be set
+	// along with one of the options above.
+	VaultIDs []VaultID `mapstructure:"vault_ids"`
+}
+
+// VaultID is a vault identity and its password.
+type VaultID struct {
+	// The label of the vault identity, such as `prod`.
+	ID string `mapstructure:"id" required:"true"`
+	// The vault password of the identity. It is masked in the output and
+	// written to a file only readable by the user running Ansible, which is
+	// removed after the run.
+	Password string `mapstructure:"password"`
+	// A file containing the vault password of the identity, or an executable
+	// script printing it.
+	PasswordFile string `mapstructure:"password_file"`
+}
+
+// VaultWriteFunc writes content to a file named after name, readable only by
+// the user running Ansible with the permission bits of mode, and returns the
+// path of the file as seen by Ansible.
+type VaultWriteFunc func(name string, content []byte, mode os.FileMode) (string, error)
+
+// Prepare validates the vault options.
+func (c *VaultConfig) Prepare() []error {
+	var errs []error
+
+	set := 0
+	for _, v := range []string{c.VaultPasswordFile, c.VaultPassword, c.VaultPasswordCommand} {
+		if v != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		errs = append(errs, fmt.Errorf("only one of vault_password_file, vault_password and vault_password_command can be set"))
+	}
+	if c.VaultPasswordFile != "" {
+		if err := checkFile(c.VaultPasswordFile); err != nil {
+			errs = append(errs, fmt.Errorf("vault_password_file: %s", err))
+		}
+	}
+
+	ids := map[string]bool{}
+	for i, v := range c.VaultIDs {
+		switch {
+		case v.ID == "":
+			errs = append(errs, fmt.Errorf("vault_ids[%d]: id must be set", i))
+		case strings.Contains(v.ID, "@"):
+			errs = append(errs, fmt.Errorf("vault_ids[%d]: id %q can't contain @", i, v.ID))
+		case ids[v.ID]:
+			errs = append(errs, fmt.Errorf("vault_ids[%d]: id %q is duplicated", i, v.ID))
+		}
+		ids[v.ID] = true
+
+		if (v.Password == "") == (v.PasswordFile == "") {
+			errs = append(errs, fmt.Errorf("vault_ids[%d]: exactly one of password and password_file must be set", i))
+		}
+		if v.PasswordFile != "" {
+			if err := checkFile(v.PasswordFile); err != nil {
+				errs = append(errs, fmt.Errorf("vault_ids[%d]: password_file: %s", i, err))
+			}
+		}
+	}
+	return errs
+}
+
+// Passwords returns the inline vault passwords, to be masked in the output.
+func (c *VaultConfig) Passwords() []string {
+	var passwords []string
+	if c.VaultPassword != "" {
+		passwords = append(passwords, c.VaultPassword)
+	}
+	for _, v := range c.VaultIDs {
+		if v.Password != "" {
+			passwords = append(passwords, v.Password)
+		}
+	}
+	return passwords
+}
+
+// Args returns the arguments passing the vault passwords to
+// ansible-playbook. write is called to write the inline passwords and the
+// password command to files. If copyFiles is set, the password files are read
+// and written with write too, as when Ansible runs on the guest.
+func (c *VaultConfig) Args(write VaultWriteFunc, copyFiles bool) ([]string, error) {
+	file := func(name, path string) (string, error) {
+		if !copyFiles {
+			return path, nil
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		// Keep password scripts executable.
+		return write(name, content, 0600|info.Mode().Perm()&0100)
+	}
+
+	var args []string
+	var path string
+	var err error
+	switch {
+	case c.VaultPasswordFile != "":
+		path, err = file("vault-password", c.VaultPasswordFile)
+	case c.VaultPassword != "":
+		path, err = write("vault-password", []byte(c.VaultPassword), 0600)
+	case c.VaultPasswordCommand != "":
+		script := fmt.Sprintf("#!/bin/sh\nexec %s\n", c.VaultPasswordCommand)
+		path, err = write("vault-password-command", []byte(script), 0700)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if path != "" {
+		args = append(args, "--vault-password-file", path)
+	}
+
+	for i, v := range c.VaultIDs {
+		name := fmt.Sprintf("vault-id-%d", i)
+		if v.Password != "" {
+			path, err = write(name, []byte(v.Password), 0600)
+		} else {
+			path, err = file(name, v.PasswordFile)
+		}
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--vault-id", v.ID+"@"+path)
+	}
+	return args, nil
+}
+
+func checkFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("%s is invalid: %s", path, err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s must point to a file", path)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblecommon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVaultConfig_Prepare(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "vault-pass")
+	if err := os.WriteFile(passwordFile, []byte("hunter2\n"), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testcases := []struct {
+		name       string
+		config     VaultConfig
+		errorCount int
+	}{
+		{
+			name: "password and vault ids",
+			config: VaultConfig{
+				VaultPassword: "hunter2",
+				VaultIDs: []VaultID{
+					{ID: "prod", Password: "s3cr3t"},
+					{ID: "dev", PasswordFile: passwordFile},
+				},
+			},
+		},
+		{
+			name:       "password and password file",
+			config:     VaultConfig{VaultPassword: "hunter2", VaultPasswordFile: passwordFile},
+			errorCount: 1,
+		},
+		{
+			name:       "missing password file",
+			config:     VaultConfig{VaultPasswordFile: filepath.Join(t.TempDir(), "missing")},
+			errorCount: 1,
+		},
+		{
+			name: "invalid vault ids",
+			config: VaultConfig{
+				VaultIDs: []VaultID{
+					{Password: "hunter2"},
+					{ID: "a@b", Password: "hunter2"},
+					{ID: "prod", Password: "hunter2", PasswordFile: passwordFile},
+					{ID: "prod", Password: "hunter2"},
+				},
+			},
+			errorCount: 4,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Len(t, tc.config.Prepare(), tc.errorCount)
+		})
+	}
+}
+
+func TestVaultConfig_Args(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "vault-pass.sh")
+	if err := os.WriteFile(passwordFile, []byte("#!/bin/sh\necho hunter2\n"), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	type written struct {
+		content string
+		mode    os.FileMode
+	}
+	var files map[string]written
+	write := func(name string, content []byte, mode os.FileMode) (string, error) {
+		path := fmt.Sprintf("/staging/packer-%s", name)
+		files[path] = written{string(content), mode}
+		return path, nil
+	}
+
+	c := VaultConfig{
+		VaultPasswordCommand: "pass show ansible/vault",
+		VaultIDs: []VaultID{
+			{ID: "prod", Password: "s3cr3t"},
+			{ID: "dev", PasswordFile: passwordFile},
+		},
+	}
+
+	files = map[string]written{}
+	args, err := c.Args(write, false)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	assert.Equal(t, []string{
+		"--vault-password-file", "/staging/packer-vault-password-command",
+		"--vault-id", "prod@/staging/packer-vault-id-0",
+		"--vault-id", "dev@" + passwordFile,
+	}, args)
+	assert.Equal(t, map[string]written{
+		"/staging/packer-vault-password-command": {"#!/bin/sh\nexec pass show ansible/vault\n", 0700},
+		"/staging/packer-vault-id-0":             {"s3cr3t", 0600},
+	}, files)
+
+	files = map[string]written{}
+	args, err = c.Args(write, true)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	assert.Equal(t, "dev@/staging/packer-vault-id-1", args[len(args)-1],
+		"password files should be copied")
+	assert.Equal(t, written{"#!/bin/sh\necho hunter2\n", 0700}, files["/staging/packer-vault-id-1"],
+		"copied password scripts should stay executable")
+	assert.Equal(t, []string{"s3cr3t"}, c.Passwords())
+}
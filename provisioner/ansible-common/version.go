@@ -0,0 +1,118 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblecommon
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/go-version"
+)
+
+// Names of the Python packages providing ansible-playbook.
+const (
+	// The engine of Ansible, since Ansible 2.11.
+	PackageAnsibleCore = "ansible-core"
+	// The engine of Ansible 2.10.
+	PackageAnsibleBase = "ansible-base"
+	// Ansible up to 2.9, before the engine and the collections were split.
+	PackageAnsible = "ansible"
+)
+
+var (
+	// ansible-playbook [core 2.16.3], ansible-playbook 2.10.17 or
+	// ansible-playbook 2.9.27
+	coreVersionRe = regexp.MustCompile(`(?m)^\S+ \[(core|base) (\d+\.\d+[.\w]*)\]|^\S+ (\d+\.\d+[.\w]*)`)
+	// python version = 3.11.6 (main, Oct  2 2023, 13:45:54) [GCC 13.2.0]
+	pythonVersionRe = regexp.MustCompile(`(?m)^\s*python version = (\d+\.\d+[.\w]*)`)
+	// Ansible community version 9.2.0
+	communityVersionRe = regexp.MustCompile(`(?m)^Ansible community version (\d+\.\d+[.\w]*)`)
+)
+
+// AnsibleVersion describes the Ansible installation of the controller.
+type AnsibleVersion struct {
+	// The package providing ansible-playbook: ansible-core, ansible-base
+	// or ansible.
+	Package string
+	// The version of Package.
+	Core *version.Version
+	// The version of the ansible community package installed along with
+	// ansible-core, if known.
+	Community *version.Version
+	// The version of Python running ansible-playbook, if known.
+	Python *version.Version
+}
+
+// ParseAnsibleVersion parses the output of `ansible-playbook --version`.
+func ParseAnsibleVersion(out string) (*AnsibleVersion, error) {
+	matches := coreVersionRe.FindStringSubmatch(out)
+	if matches == nil {
+		return nil, fmt.Errorf("could not find the Ansible version in output:\n%s", out)
+	}
+
+	v := &AnsibleVersion{}
+	raw := matches[3]
+	switch matches[1] {
+	case "core":
+		v.Package, raw = PackageAnsibleCore, matches[2]
+	case "base":
+		v.Package, raw = PackageAnsibleBase, matches[2]
+	}
+	var err error
+	if v.Core, err = version.NewVersion(raw); err != nil {
+		return nil, fmt.Errorf("could not parse the Ansible version %q: %s", raw, err)
+	}
+	if v.Package == "" {
+		// ansible-base 2.10 prints its version like Ansible 2.9 did.
+		v.Package = PackageAnsible
+		if v.Core.Segments()[0] == 2 && v.Core.Segments()[1] == 10 {
+			v.Package = PackageAnsibleBase
+		}
+	}
+
+	if matches := pythonVersionRe.FindStringSubmatch(out); matches != nil {
+		v.Python, _ = version.NewVersion(matches[1])
+	}
+	return v, nil
+}
+
+// ParseCommunityVersion parses the output of `ansible-community --version`.
+func ParseCommunityVersion(out string) (*version.Version, error) {
+	matches := communityVersionRe.FindStringSubmatch(out)
+	if matches == nil {
+		return nil, fmt.Errorf("could not find the Ansible community version in output:\n%s", out)
+	}
+	return version.NewVersion(matches[1])
+}
+
+// Major returns the major version of Package.
+func (v *AnsibleVersion) Major() int {
+	return v.Core.Segments()[0]
+}
+
+// Check returns an error if the version of Package doesn't satisfy
+// constraint, such as ">= 2.15, < 2.18".
+func (v *AnsibleVersion) Check(constraint string) error {
+	c, err := version.NewConstraint(constraint)
+	if err != nil {
+		return err
+	}
+	if !c.Check(v.Core) {
+		return fmt.Errorf("%s does not satisfy the constraint %q", v, constraint)
+	}
+	return nil
+}
+
+func (v *AnsibleVersion) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s", v.Package, v.Core.Original())
+	if v.Community != nil {
+		fmt.Fprintf(&b, " (ansible %s)", v.Community.Original())
+	}
+	if v.Python != nil {
+		fmt.Fprintf(&b, " on Python %s", v.Python.Original())
+	}
+	return b.String()
+}
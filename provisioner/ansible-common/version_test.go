@@ -0,0 +1,102 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblecommon
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAnsibleVersion(t *testing.T) {
+	testcases := []struct {
+		name            string
+		output          string
+		expectedPackage string
+		expectedCore    string
+		expectedPython  string
+		expectedString  string
+	}{
+		{
+			name: "ansible-core",
+			output: `ansible-playbook [core 2.16.3]
+  config file = None
+  configured module search path = ['/home/user/.ansible/plugins/modules']
+  ansible python module location = /usr/lib/python3/dist-packages/ansible
+  executable location = /usr/bin/ansible-playbook
+  python version = 3.11.6 (main, Oct  2 2023, 13:45:54) [GCC 13.2.0] (/usr/bin/python3)
+  jinja version = 3.1.2
+  libyaml = True
+`,
+			expectedPackage: PackageAnsibleCore,
+			expectedCore:    "2.16.3",
+			expectedPython:  "3.11.6",
+			expectedString:  "ansible-core 2.16.3 on Python 3.11.6",
+		},
+		{
+			name: "ansible-core pre-release",
+			output: `ansible-playbook [core 2.18.0rc1]
+  python version = 3.12.1 (main, Dec  8 2023, 05:40:51) [GCC 12.2.0]
+`,
+			expectedPackage: PackageAnsibleCore,
+			expectedCore:    "2.18.0rc1",
+			expectedPython:  "3.12.1",
+			expectedString:  "ansible-core 2.18.0rc1 on Python 3.12.1",
+		},
+		{
+			name: "ansible-base",
+			output: `ansible-playbook 2.10.17
+  python version = 3.8.10 (default, Nov 22 2023, 10:22:35) [GCC 9.4.0]
+`,
+			expectedPackage: PackageAnsibleBase,
+			expectedCore:    "2.10.17",
+			expectedPython:  "3.8.10",
+			expectedString:  "ansible-base 2.10.17 on Python 3.8.10",
+		},
+		{
+			name:            "ansible",
+			output:          "ansible-playbook 2.9.27\n",
+			expectedPackage: PackageAnsible,
+			expectedCore:    "2.9.27",
+			expectedString:  "ansible 2.9.27",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := ParseAnsibleVersion(tc.output)
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			assert.Equal(t, tc.expectedPackage, v.Package)
+			assert.Equal(t, tc.expectedCore, v.Core.Original())
+			if tc.expectedPython == "" {
+				assert.Nil(t, v.Python)
+			} else {
+				assert.Equal(t, tc.expectedPython, v.Python.Original())
+			}
+			assert.Equal(t, 2, v.Major())
+			assert.Equal(t, tc.expectedString, v.String())
+		})
+	}
+
+	_, err := ParseAnsibleVersion("command not found")
+	assert.Error(t, err)
+}
+
+func TestAnsibleVersion_Check(t *testing.T) {
+	v, err := ParseAnsibleVersion("ansible-playbook [core 2.16.3]\n")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	v.Community, err = ParseCommunityVersion("Ansible community version 9.2.0\n")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	assert.NoError(t, v.Check(">= 2.15, < 2.18"))
+	err = v.Check(">= 2.17")
+	assert.EqualError(t, err, `ansible-core 2.16.3 (ansible 9.2.0) does not satisfy the constraint ">= 2.17"`)
+	assert.Error(t, v.Check("not a constraint"))
+}
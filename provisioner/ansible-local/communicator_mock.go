@@ -5,8 +5,11 @@ package ansiblelocal
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
 
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
 )
@@ -14,28 +17,102 @@ import (
 type communicatorMock struct {
 	startCommand      []string
 	uploadDestination []string
+	// uploads holds the content and mode of the uploaded files by
+	// destination.
+	uploads map[string]uploadedFile
+	// uploadDirs holds the files of the uploaded directories, relative to
+	// the directory, by destination.
+	uploadDirs map[string][]string
+	// downloads holds the content of the files which can be downloaded, by
+	// source.
+	downloads map[string]string
+	// downloadDirs holds the destination of the downloaded directories, by
+	// source.
+	downloadDirs map[string]string
+	// exitStatus, if set, returns the exit status of a command.
+	exitStatus func(command string) int
+	// stdout, if set, returns the output of a command.
+	stdout func(command string) string
+	// stderr, if set, returns the error output of a command.
+	stderr func(command string) string
 }
 
 func (c *communicatorMock) Start(ctx context.Context, cmd *packersdk.RemoteCmd) error {
 	c.startCommand = append(c.startCommand, cmd.Command)
+	if c.stdout != nil && cmd.Stdout != nil {
+		if _, err := io.WriteString(cmd.Stdout, c.stdout(cmd.Command)); err != nil {
+			return err
+		}
+	}
+	if c.stderr != nil && cmd.Stderr != nil {
+		if _, err := io.WriteString(cmd.Stderr, c.stderr(cmd.Command)); err != nil {
+			return err
+		}
+	}
+	if c.exitStatus != nil {
+		cmd.SetExited(c.exitStatus(cmd.Command))
+		return nil
+	}
 	cmd.SetExited(0)
 	return nil
 }
 
-func (c *communicatorMock) Upload(dst string, _ io.Reader, _ *os.FileInfo) error {
+type uploadedFile struct {
+	content []byte
+	mode    os.FileMode
+}
+
+func (c *communicatorMock) Upload(dst string, r io.Reader, fi *os.FileInfo) error {
 	c.uploadDestination = append(c.uploadDestination, dst)
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	upload := uploadedFile{content: content}
+	if fi != nil {
+		upload.mode = (*fi).Mode()
+	}
+	if c.uploads == nil {
+		c.uploads = map[string]uploadedFile{}
+	}
+	c.uploads[dst] = upload
 	return nil
 }
 
 func (c *communicatorMock) UploadDir(dst, src string, exclude []string) error {
+	var files []string
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		files = append(files, filepath.ToSlash(rel))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if c.uploadDirs == nil {
+		c.uploadDirs = map[string][]string{}
+	}
+	c.uploadDirs[dst] = files
 	return nil
 }
 
 func (c *communicatorMock) Download(src string, dst io.Writer) error {
-	return nil
+	content, ok := c.downloads[src]
+	if !ok {
+		return fmt.Errorf("%s: no such file", src)
+	}
+	_, err := io.WriteString(dst, content)
+	return err
 }
 
 func (c *communicatorMock) DownloadDir(src, dst string, exclude []string) error {
+	if c.downloadDirs == nil {
+		c.downloadDirs = map[string]string{}
+	}
+	c.downloadDirs[src] = dst
 	return nil
 }
 
@@ -0,0 +1,68 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+//go:generate packer-sdc mapstructure-to-hcl2 -type FetchFile
+//go:generate packer-sdc struct-markdown
+
+package ansiblelocal
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FetchFile is a file or directory downloaded from the remote machine once
+// the playbooks have run, even if they failed, such as the Ansible log or
+// reports generated by the playbooks.
+//
+// ```hcl
+//
+//	fetch {
+//	  source      = "ansible.log"
+//	  destination = "logs/"
+//	}
+//
+// ```
+type FetchFile struct {
+	// The path of the file on the remote machine, relative to
+	// `staging_directory` unless it is absolute. If it ends with `/`, the
+	// directory is downloaded with its content.
+	Source string `mapstructure:"source" required:"true"`
+	// The local path where the file is downloaded. If it ends with `/` or is
+	// an existing directory, the file is downloaded in it with the name of
+	// `source`. Missing parent directories are created.
+	Destination string `mapstructure:"destination" required:"true"`
+}
+
+// Prepare validates the fetched file.
+func (f *FetchFile) Prepare() []error {
+	var errs []error
+	if f.Source == "" {
+		errs = append(errs, fmt.Errorf("source must be set"))
+	}
+	if f.Destination == "" {
+		errs = append(errs, fmt.Errorf("destination must be set"))
+	}
+	return errs
+}
+
+// destination returns the local path of the file downloaded from src.
+func (f *FetchFile) destination(src string) string {
+	dst := f.Destination
+	if strings.HasSuffix(dst, "/") {
+		return filepath.Join(dst, path.Base(src))
+	}
+	if info, err := os.Stat(dst); err == nil && info.IsDir() {
+		return filepath.Join(dst, path.Base(src))
+	}
+	return dst
+}
+
+// isAbsGuestPath reports whether p is an absolute path on the remote
+// machine, with or without a drive letter.
+func isAbsGuestPath(p string) bool {
+	return path.IsAbs(p) || (len(p) > 2 && p[1] == ':' && p[2] == '/')
+}
@@ -0,0 +1,82 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblelocal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/tmp"
+
+	ansiblecommon "github.com/hashicorp/packer-plugin-ansible/provisioner/ansible-common"
+)
+
+// executeHostGalaxy installs the galaxy requirements on the machine running
+// Packer and uploads them to the galaxy roles and collections paths.
+func (p *Provisioner) executeHostGalaxy(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator) error {
+	dir, err := tmp.Dir("packer-provisioner-ansible-local-galaxy")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	// ansible-galaxy reads galaxy_file itself, so that the relative paths in
+	// it are resolved as usual.
+	for _, step := range p.galaxyReqs.Steps(p.config.GalaxyFile) {
+		// ansible-galaxy install -r requirements.yml -p dir/roles
+		args := append(step.Args, "-p", filepath.Join(dir, step.Kind))
+		// Add force to arguments
+		if p.config.GalaxyForceInstall {
+			args = append(args, "-f")
+		}
+
+		galaxyUi := &ansiblecommon.GalaxyUi{Ui: ui, Step: step}
+		galaxyUi.Start()
+		if err := p.invokeHostGalaxyCommand(ctx, args, galaxyUi); err != nil {
+			return err
+		}
+	}
+
+	for _, step := range p.galaxyReqs.Steps(p.config.GalaxyFile) {
+		dst := p.config.GalaxyRolesPath
+		if step.Kind == ansiblecommon.GalaxyCollections {
+			dst = p.config.GalaxyCollectionsPath
+		}
+		ui.Say(fmt.Sprintf("Uploading galaxy %s to %s...", step.Kind, dst))
+		if err := p.uploadDir(ctx, ui, comm, filepath.ToSlash(dst), filepath.Join(dir, step.Kind)); err != nil {
+			return fmt.Errorf("Error uploading galaxy %s: %s", step.Kind, err)
+		}
+	}
+	return nil
+}
+
+// hostGalaxyEnv returns the environment of ansible-galaxy on the machine
+// running Packer, with ansible_env_vars and ansible_env set like on the
+// remote machine.
+func (p *Provisioner) hostGalaxyEnv() []string {
+	env := append(os.Environ(), p.config.AnsibleEnvVars...)
+	names := make([]string, 0, len(p.config.AnsibleEnv))
+	for name := range p.config.AnsibleEnv {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, name+"="+p.config.AnsibleEnv[name])
+	}
+	return env
+}
+
+// invokeHostGalaxyCommand runs ansible-galaxy on the machine running Packer.
+func (p *Provisioner) invokeHostGalaxyCommand(ctx context.Context, args []string, ui packersdk.Ui) error {
+	ui.Say(fmt.Sprintf("Executing Ansible Galaxy on the host: %s %s", p.config.GalaxyCommand, strings.Join(args, " ")))
+	return ansiblecommon.RunHostGalaxy(ctx, ui, p.config.GalaxyCommand, args, p.hostGalaxyEnv(),
+		p.config.InterruptGracePeriod, p.config.TerminateGracePeriod)
+}
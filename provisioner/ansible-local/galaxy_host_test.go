@@ -0,0 +1,135 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !windows
+// +build !windows
+
+package ansiblelocal
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+func TestProvisionerProvision_GalaxyHost(t *testing.T) {
+	var p Provisioner
+	config := testConfig()
+
+	dir := t.TempDir()
+	playbook_file := filepath.Join(dir, "site.yml")
+	galaxy_file := filepath.Join(dir, "requirements.yml")
+	content := "roles:\n  - geerlingguy.docker\ncollections:\n  - community.general\n"
+	for file, content := range map[string]string{playbook_file: "---\n", galaxy_file: content} {
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	// Installs a role or a collection in the directory passed with -p, the
+	// way ansible-galaxy lays them out.
+	galaxy_stub := filepath.Join(dir, "ansible-galaxy")
+	galaxy_log := filepath.Join(dir, "galaxy.log")
+	script := `#!/usr/bin/env bash
+while [ $# -gt 0 ]; do
+  case "$1" in
+    -r) [ -f "$2" ] || exit 1; echo "$ANSIBLE_GALAXY_SERVER $GALAXY_TOKEN $2" >> ` + galaxy_log + ` ;;
+    -p) dst="$2" ;;
+  esac
+  shift
+done
+case "$dst" in
+  */roles) mkdir -p "$dst/geerlingguy.docker/tasks"; touch "$dst/geerlingguy.docker/tasks/main.yml"
+           echo "- geerlingguy.docker (7.0.0) was installed successfully" ;;
+  */collections) mkdir -p "$dst/ansible_collections/community/general"; touch "$dst/ansible_collections/community/general/MANIFEST.json"
+           echo "community.general:8.2.0 was installed successfully" ;;
+esac
+`
+	if err := os.WriteFile(galaxy_stub, []byte(script), 0777); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	config["playbook_file"] = playbook_file
+	config["galaxy_file"] = galaxy_file
+	config["galaxy_command"] = galaxy_stub
+	config["galaxy_install_location"] = "host"
+	config["ansible_env_vars"] = []string{"GALAXY_TOKEN=t0ken"}
+	config["ansible_env"] = map[string]string{"ANSIBLE_GALAXY_SERVER": "https://galaxy.example.com"}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	out := new(bytes.Buffer)
+	ui := &packersdk.BasicUi{Reader: new(bytes.Buffer), Writer: out, ErrorWriter: out}
+	comm := &communicatorMock{}
+	if err := p.Provision(context.Background(), ui, comm, make(map[string]interface{})); err != nil {
+		t.Fatalf("err: %s\n%s", err, out.String())
+	}
+
+	expected := map[string][]string{
+		p.config.GalaxyRolesPath:       {"geerlingguy.docker/tasks/main.yml"},
+		p.config.GalaxyCollectionsPath: {"ansible_collections/community/general/MANIFEST.json"},
+	}
+	for dst, files := range expected {
+		if !reflect.DeepEqual(comm.uploadDirs[dst], files) {
+			t.Fatalf("expected %v to be uploaded to %s, got %v", files, dst, comm.uploadDirs[dst])
+		}
+	}
+	for _, cmd := range comm.startCommand {
+		if strings.Contains(cmd, "ansible-galaxy") {
+			t.Fatalf("ansible-galaxy should not run on the guest: %s", cmd)
+		}
+	}
+	b, err := os.ReadFile(galaxy_log)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	runs := strings.Split(strings.TrimSpace(string(b)), "\n")
+	expectedRuns := []string{
+		"https://galaxy.example.com t0ken " + galaxy_file,
+		"https://galaxy.example.com t0ken " + galaxy_file,
+	}
+	if !reflect.DeepEqual(runs, expectedRuns) {
+		t.Fatalf("expected ansible-galaxy to read galaxy_file with ansible_env_vars and ansible_env set %v, got %v", expectedRuns, runs)
+	}
+	for _, msg := range []string{"Installed role geerlingguy.docker (7.0.0)", "Installed collection community.general (8.2.0)"} {
+		if !strings.Contains(out.String(), msg) {
+			t.Fatalf("expected %q in output:\n%s", msg, out.String())
+		}
+	}
+}
+
+func TestProvisionerPrepare_GalaxyInstallLocation(t *testing.T) {
+	var p Provisioner
+	config := testConfig()
+
+	playbook_file := createTempFile("")
+	defer removeFiles(playbook_file)
+	galaxy_file := createTempFile("")
+	defer removeFiles(galaxy_file)
+
+	config["playbook_file"] = playbook_file
+	config["galaxy_file"] = galaxy_file
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if p.config.GalaxyInstallLocation != "guest" {
+		t.Fatalf("galaxy_install_location should default to guest, got %q", p.config.GalaxyInstallLocation)
+	}
+
+	config["galaxy_install_location"] = "controller"
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["galaxy_install_location"] = "host"
+	config["galaxy_command"] = filepath.Join(t.TempDir(), "ansible-galaxy")
+	if err := p.Prepare(config); err == nil || !strings.Contains(err.Error(), "galaxy_command") {
+		t.Fatalf("a missing galaxy_command should be an error on the host, got %v", err)
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+//go:generate packer-sdc mapstructure-to-hcl2 -type InstallConfig
+//go:generate packer-sdc struct-markdown
+
+package ansiblelocal
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Values of the install method.
+const (
+	installPip     = "pip"
+	installPipx    = "pipx"
+	installPackage = "package"
+	installNone    = "none"
+)
+
+// installPackageScript installs the ansible package with the package manager
+// of the remote machine. dnf falls back to ansible-core, the only one of the
+// two shipped by RHEL without EPEL.
+const installPackageScript = `if command -v apt-get >/dev/null 2>&1; then
+  apt-get update && DEBIAN_FRONTEND=noninteractive apt-get install -y ansible
+elif command -v dnf >/dev/null 2>&1; then
+  dnf install -y ansible || dnf install -y ansible-core
+elif command -v yum >/dev/null 2>&1; then
+  yum install -y ansible
+elif command -v zypper >/dev/null 2>&1; then
+  zypper --non-interactive install ansible
+elif command -v apk >/dev/null 2>&1; then
+  apk add --no-cache ansible
+elif command -v pacman >/dev/null 2>&1; then
+  pacman -Sy --noconfirm ansible
+else
+  echo "No supported package manager found" >&2
+  exit 1
+fi`
+
+// The virtualenv in which the pip method installs Ansible, and the directory
+// in which the pip and pipx methods link its commands, with and without sudo.
+// They are expanded by the remote shell. The directory of the user is
+// usually not in the PATH of non-interactive shells, see pathEnv.
+const (
+	installVenvDir     = "/opt/ansible"
+	installBinDir      = "/usr/local/bin"
+	installUserVenvDir = "$HOME/.ansible/venv"
+	installUserBinDir  = "$HOME/.local/bin"
+)
+
+// InstallConfig installs Ansible on the remote machine when `command` is not
+// found there. The command is looked for before anything is uploaded, so that
+// a machine without Ansible fails, or gets Ansible, right away.
+//
+// ```hcl
+//
+//	install {
+//	  method  = "pip"
+//	  version = "2.16.3"
+//	}
+//
+// ```
+type InstallConfig struct {
+	// How Ansible is installed: `pip` installs `package` with `pip` in a
+	// virtualenv created by `python -m venv`, `pipx` installs it with
+	// `pipx`, `package` installs the `ansible` package with the package
+	// manager of the remote machine (apt, dnf, yum, zypper, apk or pacman;
+	// dnf installs `ansible-core` when `ansible` isn't available, such as on
+	// RHEL without EPEL) and `none` only checks that `command` is found. The
+	// virtualenv keeps `pip` away from the Python of the system, which
+	// distributions such as Debian 12 mark as externally managed. Defaults to
+	// `pip`.
+	Method string `mapstructure:"method"`
+	// The version of `package` to install with `pip` or `pipx`, such as
+	// `2.16.3`, or a version specifier such as `>=2.15,<2.17`. By default,
+	// the latest version is installed. Not supported by the `package` method.
+	Version string `mapstructure:"version"`
+	// The Python package installed by `pip` and `pipx`. Defaults to
+	// `ansible-core`.
+	Package string `mapstructure:"package"`
+	// The Python interpreter creating the virtualenv of the `pip` method.
+	// Defaults to `python3`.
+	Python string `mapstructure:"python"`
+	// A local directory of wheels uploaded to the remote machine, from which
+	// `pip` or `pipx` install `package` without accessing a package index.
+	Wheelhouse string `mapstructure:"wheelhouse"`
+	// Run the install commands with `sudo`. The `pip` virtualenv is then
+	// created in `/opt/ansible` and the `pipx` one in `/opt/pipx`, with
+	// their commands linked in `/usr/local/bin`. Without `sudo`, the `pip`
+	// virtualenv is created in `~/.ansible/venv`, and the commands of `pip`
+	// and `pipx` are linked in `~/.local/bin`, which is added to the `PATH`
+	// of the Ansible commands if needed. By default, this is `false`.
+	Sudo bool `mapstructure:"sudo"`
+}
+
+// Prepare validates the install options and sets their defaults.
+func (c *InstallConfig) Prepare() []error {
+	var errs []error
+	if c.Method == "" {
+		c.Method = installPip
+	}
+	if c.Package == "" {
+		c.Package = "ansible-core"
+	}
+	if c.Python == "" {
+		c.Python = "python3"
+	}
+	switch c.Method {
+	case installPip, installPipx, installNone:
+	case installPackage:
+		if c.Version != "" {
+			errs = append(errs, fmt.Errorf("install: version is not supported by the package method"))
+		}
+		if c.Wheelhouse != "" {
+			errs = append(errs, fmt.Errorf("install: wheelhouse is not supported by the package method"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("install: method must be one of %s, %s, %s or %s, got %q",
+			installPip, installPipx, installPackage, installNone, c.Method))
+	}
+	if c.Wheelhouse != "" {
+		if info, err := os.Stat(c.Wheelhouse); err != nil {
+			errs = append(errs, fmt.Errorf("install: wheelhouse: %s is invalid: %s", c.Wheelhouse, err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("install: wheelhouse: %s must point to a directory", c.Wheelhouse))
+		}
+	}
+	return errs
+}
+
+// requirement returns the pip requirement specifier of the package.
+func (c *InstallConfig) requirement() string {
+	switch {
+	case c.Version == "":
+		return c.Package
+	case strings.ContainsAny(c.Version[:1], "<>=!~"):
+		return c.Package + c.Version
+	}
+	return c.Package + "==" + c.Version
+}
+
+// Script returns the shell script installing Ansible on the remote machine,
+// with the wheels uploaded to wheelhouse if it isn't empty.
+func (c *InstallConfig) Script(wheelhouse string) string {
+	sh := unixShell{}
+	var script string
+	switch c.Method {
+	case installPip:
+		venv, bin := installVenvDir, installBinDir
+		if !c.Sudo {
+			venv, bin = installUserVenvDir, installUserBinDir
+		}
+		args := []string{fmt.Sprintf(`"%s/bin/python"`, venv), "-m", "pip", "install", "--disable-pip-version-check"}
+		if wheelhouse != "" {
+			args = append(args, "--no-index", "--find-links", sh.Quote(wheelhouse))
+		}
+		script = sh.Chain(
+			fmt.Sprintf(`%s -m venv "%s"`, sh.Quote(c.Python), venv),
+			strings.Join(append(args, sh.Quote(c.requirement())), " "),
+			fmt.Sprintf(`mkdir -p "%s"`, bin),
+			fmt.Sprintf(`ln -sf "%s"/bin/ansible* "%s"/`, venv, bin))
+	case installPipx:
+		args := []string{"pipx", "install"}
+		if wheelhouse != "" {
+			args = append(args, "--pip-args", sh.Quote("--no-index --find-links "+wheelhouse))
+		}
+		script = strings.Join(append(args, sh.Quote(c.requirement())), " ")
+		if c.Sudo {
+			script = "PIPX_HOME=/opt/pipx PIPX_BIN_DIR=/usr/local/bin " + script
+		}
+	case installPackage:
+		script = installPackageScript
+	}
+	if c.Sudo {
+		script = "sudo sh -c " + sh.Quote(script)
+	}
+	return script
+}
+
+// pathEnv returns the shell assignment adding the directory in which the
+// commands of Ansible are linked without sudo to PATH, or an empty string if
+// they are linked in a directory of the default PATH.
+func (c *InstallConfig) pathEnv() string {
+	if c.Sudo || (c.Method != installPip && c.Method != installPipx) {
+		return ""
+	}
+	return fmt.Sprintf(`PATH="%s:$PATH"`, installUserBinDir)
+}
+
+// commandName returns the executable run by command, skipping the leading
+// environment variable assignments.
+func commandName(command string) string {
+	for _, word := range strings.Fields(command) {
+		if !strings.Contains(word, "=") {
+			return word
+		}
+	}
+	return ""
+}
@@ -0,0 +1,93 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblelocal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInstallConfig_Script(t *testing.T) {
+	testcases := []struct {
+		name       string
+		config     InstallConfig
+		wheelhouse string
+		expected   string
+	}{
+		{
+			name:   "pip",
+			config: InstallConfig{},
+			expected: `'python3' -m venv "$HOME/.ansible/venv" && "$HOME/.ansible/venv/bin/python" -m pip install --disable-pip-version-check 'ansible-core' && ` +
+				`mkdir -p "$HOME/.local/bin" && ln -sf "$HOME/.ansible/venv"/bin/ansible* "$HOME/.local/bin"/`,
+		},
+		{
+			name:       "pip offline",
+			config:     InstallConfig{Version: "2.16.3", Python: "/usr/bin/python3.11"},
+			wheelhouse: "/tmp/staging/packer-wheelhouse",
+			expected: `'/usr/bin/python3.11' -m venv "$HOME/.ansible/venv" && "$HOME/.ansible/venv/bin/python" -m pip install --disable-pip-version-check --no-index --find-links '/tmp/staging/packer-wheelhouse' 'ansible-core==2.16.3' && ` +
+				`mkdir -p "$HOME/.local/bin" && ln -sf "$HOME/.ansible/venv"/bin/ansible* "$HOME/.local/bin"/`,
+		},
+		{
+			name:   "pip sudo version specifier",
+			config: InstallConfig{Package: "ansible", Version: ">=9,<10", Sudo: true},
+			expected: `sudo sh -c ''"'"'python3'"'"' -m venv "/opt/ansible" && "/opt/ansible/bin/python" -m pip install --disable-pip-version-check '"'"'ansible>=9,<10'"'"' && ` +
+				`mkdir -p "/usr/local/bin" && ln -sf "/opt/ansible"/bin/ansible* "/usr/local/bin"/'`,
+		},
+		{
+			name:       "pipx",
+			config:     InstallConfig{Method: "pipx", Version: "2.16.3"},
+			wheelhouse: "/tmp/wheels",
+			expected:   "pipx install --pip-args '--no-index --find-links /tmp/wheels' 'ansible-core==2.16.3'",
+		},
+		{
+			name:     "pipx sudo",
+			config:   InstallConfig{Method: "pipx", Sudo: true},
+			expected: `sudo sh -c 'PIPX_HOME=/opt/pipx PIPX_BIN_DIR=/usr/local/bin pipx install '"'"'ansible-core'"'"''`,
+		},
+		{
+			name:     "package",
+			config:   InstallConfig{Method: "package", Sudo: true},
+			expected: "sudo sh -c '" + installPackageScript + "'",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if errs := tc.config.Prepare(); len(errs) > 0 {
+				t.Fatalf("err: %v", errs)
+			}
+			if actual := tc.config.Script(tc.wheelhouse); actual != tc.expected {
+				t.Fatalf("expected:\n%s\ngot:\n%s", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestInstallConfig_Prepare(t *testing.T) {
+	testcases := []struct {
+		config        InstallConfig
+		expectedError string
+	}{
+		{InstallConfig{Method: "brew"}, `method must be one of pip, pipx, package or none, got "brew"`},
+		{InstallConfig{Method: "package", Version: "2.16.3"}, "version is not supported by the package method"},
+		{InstallConfig{Wheelhouse: "/does/not/exist"}, "wheelhouse: /does/not/exist is invalid"},
+	}
+	for _, tc := range testcases {
+		errs := tc.config.Prepare()
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), tc.expectedError) {
+			t.Fatalf("expected error %q, got %v", tc.expectedError, errs)
+		}
+	}
+}
+
+func TestCommandName(t *testing.T) {
+	for command, expected := range map[string]string{
+		"ANSIBLE_FORCE_COLOR=1 PYTHONUNBUFFERED=1 ansible-playbook": "ansible-playbook",
+		"/opt/ansible/bin/ansible-playbook -v":                      "/opt/ansible/bin/ansible-playbook",
+		"":                                                          "",
+	} {
+		if actual := commandName(command); actual != expected {
+			t.Fatalf("%q: expected %q, got %q", command, expected, actual)
+		}
+	}
+}
@@ -7,24 +7,42 @@
 package ansiblelocal
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
-	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/hcl/v2/hcldec"
 	"github.com/hashicorp/packer-plugin-sdk/common"
+	"github.com/hashicorp/packer-plugin-sdk/guestexec"
+	"github.com/hashicorp/packer-plugin-sdk/multistep/commonsteps"
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
 	"github.com/hashicorp/packer-plugin-sdk/template/config"
 	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
 	"github.com/hashicorp/packer-plugin-sdk/tmp"
 	"github.com/hashicorp/packer-plugin-sdk/uuid"
+
+	ansiblecommon "github.com/hashicorp/packer-plugin-ansible/provisioner/ansible-common"
 )
 
 const DefaultStagingDir = "/tmp/packer-provisioner-ansible-local"
 
+// DefaultWindowsStagingDir is the default staging directory of Windows
+// guests.
+const DefaultWindowsStagingDir = "C:/Windows/Temp/packer-provisioner-ansible-local"
+
+// Values of galaxy_install_location.
+const (
+	galaxyInstallGuest = "guest"
+	galaxyInstallHost  = "host"
+)
+
 type Config struct {
 	common.PackerConfig `mapstructure:",squash"`
 	ctx                 interpolate.Context
@@ -34,11 +52,38 @@ type Config struct {
 	//  ansible, take a look at the ansible wrapper guide [here](/packer/integrations/hashicorp/ansible/latest/components/provisioner/ansible#using-a-wrapping-script-for-your-ansible-call) for inspiration.
 	//  Please note that Packer expects Command to be a path to an executable.
 	//  Arbitrary bash scripting will not work and needs to go inside an
-	//  executable script.
+	//  executable script. Set environment variables with `ansible_env_vars`
+	//  or `ansible_env` rather than in the command. On `unix` guests, the
+	//  default command is run with `ANSIBLE_FORCE_COLOR=1` and
+	//  `PYTHONUNBUFFERED=1`.
 	Command string `mapstructure:"command"`
+	// Environment variables to set before running Ansible and Ansible
+	// Galaxy, of the form `NAME=value`. The values are quoted for the shell
+	// of the remote machine, so they may contain spaces, quotes or `$`. Usage
+	// example:
+	//
+	// ```hcl
+	// ansible_env_vars = ["ANSIBLE_STDOUT_CALLBACK=yaml", "HTTPS_PROXY=${var.proxy}"]
+	// ```
+	//
+	// The values of the variables marked as sensitive in the template, and
+	// of `sensitive_values`, are masked in the output.
+	AnsibleEnvVars []string `mapstructure:"ansible_env_vars"`
+	// Environment variables to set before running Ansible and Ansible
+	// Galaxy, like `ansible_env_vars`, as a map of names to values. They are
+	// set after `ansible_env_vars`, in the order of their names.
+	//
+	// ```hcl
+	// ansible_env = {
+	//   ANSIBLE_VAULT_IDENTITY = "prod"
+	//   NO_PROXY               = "localhost,127.0.0.1"
+	// }
+	// ```
+	AnsibleEnv map[string]string `mapstructure:"ansible_env"`
 	// Extra arguments to pass to Ansible.
-	// These arguments _will not_ be passed through a shell and arguments should
-	// not be quoted. Usage example:
+	// Each argument is quoted for the shell of the remote machine and is
+	// received as is by Ansible, so arguments should not be quoted. Usage
+	// example:
 	//
 	// ```json
 	//    "extra_arguments": [ "--extra-vars", "Region={{user `Region`}} Stage={{user `Stage`}}" ]
@@ -71,6 +116,29 @@ type Config struct {
 	// ]
 	// ```
 	ExtraArguments []string `mapstructure:"extra_arguments"`
+	// Extra variables passed to `ansible-playbook`, of any type and nesting.
+	// They are written to a JSON file readable only by the user Packer
+	// connects as, uploaded to the staging directory and passed with
+	// `--extra-vars @file`, so that their values don't need to be quoted and
+	// aren't shown in the output. The file is removed after the run.
+	//
+	// ```hcl
+	// extra_vars = {
+	//   app_version = "1.2.3"
+	//   debug       = false
+	//   users = [
+	//     { name = "alice", groups = ["wheel"] },
+	//   ]
+	// }
+	// ```
+	ExtraVars map[string]interface{} `mapstructure:"extra_vars"`
+	// Values to mask as `<sensitive>` in the output of the provisioner, its
+	// `report_file` and its logs, in addition to the values of the variables
+	// marked as sensitive in the template.
+	SensitiveValues []string `mapstructure:"sensitive_values"`
+	// The Ansible Vault passwords. See the [Ansible Vault](#ansible-vault)
+	// section below.
+	ansiblecommon.VaultConfig `mapstructure:",squash"`
 	// A path to the directory containing ansible group
 	// variables on your local system to be copied to the remote machine. By
 	// default, this is empty.
@@ -103,12 +171,31 @@ type Config struct {
 	// An array of local paths of collections to upload.
 	CollectionPaths []string `mapstructure:"collection_paths"`
 
+	// The target guest OS type, either `unix` or `windows`. Setting this to
+	// `windows` runs the commands on the remote machine with PowerShell, for
+	// Ansible running under WSL or Cygwin, and makes the default
+	// `staging_directory` `C:/Windows/Temp/packer-provisioner-ansible-local`.
+	// Backslashes in the remote paths are turned into forward slashes, which
+	// PowerShell accepts. The galaxy roles and collections paths are passed
+	// to Ansible relative to `staging_directory`, so `galaxy_roles_path` and
+	// `galaxy_collections_path` must be on its drive. By default, this is
+	// `unix`.
+	GuestOSType string `mapstructure:"guest_os_type"`
+
 	// The directory where files will be uploaded. Packer requires write
 	// permissions in this directory.
 	StagingDir string `mapstructure:"staging_directory"`
 	// If set to `true`, the content of the `staging_directory` will be removed after
 	// executing ansible. By default this is set to `false`.
 	CleanStagingDir bool `mapstructure:"clean_staging_directory"`
+	// If set to `true`, the playbooks, inventory, variables, roles and
+	// collections are uploaded to the `staging_directory` as a single
+	// compressed tarball built locally, then extracted with `tar` on the
+	// remote machine, instead of one upload per file and directory. This
+	// speeds up builds over WinRM and slow SSH links. When `tar` or `gzip`
+	// are missing on the remote machine, the files are uploaded one by one.
+	// By default this is set to `false`.
+	StagingArchive bool `mapstructure:"staging_archive"`
 	// The inventory file to be used by ansible. This
 	// file must exist on your local system and will be uploaded to the remote
 	// machine.
@@ -150,13 +237,32 @@ type Config struct {
 	// 127.0.0.1
 	// ```
 	InventoryGroups []string `mapstructure:"inventory_groups"`
+	// The child groups of parent groups, by parent group name, written as
+	// `:children` sections of the generated inventory. A parent group listed
+	// in `inventory_groups` is replaced by its leaf groups, so that the host
+	// `127.0.0.1` is only placed in leaf groups. A value of
+	// `{ linux = ["web", "db"] }` with `inventory_groups = ["web"]` will
+	// generate an Ansible inventory like:
+	//
+	// ```text
+	// [web]
+	// 127.0.0.1
+	// [db]
+	// [linux:children]
+	// web
+	// db
+	// ```
+	GroupChildren map[string][]string `mapstructure:"group_children"`
 	// A requirements file which provides a way to
 	//  install roles or collections with the [ansible-galaxy
 	//  cli](https://docs.ansible.com/ansible/latest/galaxy/user_guide.html#the-ansible-galaxy-command-line-tool)
-	//  on the local machine before executing `ansible-playbook`. By default, this is empty.
+	//  on the local machine before executing `ansible-playbook`. The file is
+	//  validated when the build starts: roles need a `src` or a `name`, and
+	//  collections a `name` and a known source `type`. By default, this is empty.
 	GalaxyFile string `mapstructure:"galaxy_file"`
-	// The command to invoke ansible-galaxy. By default, this is
-	// `ansible-galaxy`.
+	// The command to invoke ansible-galaxy, run on the remote machine, or on
+	// the machine running Packer when `galaxy_install_location` is `host`. By
+	// default, this is `ansible-galaxy`.
 	GalaxyCommand string `mapstructure:"galaxy_command"`
 
 	// Force overwriting an existing role.
@@ -175,18 +281,113 @@ type Config struct {
 	//   `ansible-galaxy` command. By default, this will install to a 'galaxy_collections' subfolder in the
 	//   staging/collections directory.
 	GalaxyCollectionsPath string `mapstructure:"galaxy_collections_path"`
+
+	// Where the roles and collections of `galaxy_file` are resolved: `guest`
+	//   runs `galaxy_command` on the remote machine, `host` runs it on the
+	//   machine running Packer and uploads the installed roles and collections
+	//   to `galaxy_roles_path` and `galaxy_collections_path`. Use `host` when the
+	//   remote machine has no Internet access or no galaxy credentials. By
+	//   default, this is `guest`.
+	GalaxyInstallLocation string `mapstructure:"galaxy_install_location"`
+	// How long to wait for `galaxy_command` run on the machine running
+	// Packer to stop after it has been sent an interrupt because the build
+	// was cancelled or timed out, before sending it a terminate signal.
+	// Defaults to `10s`.
+	InterruptGracePeriod time.Duration `mapstructure:"interrupt_grace_period"`
+	// How long to wait for `galaxy_command` run on the machine running
+	// Packer to stop after it has been sent a terminate signal, before
+	// killing it. Defaults to `10s`.
+	TerminateGracePeriod time.Duration `mapstructure:"terminate_grace_period"`
+
+	// Show a concise line for every play and task result instead of the raw
+	// Ansible output, followed by the task counts of every play and the play
+	// recap. Every event is also sent to the machine-readable output as an
+	// `ansible-event`. This uploads a callback plugin shipped with Packer to
+	// the staging directory; the raw output is still written to the Packer
+	// log. By default, this is `false`.
+	StructuredOutput bool `mapstructure:"structured_output"`
+	// Also show the raw Ansible output when `structured_output` is enabled.
+	// By default, this is `false`.
+	ShowRawOutput bool `mapstructure:"show_raw_output"`
+	// Write a JSON report to this path on your local system when the run
+	// finishes, including when it fails. The report holds the start and end
+	// time and duration of the run and of every playbook, the Ansible version,
+	// the command line of every playbook, the play recap of every host and the
+	// name and message of every failed task. This uploads a callback plugin
+	// shipped with Packer to the staging directory. By default, this is empty.
+	ReportFile string `mapstructure:"report_file"`
+	// Write the facts of the host to this path on your local system as a JSON
+	// object once the playbooks are done, such as `ansible_distribution`,
+	// `ansible_kernel` or `ansible_interfaces`. The facts are gathered by a
+	// closing playbook, so that they reflect the changes of the playbooks,
+	// cached as JSON in the staging directory and downloaded from there. The
+	// closing playbook is neither shown nor part of `report_file`, and runs
+	// with the `extra_arguments` but the ones selecting what the playbooks
+	// run or how: `--tags`, `--skip-tags`, `--limit`, `--start-at-task`,
+	// `--check`, `--diff` and `--step`.
+	// With the generated inventory, it runs on `127.0.0.1`. With
+	// `inventory_file`, it runs on `127.0.0.1` if the playbooks ran on it,
+	// else on the only host they ran on; the build fails if they ran on
+	// several other hosts, or if the facts cannot be gathered. The values of
+	// `sensitive_values`, of the sensitive variables and of the vault
+	// passwords are masked in the file. By default, this is empty.
+	FactsOutputFile string `mapstructure:"facts_output_file"`
+	// Write the custom stats set by the playbooks with the `set_stats`
+	// module to this path on your local system as a flat JSON object once
+	// the playbooks are done, for later provisioners and post-processors.
+	// The stats of the run and of the host are merged, so that `per_host`
+	// doesn't matter. This uploads a callback plugin shipped with Packer to
+	// the staging directory. The values of `sensitive_values`, of the
+	// sensitive variables and of the vault passwords are masked in the file.
+	// By default, this is empty.
+	OutputsFile string `mapstructure:"outputs_file"`
+	// Retries a playbook when ansible-playbook fails with one of the given
+	// exit codes. See the [Retry](#retry) section below.
+	Retry ansiblecommon.RetryConfig `mapstructure:"retry"`
+	// Installs Ansible on the remote machine when `command` is not found
+	// there. See the [Install](#install) section below.
+	Install *InstallConfig `mapstructure:"install"`
+	// Files and directories downloaded from the remote machine once the
+	// playbooks have run, even if they failed. See the [Fetch](#fetch)
+	// section below.
+	Fetch []FetchFile `mapstructure:"fetch"`
 }
 
 type Provisioner struct {
 	config Config
 
-	playbookFiles []string
-	generatedData map[string]interface{}
+	playbookFiles     []string
+	generatedData     map[string]interface{}
+	callbackPluginDir string
+	factsCacheDir     string
+	defaultEnv        []string
+	report            *ansiblecommon.Report
+	outputs           *ansiblecommon.Outputs
+	// The hosts in the play recaps of the playbooks, among which is the
+	// host of facts_output_file with a user inventory file.
+	provisionedHosts map[string]bool
+	galaxyReqs       *ansiblecommon.GalaxyRequirements
+	redactor         *ansiblecommon.Redactor
+	shell            guestShell
+	// Set when the inventory file was generated by Packer.
+	generatedInventory bool
+	// Set while the staging files are collected in an archive.
+	archive *stagingArchive
+	// The assignment adding the directory of the commands installed by
+	// install to PATH, when they are only found there.
+	installPathEnv string
 }
 
-func (p *Provisioner) ConfigSpec() hcldec.ObjectSpec { return p.config.FlatMapstructure().HCL2Spec() }
+func (p *Provisioner) ConfigSpec() hcldec.ObjectSpec {
+	spec := ansiblecommon.DynamicAttributes(p.config.FlatMapstructure().HCL2Spec(), "extra_vars")
+	spec["group_children"] = ansiblecommon.GroupChildrenSpec("group_children")
+	return spec
+}
 
 func (p *Provisioner) Prepare(raws ...interface{}) error {
+	if err := ansiblecommon.DecodeDynamicValues(&p.config, raws); err != nil {
+		return err
+	}
 	err := config.Decode(&p.config, &config.DecodeOpts{
 		PluginType:         "ansible-local",
 		Interpolate:        true,
@@ -203,27 +404,101 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 	p.playbookFiles = make([]string, 0, len(p.config.PlaybookFiles))
 
 	// Defaults
+	if p.config.GuestOSType == "" {
+		p.config.GuestOSType = guestexec.DefaultOSType
+	}
+	p.config.GuestOSType = strings.ToLower(p.config.GuestOSType)
+	windows := p.config.GuestOSType == guestexec.WindowsOSType
+	if windows {
+		for _, dir := range []*string{&p.config.StagingDir, &p.config.GalaxyRolesPath, &p.config.GalaxyCollectionsPath} {
+			*dir = strings.ReplaceAll(*dir, `\`, "/")
+		}
+		for i := range p.config.Fetch {
+			p.config.Fetch[i].Source = strings.ReplaceAll(p.config.Fetch[i].Source, `\`, "/")
+		}
+	}
+
+	// The environment of the default command, which ansible_env_vars and
+	// ansible_env override.
+	p.defaultEnv = nil
 	if p.config.Command == "" {
-		p.config.Command = "ANSIBLE_FORCE_COLOR=1 PYTHONUNBUFFERED=1 ansible-playbook"
+		p.config.Command = "ansible-playbook"
+		if !windows {
+			p.defaultEnv = []string{"ANSIBLE_FORCE_COLOR=1", "PYTHONUNBUFFERED=1"}
+		}
 	}
 	if p.config.GalaxyCommand == "" {
 		p.config.GalaxyCommand = "ansible-galaxy"
 	}
+	if p.config.GalaxyInstallLocation == "" {
+		p.config.GalaxyInstallLocation = galaxyInstallGuest
+	}
+	if p.config.InterruptGracePeriod == 0 {
+		p.config.InterruptGracePeriod = ansiblecommon.DefaultInterruptGracePeriod
+	}
+	if p.config.TerminateGracePeriod == 0 {
+		p.config.TerminateGracePeriod = ansiblecommon.DefaultTerminateGracePeriod
+	}
 
 	if p.config.StagingDir == "" {
-		p.config.StagingDir = filepath.ToSlash(filepath.Join(DefaultStagingDir, uuid.TimeOrderedUUID()))
+		p.config.StagingDir = path.Join(DefaultStagingDir, uuid.TimeOrderedUUID())
+		if windows {
+			p.config.StagingDir = path.Join(DefaultWindowsStagingDir, uuid.TimeOrderedUUID())
+		}
 	}
 
 	if p.config.GalaxyRolesPath == "" {
-		p.config.GalaxyRolesPath = filepath.ToSlash(filepath.Join(p.config.StagingDir, "galaxy_roles"))
+		p.config.GalaxyRolesPath = p.stagingPath("galaxy_roles")
 	}
 
 	if p.config.GalaxyCollectionsPath == "" {
-		p.config.GalaxyCollectionsPath = filepath.ToSlash(filepath.Join(p.config.StagingDir, "galaxy_collections"))
+		p.config.GalaxyCollectionsPath = p.stagingPath("galaxy_collections")
 	}
 
 	// Validation
 	var errs *packersdk.MultiError
+	if windows {
+		// The galaxy paths are made relative to the staging directory in
+		// the environment of Ansible, see powershellShell.AppendEnvPath.
+		for _, dir := range []struct{ name, path string }{
+			{"galaxy_roles_path", p.config.GalaxyRolesPath},
+			{"galaxy_collections_path", p.config.GalaxyCollectionsPath},
+		} {
+			if _, ok := relativePath(p.config.StagingDir, dir.path); !ok {
+				errs = packersdk.MultiErrorAppend(errs, fmt.Errorf(
+					"%s must be on the drive of staging_directory with guest_os_type windows, got %q", dir.name, dir.path))
+			}
+		}
+	}
+	errs = packersdk.MultiErrorAppend(errs, p.config.Retry.Prepare()...)
+	errs = packersdk.MultiErrorAppend(errs, p.config.VaultConfig.Prepare()...)
+
+	for _, env := range p.config.AnsibleEnvVars {
+		if name, _, ok := strings.Cut(env, "="); !ok || !validEnvName(name) {
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("ansible_env_vars: %q must be of the form NAME=value", env))
+		}
+	}
+	for name := range p.config.AnsibleEnv {
+		if !validEnvName(name) {
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("ansible_env: %q is not a valid environment variable name", name))
+		}
+	}
+
+	if p.shell, err = newGuestShell(p.config.GuestOSType); err != nil {
+		errs = packersdk.MultiErrorAppend(errs, err)
+	}
+	if p.config.Install != nil {
+		errs = packersdk.MultiErrorAppend(errs, p.config.Install.Prepare()...)
+		if windows && p.config.Install.Method != installNone {
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("install: only the none method is supported on windows guests"))
+		}
+	}
+
+	for i := range p.config.Fetch {
+		for _, err := range p.config.Fetch[i].Prepare() {
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("fetch[%d]: %s", i, err))
+		}
+	}
 
 	// Check that either playbook_file or playbook_files is specified
 	if len(p.config.PlaybookFiles) != 0 && p.config.PlaybookFile != "" {
@@ -260,13 +535,32 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 		}
 	}
 
-	// Check that the galaxy file exists, if configured
+	if err := p.inventory().Validate(); err != nil {
+		errs = packersdk.MultiErrorAppend(errs, err)
+	}
+
+	// Check that the galaxy file exists and is valid, if configured
+	p.galaxyReqs = nil
 	if len(p.config.GalaxyFile) > 0 {
 		err = validateFileConfig(p.config.GalaxyFile, "galaxy_file", true)
 		if err != nil {
 			errs = packersdk.MultiErrorAppend(errs, err)
+		} else if p.galaxyReqs, err = ansiblecommon.ParseGalaxyFile(p.config.GalaxyFile); err != nil {
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("galaxy_file: %s", err))
 		}
 	}
+	switch p.config.GalaxyInstallLocation {
+	case galaxyInstallGuest:
+	case galaxyInstallHost:
+		if len(p.config.GalaxyFile) > 0 {
+			if _, err := exec.LookPath(p.config.GalaxyCommand); err != nil {
+				errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("galaxy_command: %s", err))
+			}
+		}
+	default:
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("galaxy_install_location must be %s or %s, got %q",
+			galaxyInstallGuest, galaxyInstallHost, p.config.GalaxyInstallLocation))
+	}
 
 	// Check that the playbook_dir directory exists, if configured
 	if len(p.config.PlaybookDir) > 0 {
@@ -306,24 +600,97 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 		}
 	}
 
+	ansiblecommon.FilterLogs(p.sensitiveValues()...)
+
 	if errs != nil && len(errs.Errors) > 0 {
 		return errs
 	}
 	return nil
 }
 
+// inventory returns the groups of the generated inventory.
+func (p *Provisioner) inventory() *ansiblecommon.Inventory {
+	return &ansiblecommon.Inventory{
+		Host:          "127.0.0.1",
+		Groups:        p.config.InventoryGroups,
+		GroupChildren: p.config.GroupChildren,
+	}
+}
+
 func (p *Provisioner) Provision(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator, generatedData map[string]interface{}) error {
+	p.redactor = ansiblecommon.NewRedactor(p.sensitiveValues()...)
+	ui = &ansiblecommon.RedactingUi{Ui: ui, Redactor: p.redactor}
+	finishReport := p.startReport(ui)
+	err := p.redactor.Error(p.provision(ctx, ui, comm, generatedData))
+	finishReport(err)
+	return err
+}
+
+// startReport starts the report of report_file, if any, before anything can
+// fail. The returned function finishes the report with the error of the
+// run and writes it.
+func (p *Provisioner) startReport(ui packersdk.Ui) func(err error) {
+	if p.config.ReportFile == "" {
+		return func(error) {}
+	}
+	p.report = ansiblecommon.NewReport("")
+	p.report.Redactor = p.redactor
+	return func(err error) {
+		p.report.Finish(err)
+		if writeErr := p.report.WriteFile(p.config.ReportFile); writeErr != nil {
+			ui.Error(fmt.Sprintf("Error writing report file: %s", writeErr))
+		}
+		p.report = nil
+	}
+}
+
+// sensitiveValues returns the values of the sensitive variables of the
+// template, sensitive_values and the vault passwords, which are masked in
+// the output.
+func (p *Provisioner) sensitiveValues() []string {
+	values := append([]string{}, p.config.PackerSensitiveVars...)
+	values = append(values, p.config.SensitiveValues...)
+	return append(values, p.config.VaultConfig.Passwords()...)
+}
+
+func (p *Provisioner) provision(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator, generatedData map[string]interface{}) error {
 	ui.Say("Provisioning with Ansible...")
 	p.generatedData = generatedData
 
+	if p.config.Install != nil {
+		if err := p.installAnsible(ctx, ui, comm); err != nil {
+			return fmt.Errorf("Error installing Ansible: %s", err)
+		}
+	}
+
+	if p.config.StagingArchive {
+		ok, err := p.guestCheck(ctx, ui, comm, p.shell.HasTar())
+		if err != nil {
+			return fmt.Errorf("Error checking for tar: %s", err)
+		}
+		if ok {
+			archive, err := newStagingArchive(p.config.StagingDir)
+			if err != nil {
+				return fmt.Errorf("Error creating staging archive: %s", err)
+			}
+			p.archive = archive
+			defer func() {
+				archive.remove()
+				p.archive = nil
+			}()
+		} else {
+			ui.Say("tar or gzip is missing on the remote machine, uploading the files one by one...")
+		}
+	}
+
 	if len(p.config.PlaybookDir) > 0 {
 		ui.Say("Uploading Playbook directory to Ansible staging directory...")
-		if err := p.uploadDir(ui, comm, p.config.StagingDir, p.config.PlaybookDir); err != nil {
+		if err := p.uploadDir(ctx, ui, comm, p.config.StagingDir, p.config.PlaybookDir); err != nil {
 			return fmt.Errorf("Error uploading playbook_dir directory: %s", err)
 		}
 	} else {
 		ui.Say("Creating Ansible staging directory...")
-		if err := p.createDir(ui, comm, p.config.StagingDir); err != nil {
+		if err := p.createDir(ctx, ui, comm, p.config.StagingDir); err != nil {
 			return fmt.Errorf("Error creating staging directory: %s", err)
 		}
 	}
@@ -331,11 +698,11 @@ func (p *Provisioner) Provision(ctx context.Context, ui packersdk.Ui, comm packe
 	if p.config.PlaybookFile != "" {
 		ui.Say("Uploading main Playbook file...")
 		src := p.config.PlaybookFile
-		dst := filepath.ToSlash(filepath.Join(p.config.StagingDir, filepath.Base(src)))
+		dst := p.stagingPath(filepath.Base(src))
 		if err := p.uploadFile(ui, comm, dst, src); err != nil {
 			return fmt.Errorf("Error uploading main playbook: %s", err)
 		}
-	} else if err := p.provisionPlaybookFiles(ui, comm); err != nil {
+	} else if err := p.provisionPlaybookFiles(ctx, ui, comm); err != nil {
 		return err
 	}
 
@@ -347,11 +714,13 @@ func (p *Provisioner) Provision(ctx context.Context, ui packersdk.Ui, comm packe
 		defer func() {
 			_ = os.Remove(tf.Name())
 		}()
-		if len(p.config.InventoryGroups) != 0 {
+		if len(p.config.InventoryGroups) != 0 || len(p.config.GroupChildren) != 0 {
+			inventory := p.inventory()
 			content := ""
-			for _, group := range p.config.InventoryGroups {
-				content += fmt.Sprintf("[%s]\n127.0.0.1\n", group)
+			if len(inventory.HostGroups()) == 0 {
+				content = "127.0.0.1\n"
 			}
+			content += inventory.INIGroups("127.0.0.1\n")
 			_, err = tf.Write([]byte(content))
 		} else {
 			_, err = tf.Write([]byte("127.0.0.1"))
@@ -364,15 +733,21 @@ func (p *Provisioner) Provision(ctx context.Context, ui packersdk.Ui, comm packe
 			return fmt.Errorf("Error preparing inventory file: %s", err)
 		}
 		p.config.InventoryFile = tf.Name()
+		p.generatedInventory = true
 		defer func() {
 			p.config.InventoryFile = ""
+			p.generatedInventory = false
 		}()
 	}
 
-	if len(p.config.GalaxyFile) > 0 {
+	if len(p.config.GalaxyFile) > 0 && p.config.GalaxyInstallLocation == galaxyInstallHost {
+		if err := p.executeHostGalaxy(ctx, ui, comm); err != nil {
+			return fmt.Errorf("Error executing Ansible Galaxy: %s", err)
+		}
+	} else if len(p.config.GalaxyFile) > 0 {
 		ui.Say("Uploading galaxy file...")
 		src := p.config.GalaxyFile
-		dst := filepath.ToSlash(filepath.Join(p.config.StagingDir, filepath.Base(src)))
+		dst := p.stagingPath(filepath.Base(src))
 		if err := p.uploadFile(ui, comm, dst, src); err != nil {
 			return fmt.Errorf("Error uploading galaxy file: %s", err)
 		}
@@ -380,7 +755,7 @@ func (p *Provisioner) Provision(ctx context.Context, ui packersdk.Ui, comm packe
 
 	ui.Say("Uploading inventory file...")
 	src := p.config.InventoryFile
-	dst := filepath.ToSlash(filepath.Join(p.config.StagingDir, filepath.Base(src)))
+	dst := p.stagingPath(filepath.Base(src))
 	if err := p.uploadFile(ui, comm, dst, src); err != nil {
 		return fmt.Errorf("Error uploading inventory file: %s", err)
 	}
@@ -388,8 +763,8 @@ func (p *Provisioner) Provision(ctx context.Context, ui packersdk.Ui, comm packe
 	if len(p.config.GroupVars) > 0 {
 		ui.Say("Uploading group_vars directory...")
 		src := p.config.GroupVars
-		dst := filepath.ToSlash(filepath.Join(p.config.StagingDir, "group_vars"))
-		if err := p.uploadDir(ui, comm, dst, src); err != nil {
+		dst := p.stagingPath("group_vars")
+		if err := p.uploadDir(ctx, ui, comm, dst, src); err != nil {
 			return fmt.Errorf("Error uploading group_vars directory: %s", err)
 		}
 	}
@@ -397,8 +772,8 @@ func (p *Provisioner) Provision(ctx context.Context, ui packersdk.Ui, comm packe
 	if len(p.config.HostVars) > 0 {
 		ui.Say("Uploading host_vars directory...")
 		src := p.config.HostVars
-		dst := filepath.ToSlash(filepath.Join(p.config.StagingDir, "host_vars"))
-		if err := p.uploadDir(ui, comm, dst, src); err != nil {
+		dst := p.stagingPath("host_vars")
+		if err := p.uploadDir(ctx, ui, comm, dst, src); err != nil {
 			return fmt.Errorf("Error uploading host_vars directory: %s", err)
 		}
 	}
@@ -406,8 +781,8 @@ func (p *Provisioner) Provision(ctx context.Context, ui packersdk.Ui, comm packe
 	if len(p.config.RolePaths) > 0 {
 		ui.Say("Uploading role directories...")
 		for _, src := range p.config.RolePaths {
-			dst := filepath.ToSlash(filepath.Join(p.config.StagingDir, "roles", filepath.Base(src)))
-			if err := p.uploadDir(ui, comm, dst, src); err != nil {
+			dst := p.stagingPath("roles", filepath.Base(src))
+			if err := p.uploadDir(ctx, ui, comm, dst, src); err != nil {
 				return fmt.Errorf("Error uploading roles: %s", err)
 			}
 		}
@@ -416,8 +791,8 @@ func (p *Provisioner) Provision(ctx context.Context, ui packersdk.Ui, comm packe
 	if len(p.config.CollectionPaths) > 0 {
 		ui.Say("Uploading collection directories...")
 		for _, src := range p.config.CollectionPaths {
-			dst := filepath.ToSlash(filepath.Join(p.config.StagingDir, "collections", filepath.Base(src)))
-			if err := p.uploadDir(ui, comm, dst, src); err != nil {
+			dst := p.stagingPath("collections", filepath.Base(src))
+			if err := p.uploadDir(ctx, ui, comm, dst, src); err != nil {
 				return fmt.Errorf("Error uploading collections: %s", err)
 			}
 		}
@@ -425,32 +800,49 @@ func (p *Provisioner) Provision(ctx context.Context, ui packersdk.Ui, comm packe
 
 	if len(p.config.PlaybookPaths) > 0 {
 		ui.Say("Uploading additional Playbooks...")
-		playbookDir := filepath.ToSlash(filepath.Join(p.config.StagingDir, "playbooks"))
-		if err := p.createDir(ui, comm, playbookDir); err != nil {
+		playbookDir := p.stagingPath("playbooks")
+		if err := p.createDir(ctx, ui, comm, playbookDir); err != nil {
 			return fmt.Errorf("Error creating playbooks directory: %s", err)
 		}
 		for _, src := range p.config.PlaybookPaths {
-			dst := filepath.ToSlash(filepath.Join(playbookDir, filepath.Base(src)))
-			if err := p.uploadDir(ui, comm, dst, src); err != nil {
+			dst := path.Join(playbookDir, filepath.Base(src))
+			if err := p.uploadDir(ctx, ui, comm, dst, src); err != nil {
 				return fmt.Errorf("Error uploading playbooks: %s", err)
 			}
 		}
 	}
 
-	if err := p.executeAnsible(ui, comm); err != nil {
-		return fmt.Errorf("Error executing Ansible: %s", err)
+	if p.archive != nil {
+		if err := p.uploadArchive(ctx, ui, comm); err != nil {
+			return fmt.Errorf("Error uploading staging archive: %s", err)
+		}
+	}
+
+	err := p.executeAnsible(ctx, ui, comm)
+	if len(p.config.Fetch) > 0 {
+		// The files are fetched even if a playbook failed, as they may
+		// explain why.
+		if fetchErr := p.fetchFiles(ui, comm); fetchErr != nil {
+			if err == nil {
+				return fmt.Errorf("Error fetching files: %s", fetchErr)
+			}
+			ui.Error(fmt.Sprintf("Error fetching files: %s", fetchErr))
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Error executing Ansible: %w", err)
 	}
 
 	if p.config.CleanStagingDir {
 		ui.Say("Removing staging directory...")
-		if err := p.removeDir(ui, comm, p.config.StagingDir); err != nil {
+		if err := p.removeDir(ctx, ui, comm, p.config.StagingDir); err != nil {
 			return fmt.Errorf("Error removing staging directory: %s", err)
 		}
 	}
 	return nil
 }
 
-func (p *Provisioner) provisionPlaybookFiles(ui packersdk.Ui, comm packersdk.Communicator) error {
+func (p *Provisioner) provisionPlaybookFiles(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator) error {
 	var playbookDir string
 	if p.config.PlaybookDir != "" {
 		var err error
@@ -464,20 +856,20 @@ func (p *Provisioner) provisionPlaybookFiles(ui packersdk.Ui, comm packersdk.Com
 			p.playbookFiles[index] = strings.TrimPrefix(playbookFile, playbookDir)
 			continue
 		}
-		if err := p.provisionPlaybookFile(ui, comm, playbookFile); err != nil {
+		if err := p.provisionPlaybookFile(ctx, ui, comm, playbookFile); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (p *Provisioner) provisionPlaybookFile(ui packersdk.Ui, comm packersdk.Communicator, playbookFile string) error {
+func (p *Provisioner) provisionPlaybookFile(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator, playbookFile string) error {
 	ui.Say(fmt.Sprintf("Uploading playbook file: %s", playbookFile))
 
-	remoteDir := filepath.ToSlash(filepath.Join(p.config.StagingDir, filepath.Dir(playbookFile)))
-	remotePlaybookFile := filepath.ToSlash(filepath.Join(p.config.StagingDir, playbookFile))
+	remoteDir := p.stagingPath(filepath.Dir(playbookFile))
+	remotePlaybookFile := p.stagingPath(playbookFile)
 
-	if err := p.createDir(ui, comm, remoteDir); err != nil {
+	if err := p.createDir(ctx, ui, comm, remoteDir); err != nil {
 		return fmt.Errorf("Error uploading playbook file: %s [%s]", playbookFile, err)
 	}
 
@@ -488,56 +880,41 @@ func (p *Provisioner) provisionPlaybookFile(ui packersdk.Ui, comm packersdk.Comm
 	return nil
 }
 
-func (p *Provisioner) executeGalaxy(ui packersdk.Ui, comm packersdk.Communicator) error {
-	galaxyFile := filepath.ToSlash(filepath.Join(p.config.StagingDir, filepath.Base(p.config.GalaxyFile)))
-
-	// ansible-galaxy install -r requirements.yml
-	roleArgs := []string{"install", "-r", galaxyFile, "-p", filepath.ToSlash(p.config.GalaxyRolesPath)}
-
-	// Instead of modifying args depending on config values and removing or modifying values from
-	// the slice between role and collection installs, just use 2 slices and simplify everything
-	collectionArgs := []string{"collection", "install", "-r", galaxyFile, "-p", filepath.ToSlash(p.config.GalaxyCollectionsPath)}
-
-	// Add force to arguments
-	if p.config.GalaxyForceInstall {
-		roleArgs = append(roleArgs, "-f")
-		collectionArgs = append(collectionArgs, "-f")
-	}
-
-	// Search galaxy_file for roles and collections keywords
-	f, err := os.ReadFile(p.config.GalaxyFile)
-	if err != nil {
-		return err
-	}
-	hasRoles, _ := regexp.Match(`(?m)^roles:`, f)
-	hasCollections, _ := regexp.Match(`(?m)^collections:`, f)
-
-	// If if roles keyword present (v2 format), or no collections keyword present (v1), install roles
-	if hasRoles || !hasCollections {
-		if roleInstallError := p.invokeGalaxyCommand(roleArgs, ui, comm); roleInstallError != nil {
-			return roleInstallError
+func (p *Provisioner) executeGalaxy(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator) error {
+	galaxyFile := p.stagingPath(filepath.Base(p.config.GalaxyFile))
+
+	for _, step := range p.galaxyReqs.Steps(galaxyFile) {
+		args := step.Args
+		// ansible-galaxy install -r requirements.yml -p roles_path
+		switch step.Kind {
+		case ansiblecommon.GalaxyRoles:
+			args = append(args, "-p", filepath.ToSlash(p.config.GalaxyRolesPath))
+		case ansiblecommon.GalaxyCollections:
+			args = append(args, "-p", filepath.ToSlash(p.config.GalaxyCollectionsPath))
+		}
+		// Add force to arguments
+		if p.config.GalaxyForceInstall {
+			args = append(args, "-f")
 		}
-	}
 
-	// If collections keyword present (v2 format), install collections
-	if hasCollections {
-		if collectionInstallError := p.invokeGalaxyCommand(collectionArgs, ui, comm); collectionInstallError != nil {
-			return collectionInstallError
+		galaxyUi := &ansiblecommon.GalaxyUi{Ui: ui, Step: step}
+		galaxyUi.Start()
+		if err := p.invokeGalaxyCommand(ctx, args, galaxyUi, comm); err != nil {
+			return err
 		}
 	}
-
 	return nil
 }
 
 // Intended to be invoked from p.executeGalaxy depending on the Ansible Galaxy parameters passed to Packer
-func (p *Provisioner) invokeGalaxyCommand(args []string, ui packersdk.Ui, comm packersdk.Communicator) error {
-	ctx := context.TODO()
-	command := fmt.Sprintf("cd %s && %s %s",
-		p.config.StagingDir, p.config.GalaxyCommand, strings.Join(args, " "))
-	ui.Say(fmt.Sprintf("Executing Ansible Galaxy: %s", command))
+func (p *Provisioner) invokeGalaxyCommand(ctx context.Context, args []string, ui packersdk.Ui, comm packersdk.Communicator) error {
+	galaxyCommand := p.config.GalaxyCommand + " " + p.shell.Args(args)
+	command := p.shell.Chain(p.shell.Cd(p.config.StagingDir), p.shell.WithEnv(p.ansibleEnv(false), galaxyCommand))
+	ui.Say(fmt.Sprintf("Executing Ansible Galaxy: %s",
+		p.shell.Chain(p.shell.Cd(p.config.StagingDir), p.shell.WithEnv(p.ansibleEnv(true), galaxyCommand))))
 
 	cmd := &packersdk.RemoteCmd{
-		Command: command,
+		Command: p.shell.Command(command),
 	}
 	if err := cmd.RunWithUi(ctx, comm, ui); err != nil {
 		return err
@@ -549,55 +926,230 @@ func (p *Provisioner) invokeGalaxyCommand(args []string, ui packersdk.Ui, comm p
 	return nil
 }
 
-func (p *Provisioner) executeAnsible(ui packersdk.Ui, comm packersdk.Communicator) error {
-	inventory := filepath.ToSlash(filepath.Join(p.config.StagingDir, filepath.Base(p.config.InventoryFile)))
+func (p *Provisioner) executeAnsible(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator) error {
+	if p.config.OutputsFile != "" {
+		p.outputs = ansiblecommon.NewOutputs()
+		p.outputs.Redactor = p.redactor
+		defer func() {
+			p.outputs = nil
+		}()
+	}
+	if p.config.FactsOutputFile != "" {
+		p.provisionedHosts = map[string]bool{}
+		defer func() {
+			p.provisionedHosts = nil
+		}()
+	}
+
+	inventory := p.stagingPath(filepath.Base(p.config.InventoryFile))
 
-	extraArgs := fmt.Sprintf(" --extra-vars \"packer_build_name=%s packer_builder_type=%s packer_http_addr=%s -o IdentitiesOnly=yes\" ",
-		p.config.PackerBuildName, p.config.PackerBuilderType, p.generatedData["PackerHTTPAddr"])
-	if len(p.config.ExtraArguments) > 0 {
-		extraArgs = extraArgs + strings.Join(p.config.ExtraArguments, " ")
+	var extraArgs []string
+	if p.config.PackerBuildName != "" {
+		extraArgs = append(extraArgs, "--extra-vars", fmt.Sprintf("packer_build_name=%q", p.config.PackerBuildName))
+	}
+	extraArgs = append(extraArgs, "--extra-vars", fmt.Sprintf("packer_builder_type=%s", p.config.PackerBuilderType))
+	if httpAddr, ok := p.generatedData["PackerHTTPAddr"].(string); ok && httpAddr != commonsteps.HttpAddrNotImplemented {
+		extraArgs = append(extraArgs, "--extra-vars", fmt.Sprintf("packer_http_addr=%s", httpAddr))
+	}
+	if len(p.config.ExtraVars) > 0 {
+		dst := p.stagingPath("packer-extra-vars.json")
+		ui.Message("Uploading extra_vars file...")
+		b, err := ansiblecommon.ExtraVarsJSON(p.config.ExtraVars)
+		if err != nil {
+			return fmt.Errorf("Error uploading extra_vars file: %s", err)
+		}
+		if err := p.uploadPrivateFile(comm, dst, b, 0600); err != nil {
+			return fmt.Errorf("Error uploading extra_vars file: %s", err)
+		}
+		defer func() {
+			// The file is removed even if the build was cancelled.
+			if err := p.removeFile(context.Background(), ui, comm, dst); err != nil {
+				ui.Error(fmt.Sprintf("Error removing extra_vars file: %s", err))
+			}
+		}()
+		extraArgs = append(extraArgs, "--extra-vars", "@"+dst)
 	}
 
+	var vaultFiles []string
+	defer func() {
+		// The files are removed even if the build was cancelled.
+		for _, file := range vaultFiles {
+			if err := p.removeFile(context.Background(), ui, comm, file); err != nil {
+				ui.Error(fmt.Sprintf("Error removing vault password file: %s", err))
+			}
+		}
+	}()
+	vaultArgs, err := p.config.VaultConfig.Args(func(name string, content []byte, mode os.FileMode) (string, error) {
+		dst := p.stagingPath("packer-" + name)
+		vaultFiles = append(vaultFiles, dst)
+		return dst, p.uploadPrivateFile(comm, dst, content, mode)
+	}, true)
+	if err != nil {
+		return fmt.Errorf("Error uploading vault password files: %s", err)
+	}
+	extraArgs = append(extraArgs, vaultArgs...)
+	// The closing playbook gathering the facts only needs the extra
+	// arguments with which the playbooks reached the host.
+	playbookArgs := append(append([]string{}, extraArgs...), p.config.ExtraArguments...)
+
 	// Fetch external dependencies
-	if len(p.config.GalaxyFile) > 0 {
-		if err := p.executeGalaxy(ui, comm); err != nil {
+	if len(p.config.GalaxyFile) > 0 && p.config.GalaxyInstallLocation == galaxyInstallGuest {
+		if err := p.executeGalaxy(ctx, ui, comm); err != nil {
 			return fmt.Errorf("Error executing Ansible Galaxy: %s", err)
 		}
 	}
 
-	if p.config.PlaybookFile != "" {
-		playbookFile := filepath.ToSlash(filepath.Join(p.config.StagingDir, filepath.Base(p.config.PlaybookFile)))
-		if err := p.executeAnsiblePlaybook(ui, comm, playbookFile, extraArgs, inventory); err != nil {
-			return err
+	if p.usesCallbackPlugin() {
+		ui.Say("Uploading callback plugin...")
+		dir := p.stagingPath("packer_callback_plugins")
+		if err := p.createDir(ctx, ui, comm, dir); err != nil {
+			return fmt.Errorf("Error creating callback plugin directory: %s", err)
 		}
+		dst := path.Join(dir, ansiblecommon.CallbackPluginFile)
+		if err := comm.Upload(dst, ansiblecommon.CallbackPlugin(), nil); err != nil {
+			return fmt.Errorf("Error uploading callback plugin: %s", err)
+		}
+		p.callbackPluginDir = dir
+		defer func() {
+			p.callbackPluginDir = ""
+		}()
 	}
 
+	var playbookFiles []string
+	if p.config.PlaybookFile != "" {
+		playbookFiles = append(playbookFiles, p.stagingPath(filepath.Base(p.config.PlaybookFile)))
+	}
 	for _, playbookFile := range p.playbookFiles {
-		playbookFile = filepath.ToSlash(filepath.Join(p.config.StagingDir, playbookFile))
-		if err := p.executeAnsiblePlaybook(ui, comm, playbookFile, extraArgs, inventory); err != nil {
+		playbookFiles = append(playbookFiles, p.stagingPath(playbookFile))
+	}
+
+	for _, playbookFile := range playbookFiles {
+		err := p.config.Retry.Run(ctx, ui, "Playbook "+playbookFile, func(int) (int, error) {
+			return p.executeAnsiblePlaybook(ctx, ui, comm, playbookFile, playbookArgs, inventory)
+		})
+		if err != nil {
 			return err
 		}
 	}
+
+	if p.config.FactsOutputFile != "" {
+		factsArgs := append(append([]string{}, extraArgs...), ansiblecommon.FactsArgs(p.config.ExtraArguments)...)
+		if err := p.writeFactsFile(ctx, ui, comm, factsArgs, inventory); err != nil {
+			return fmt.Errorf("Error writing facts file: %s", err)
+		}
+	}
+
+	if p.outputs != nil {
+		if err := p.outputs.WriteFile(p.config.OutputsFile); err != nil {
+			return fmt.Errorf("Error writing outputs file: %s", err)
+		}
+	}
 	return nil
 }
 
+// writeFactsFile gathers the facts of the host with a closing playbook,
+// cached in the staging directory, and downloads them to
+// facts_output_file. The closing playbook isn't one of the playbooks: it is
+// neither reported nor shown.
+func (p *Provisioner) writeFactsFile(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator, extraArgs []string, inventory string) error {
+	host := p.inventory().Host
+	if !p.generatedInventory {
+		var err error
+		if host, err = ansiblecommon.FactsHost(host, p.provisionedHosts); err != nil {
+			return err
+		}
+	}
+	ui.Say(fmt.Sprintf("Gathering the facts of %s...", host))
+	playbookFile := p.stagingPath(ansiblecommon.FactsPlaybookFile)
+	if err := p.uploadContent(comm, playbookFile, ansiblecommon.FactsPlaybook(host)); err != nil {
+		return err
+	}
+	p.factsCacheDir = p.stagingPath("packer-facts")
+	defer func() {
+		// The files are removed even if the build was cancelled.
+		if err := p.removeFile(context.Background(), ui, comm, playbookFile); err != nil {
+			ui.Error(fmt.Sprintf("Error removing facts playbook: %s", err))
+		}
+		if err := p.removeDir(context.Background(), ui, comm, p.factsCacheDir); err != nil {
+			ui.Error(fmt.Sprintf("Error removing fact cache: %s", err))
+		}
+		p.factsCacheDir = ""
+	}()
+
+	quiet := &ansiblecommon.QuietUi{Ui: ui}
+	output := &ansiblecommon.EventUi{Ui: quiet, Structured: true}
+	if _, err := p.runPlaybook(ctx, quiet, output, nil, comm, playbookFile, extraArgs, inventory); err != nil {
+		return err
+	}
+	var cached bytes.Buffer
+	if err := comm.Download(path.Join(p.factsCacheDir, ansiblecommon.FactsCacheFile(host)), &cached); err != nil {
+		return fmt.Errorf("no facts were gathered for %s: %s", host, err)
+	}
+	return ansiblecommon.WriteFactsFile(p.config.FactsOutputFile, cached.Bytes(), p.redactor)
+}
+
+// usesCallbackPlugin reports whether the packer callback plugin is needed to
+// collect events from ansible-playbook.
+func (p *Provisioner) usesCallbackPlugin() bool {
+	return p.config.StructuredOutput || p.config.ReportFile != "" || p.config.OutputsFile != "" ||
+		p.config.FactsOutputFile != ""
+}
+
+// recordEvent passes an event of the callback plugin to the report and the
+// outputs, if any.
+func (p *Provisioner) recordEvent(ev *ansiblecommon.Event) {
+	if p.report != nil {
+		p.report.Record(ev)
+	}
+	if p.outputs != nil {
+		p.outputs.Record(ev)
+	}
+	if p.provisionedHosts != nil && ev.Event == "stats" {
+		for host := range ev.Stats {
+			p.provisionedHosts[host] = true
+		}
+	}
+}
+
+// executeAnsiblePlaybook runs a single playbook and returns the exit status
+// of ansible-playbook, or -1 if it didn't run.
 func (p *Provisioner) executeAnsiblePlaybook(
-	ui packersdk.Ui, comm packersdk.Communicator, playbookFile, extraArgs, inventory string,
-) error {
-	ctx := context.TODO()
-	env_vars := ""
+	ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator, playbookFile string, extraArgs []string, inventory string,
+) (int, error) {
+	output := &ansiblecommon.EventUi{
+		Ui:         ui,
+		Structured: p.config.StructuredOutput,
+		ShowRaw:    p.config.ShowRawOutput,
+	}
+	output.OnEvent = p.recordEvent
+	return p.runPlaybook(ctx, ui, output, p.report, comm, playbookFile, extraArgs, inventory)
+}
+
+// runPlaybook runs ansible-playbook on playbookFile with its output sent to
+// output, and records the run in report if it isn't nil.
+func (p *Provisioner) runPlaybook(
+	ctx context.Context, ui packersdk.Ui, output *ansiblecommon.EventUi, report *ansiblecommon.Report,
+	comm packersdk.Communicator, playbookFile string, extraArgs []string, inventory string,
+) (int, error) {
+	var env_vars []string
+	for _, env := range p.defaultEnv {
+		name, value, _ := strings.Cut(env, "=")
+		env_vars = append(env_vars, p.shell.SetEnv(name, value))
+	}
+	// ansible_env_vars and ansible_env are set before the paths below, so
+	// that the staging paths are appended to their values. They are masked in the
+	// displayed command before being quoted, which could otherwise change
+	// the sensitive values beyond what the redacting ui recognizes.
+	displayed_env := append(append([]string{}, env_vars...), p.ansibleEnv(true)...)
+	env_vars = append(env_vars, p.ansibleEnv(false)...)
+	var staging_vars []string
 	galaxyFileHasCollections := false
 	galaxyFileHasRoles := false
 
-	// Check if we have custom collections from either galaxy or locally. TODO: Abstract to function
-	// as we use the same check in executeGalaxy
-	if len(p.config.GalaxyFile) > 0 {
-		f, err := os.ReadFile(p.config.GalaxyFile)
-		if err != nil {
-			return err
-		}
-		galaxyFileHasCollections, _ = regexp.Match(`(?m)^collections:`, f)
-		galaxyFileHasRoles, _ = regexp.Match(`(?m)^roles:`, f)
+	// Check if we have custom collections from either galaxy or locally.
+	if p.galaxyReqs != nil {
+		galaxyFileHasCollections = len(p.galaxyReqs.Collections) > 0
+		galaxyFileHasRoles = len(p.galaxyReqs.Roles) > 0
 	}
 
 	collections_path := []string{}
@@ -607,26 +1159,88 @@ func (p *Provisioner) executeAnsiblePlaybook(
 	}
 
 	if len(p.config.CollectionPaths) > 0 {
-		collections_path = append(collections_path, filepath.ToSlash(filepath.Join(p.config.StagingDir, "collections")))
+		collections_path = append(collections_path, p.stagingPath("collections"))
 	}
 
 	if len(collections_path) > 0 {
-		env_vars += fmt.Sprintf(" ANSIBLE_COLLECTIONS_PATH=$ANSIBLE_COLLECTIONS_PATH:%s",
-			strings.Join(collections_path, ":"))
+		staging_vars = append(staging_vars, p.shell.AppendEnvPath("ANSIBLE_COLLECTIONS_PATH", p.config.StagingDir, collections_path))
 	}
 
 	if galaxyFileHasRoles {
-		env_vars += fmt.Sprintf(" ANSIBLE_ROLES_PATH=$ANSIBLE_ROLES_PATH:%s",
-			p.config.GalaxyRolesPath)
+		staging_vars = append(staging_vars, p.shell.AppendEnvPath("ANSIBLE_ROLES_PATH", p.config.StagingDir, []string{p.config.GalaxyRolesPath}))
+	}
+
+	if p.callbackPluginDir != "" {
+		// The callbacks enabled in ansible_env_vars or ansible_env stay
+		// enabled.
+		userEnv := append([]string{}, p.config.AnsibleEnvVars...)
+		for name, value := range p.config.AnsibleEnv {
+			userEnv = append(userEnv, name+"="+value)
+		}
+		for _, env := range ansiblecommon.CallbackEnvVars(p.callbackPluginDir, userEnv) {
+			name, value, _ := strings.Cut(env, "=")
+			staging_vars = append(staging_vars, p.shell.SetEnv(name, value))
+		}
 	}
 
-	command := fmt.Sprintf("cd %s && %s %s %s%s -c local -i %s",
-		p.config.StagingDir, env_vars, p.config.Command, playbookFile, extraArgs, inventory,
-	)
-	ui.Say(fmt.Sprintf("Executing Ansible: %s", command))
+	if p.factsCacheDir != "" {
+		for _, env := range ansiblecommon.FactsCacheEnvVars(p.factsCacheDir) {
+			name, value, _ := strings.Cut(env, "=")
+			staging_vars = append(staging_vars, p.shell.SetEnv(name, value))
+		}
+	}
+
+	args := append(append([]string{playbookFile}, extraArgs...), "-c", "local", "-i", inventory)
+	ansibleCommand := p.config.Command + " " + p.shell.Args(args)
+	command := p.shell.Chain(p.shell.Cd(p.config.StagingDir),
+		p.shell.WithEnv(append(env_vars, staging_vars...), ansibleCommand))
+	displayed := p.shell.Chain(p.shell.Cd(p.config.StagingDir),
+		p.shell.WithEnv(append(displayed_env, staging_vars...), ansibleCommand))
+	ui.Say(fmt.Sprintf("Executing Ansible: %s", displayed))
 	cmd := &packersdk.RemoteCmd{
-		Command: command,
+		Command: p.shell.Command(command),
+	}
+	if report != nil {
+		report.StartPlaybook(playbookFile, p.redactor.Strings(append(strings.Fields(p.config.Command), args...)))
+	}
+	err := p.runAnsiblePlaybook(ctx, output, comm, cmd)
+	if report != nil {
+		report.FinishPlaybook(cmd.ExitStatus(), err)
+	}
+	return cmd.ExitStatus(), err
+}
+
+// ansibleEnv returns the commands setting ansible_env_vars and ansible_env
+// in the shell of the remote machine, with the sensitive values masked if
+// redact is true. They come after the PATH of the commands installed by
+// install, if any, so that they can override it.
+func (p *Provisioner) ansibleEnv(redact bool) []string {
+	var env []string
+	if p.installPathEnv != "" {
+		env = append(env, p.installPathEnv)
+	}
+	set := func(name, value string) {
+		if redact {
+			value = p.redactor.String(value)
+		}
+		env = append(env, p.shell.SetEnv(name, value))
+	}
+	for _, v := range p.config.AnsibleEnvVars {
+		name, value, _ := strings.Cut(v, "=")
+		set(name, value)
+	}
+	names := make([]string, 0, len(p.config.AnsibleEnv))
+	for name := range p.config.AnsibleEnv {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		set(name, p.config.AnsibleEnv[name])
 	}
+	return env
+}
+
+func (p *Provisioner) runAnsiblePlaybook(ctx context.Context, ui *ansiblecommon.EventUi, comm packersdk.Communicator, cmd *packersdk.RemoteCmd) error {
 	if err := cmd.RunWithUi(ctx, comm, ui); err != nil {
 		return err
 	}
@@ -637,7 +1251,7 @@ func (p *Provisioner) executeAnsiblePlaybook(
 				p.config.Command)
 		}
 
-		return fmt.Errorf("Non-zero exit status: %d", cmd.ExitStatus())
+		return ui.ExitError(cmd.ExitStatus())
 	}
 	return nil
 }
@@ -668,6 +1282,9 @@ func validateFileConfig(name string, config string, req bool) error {
 }
 
 func (p *Provisioner) uploadFile(ui packersdk.Ui, comm packersdk.Communicator, dst, src string) error {
+	if rel, ok := p.archiveRel(dst); ok {
+		return p.archive.addFile(rel, src)
+	}
 	f, err := os.Open(src)
 	if err != nil {
 		return fmt.Errorf("Error opening: %s", err)
@@ -682,10 +1299,36 @@ func (p *Provisioner) uploadFile(ui packersdk.Ui, comm packersdk.Communicator, d
 	return nil
 }
 
-func (p *Provisioner) createDir(ui packersdk.Ui, comm packersdk.Communicator, dir string) error {
-	ctx := context.TODO()
+// uploadPrivateFile uploads content to dst with the permission bits of mode,
+// so that it is only readable by the user Packer connects as.
+func (p *Provisioner) uploadPrivateFile(comm packersdk.Communicator, dst string, content []byte, mode os.FileMode) error {
+	src, err := ansiblecommon.WriteTempFile("packer-upload-*", content, mode)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(src)
+	}()
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return comm.Upload(dst, f, &fi)
+}
+
+func (p *Provisioner) createDir(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator, dir string) error {
+	if rel, ok := p.archiveRel(dir); ok {
+		return p.archive.addDir(rel)
+	}
 	cmd := &packersdk.RemoteCmd{
-		Command: fmt.Sprintf("mkdir -p '%s'", dir),
+		Command: p.shell.Command(p.shell.CreateDir(dir)),
 	}
 
 	ui.Say(fmt.Sprintf("Creating directory: %s", dir))
@@ -699,10 +1342,9 @@ func (p *Provisioner) createDir(ui packersdk.Ui, comm packersdk.Communicator, di
 	return nil
 }
 
-func (p *Provisioner) removeDir(ui packersdk.Ui, comm packersdk.Communicator, dir string) error {
-	ctx := context.TODO()
+func (p *Provisioner) removeDir(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator, dir string) error {
 	cmd := &packersdk.RemoteCmd{
-		Command: fmt.Sprintf("rm -rf '%s'", dir),
+		Command: p.shell.Command(p.shell.RemoveDir(dir)),
 	}
 
 	ui.Say(fmt.Sprintf("Removing directory: %s", dir))
@@ -716,8 +1358,27 @@ func (p *Provisioner) removeDir(ui packersdk.Ui, comm packersdk.Communicator, di
 	return nil
 }
 
-func (p *Provisioner) uploadDir(ui packersdk.Ui, comm packersdk.Communicator, dst, src string) error {
-	if err := p.createDir(ui, comm, dst); err != nil {
+func (p *Provisioner) removeFile(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator, file string) error {
+	cmd := &packersdk.RemoteCmd{
+		Command: p.shell.Command(p.shell.RemoveFile(file)),
+	}
+
+	ui.Say(fmt.Sprintf("Removing file: %s", file))
+	if err := cmd.RunWithUi(ctx, comm, ui); err != nil {
+		return err
+	}
+
+	if cmd.ExitStatus() != 0 {
+		return fmt.Errorf("Non-zero exit status. See output above for more information.")
+	}
+	return nil
+}
+
+func (p *Provisioner) uploadDir(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator, dst, src string) error {
+	if rel, ok := p.archiveRel(dst); ok {
+		return p.archive.addTree(rel, src)
+	}
+	if err := p.createDir(ctx, ui, comm, dst); err != nil {
 		return err
 	}
 
@@ -728,3 +1389,188 @@ func (p *Provisioner) uploadDir(ui packersdk.Ui, comm packersdk.Communicator, ds
 	}
 	return comm.UploadDir(dst, src, nil)
 }
+
+// uploadContent uploads content to dst.
+func (p *Provisioner) uploadContent(comm packersdk.Communicator, dst string, content []byte) error {
+	if rel, ok := p.archiveRel(dst); ok {
+		return p.archive.addContent(rel, content, 0644)
+	}
+	return comm.Upload(dst, bytes.NewReader(content), nil)
+}
+
+// archiveRel returns the path of dst in the staging archive, and false if
+// there is no staging archive or dst is outside of the staging directory.
+func (p *Provisioner) archiveRel(dst string) (string, bool) {
+	if p.archive == nil {
+		return "", false
+	}
+	return p.archive.rel(dst)
+}
+
+// guestCheck runs script on the remote machine and reports whether it
+// succeeded.
+func (p *Provisioner) guestCheck(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator, script string) (bool, error) {
+	cmd := &packersdk.RemoteCmd{
+		Command: p.shell.Command(script),
+	}
+	if err := cmd.RunWithUi(ctx, comm, ui); err != nil {
+		return false, err
+	}
+	return cmd.ExitStatus() == 0, nil
+}
+
+// uploadArchive uploads the staging archive and extracts it in the staging
+// directory.
+func (p *Provisioner) uploadArchive(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator) error {
+	archive := p.archive
+	// Upload and run commands directly from now on.
+	p.archive = nil
+
+	src, err := archive.close()
+	if err != nil {
+		return err
+	}
+	if err := p.createDir(ctx, ui, comm, p.config.StagingDir); err != nil {
+		return err
+	}
+	dst := p.stagingPath(stagingArchiveFile)
+	ui.Say("Uploading staging archive...")
+	if err := p.uploadFile(ui, comm, dst, src); err != nil {
+		return err
+	}
+
+	cmd := &packersdk.RemoteCmd{
+		Command: p.shell.Command(p.shell.Chain(p.shell.Cd(p.config.StagingDir),
+			"tar -xzf "+p.shell.Quote(stagingArchiveFile), p.shell.RemoveFile(stagingArchiveFile))),
+	}
+	ui.Say("Extracting staging archive...")
+	if err := cmd.RunWithUi(ctx, comm, ui); err != nil {
+		return err
+	}
+	if cmd.ExitStatus() != 0 {
+		return fmt.Errorf("Non-zero exit status. See output above for more information.")
+	}
+	return nil
+}
+
+// fetchFiles downloads the fetch files from the remote machine, going on
+// after a failed download.
+func (p *Provisioner) fetchFiles(ui packersdk.Ui, comm packersdk.Communicator) error {
+	var errs *packersdk.MultiError
+	for _, f := range p.config.Fetch {
+		src := f.Source
+		if !isAbsGuestPath(src) {
+			src = p.stagingPath(src)
+			if strings.HasSuffix(f.Source, "/") {
+				src += "/"
+			}
+		}
+		if err := p.fetchFile(ui, comm, f, src); err != nil {
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("%s: %s", src, err))
+		}
+	}
+	if errs != nil && len(errs.Errors) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (p *Provisioner) fetchFile(ui packersdk.Ui, comm packersdk.Communicator, f FetchFile, src string) error {
+	if strings.HasSuffix(src, "/") {
+		ui.Message(fmt.Sprintf("Downloading %s => %s", src, f.Destination))
+		if err := os.MkdirAll(f.Destination, 0755); err != nil {
+			return err
+		}
+		return comm.DownloadDir(src, f.Destination, nil)
+	}
+
+	dst := f.destination(src)
+	ui.Message(fmt.Sprintf("Downloading %s => %s", src, dst))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := comm.Download(src, out); err != nil {
+		_ = out.Close()
+		_ = os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// stagingPath returns the path of elem in the staging directory on the
+// remote machine.
+func (p *Provisioner) stagingPath(elem ...string) string {
+	for i := range elem {
+		elem[i] = filepath.ToSlash(elem[i])
+	}
+	return path.Join(append([]string{p.config.StagingDir}, elem...)...)
+}
+
+// findInstalledCommand looks for the command name on the remote machine,
+// first in the PATH and then in the directory in which install links the
+// commands without sudo, which is then added to the PATH of the Ansible
+// commands.
+func (p *Provisioner) findInstalledCommand(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator, name string) (bool, error) {
+	ok, err := p.guestCheck(ctx, ui, comm, p.shell.HasCommand(name))
+	pathEnv := p.config.Install.pathEnv()
+	if err != nil || ok || pathEnv == "" {
+		return ok, err
+	}
+	ok, err = p.guestCheck(ctx, ui, comm, pathEnv+"; "+p.shell.HasCommand(name))
+	if ok {
+		p.installPathEnv = pathEnv
+	}
+	return ok, err
+}
+
+// installAnsible installs Ansible on the remote machine with the install
+// method, unless command is already found there.
+func (p *Provisioner) installAnsible(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator) error {
+	install := p.config.Install
+	name := commandName(p.config.Command)
+	p.installPathEnv = ""
+	ok, err := p.findInstalledCommand(ctx, ui, comm, name)
+	if err != nil || ok {
+		return err
+	}
+	if install.Method == installNone {
+		return fmt.Errorf("%s was not found on the remote machine", name)
+	}
+
+	ui.Say(fmt.Sprintf("%s was not found, installing Ansible with %s...", name, install.Method))
+	wheelhouse := ""
+	if install.Wheelhouse != "" {
+		wheelhouse = p.stagingPath("packer-wheelhouse")
+		ui.Say("Uploading wheelhouse...")
+		if err := p.uploadDir(ctx, ui, comm, wheelhouse, install.Wheelhouse); err != nil {
+			return fmt.Errorf("Error uploading wheelhouse: %s", err)
+		}
+		defer func() {
+			if err := p.removeDir(context.Background(), ui, comm, wheelhouse); err != nil {
+				ui.Error(fmt.Sprintf("Error removing wheelhouse: %s", err))
+			}
+		}()
+	}
+
+	cmd := &packersdk.RemoteCmd{
+		Command: install.Script(wheelhouse),
+	}
+	if err := cmd.RunWithUi(ctx, comm, ui); err != nil {
+		return err
+	}
+	if cmd.ExitStatus() != 0 {
+		return fmt.Errorf("Non-zero exit status. See output above for more information.")
+	}
+
+	if ok, err := p.findInstalledCommand(ctx, ui, comm, name); err != nil || !ok {
+		if err == nil {
+			err = fmt.Errorf("%s was not found after installing Ansible, make sure its directory is in the PATH or set command to its path", name)
+		}
+		return err
+	}
+	return nil
+}
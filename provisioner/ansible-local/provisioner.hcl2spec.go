@@ -4,39 +4,62 @@ package ansiblelocal
 
 import (
 	"github.com/hashicorp/hcl/v2/hcldec"
+	ansiblecommon "github.com/hashicorp/packer-plugin-ansible/provisioner/ansible-common"
 	"github.com/zclconf/go-cty/cty"
 )
 
 // FlatConfig is an auto-generated flat version of Config.
 // Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
 type FlatConfig struct {
-	PackerBuildName       *string           `mapstructure:"packer_build_name" cty:"packer_build_name" hcl:"packer_build_name"`
-	PackerBuilderType     *string           `mapstructure:"packer_builder_type" cty:"packer_builder_type" hcl:"packer_builder_type"`
-	PackerCoreVersion     *string           `mapstructure:"packer_core_version" cty:"packer_core_version" hcl:"packer_core_version"`
-	PackerDebug           *bool             `mapstructure:"packer_debug" cty:"packer_debug" hcl:"packer_debug"`
-	PackerForce           *bool             `mapstructure:"packer_force" cty:"packer_force" hcl:"packer_force"`
-	PackerOnError         *string           `mapstructure:"packer_on_error" cty:"packer_on_error" hcl:"packer_on_error"`
-	PackerUserVars        map[string]string `mapstructure:"packer_user_variables" cty:"packer_user_variables" hcl:"packer_user_variables"`
-	PackerSensitiveVars   []string          `mapstructure:"packer_sensitive_variables" cty:"packer_sensitive_variables" hcl:"packer_sensitive_variables"`
-	Command               *string           `mapstructure:"command" cty:"command" hcl:"command"`
-	ExtraArguments        []string          `mapstructure:"extra_arguments" cty:"extra_arguments" hcl:"extra_arguments"`
-	GroupVars             *string           `mapstructure:"group_vars" cty:"group_vars" hcl:"group_vars"`
-	HostVars              *string           `mapstructure:"host_vars" cty:"host_vars" hcl:"host_vars"`
-	PlaybookDir           *string           `mapstructure:"playbook_dir" cty:"playbook_dir" hcl:"playbook_dir"`
-	PlaybookFile          *string           `mapstructure:"playbook_file" cty:"playbook_file" hcl:"playbook_file"`
-	PlaybookFiles         []string          `mapstructure:"playbook_files" cty:"playbook_files" hcl:"playbook_files"`
-	PlaybookPaths         []string          `mapstructure:"playbook_paths" cty:"playbook_paths" hcl:"playbook_paths"`
-	RolePaths             []string          `mapstructure:"role_paths" cty:"role_paths" hcl:"role_paths"`
-	CollectionPaths       []string          `mapstructure:"collection_paths" cty:"collection_paths" hcl:"collection_paths"`
-	StagingDir            *string           `mapstructure:"staging_directory" cty:"staging_directory" hcl:"staging_directory"`
-	CleanStagingDir       *bool             `mapstructure:"clean_staging_directory" cty:"clean_staging_directory" hcl:"clean_staging_directory"`
-	InventoryFile         *string           `mapstructure:"inventory_file" cty:"inventory_file" hcl:"inventory_file"`
-	InventoryGroups       []string          `mapstructure:"inventory_groups" cty:"inventory_groups" hcl:"inventory_groups"`
-	GalaxyFile            *string           `mapstructure:"galaxy_file" cty:"galaxy_file" hcl:"galaxy_file"`
-	GalaxyCommand         *string           `mapstructure:"galaxy_command" cty:"galaxy_command" hcl:"galaxy_command"`
-	GalaxyForceInstall    *bool             `mapstructure:"galaxy_force_install" cty:"galaxy_force_install" hcl:"galaxy_force_install"`
-	GalaxyRolesPath       *string           `mapstructure:"galaxy_roles_path" cty:"galaxy_roles_path" hcl:"galaxy_roles_path"`
-	GalaxyCollectionsPath *string           `mapstructure:"galaxy_collections_path" cty:"galaxy_collections_path" hcl:"galaxy_collections_path"`
+	PackerBuildName       *string                        `mapstructure:"packer_build_name" cty:"packer_build_name" hcl:"packer_build_name"`
+	PackerBuilderType     *string                        `mapstructure:"packer_builder_type" cty:"packer_builder_type" hcl:"packer_builder_type"`
+	PackerCoreVersion     *string                        `mapstructure:"packer_core_version" cty:"packer_core_version" hcl:"packer_core_version"`
+	PackerDebug           *bool                          `mapstructure:"packer_debug" cty:"packer_debug" hcl:"packer_debug"`
+	PackerForce           *bool                          `mapstructure:"packer_force" cty:"packer_force" hcl:"packer_force"`
+	PackerOnError         *string                        `mapstructure:"packer_on_error" cty:"packer_on_error" hcl:"packer_on_error"`
+	PackerUserVars        map[string]string              `mapstructure:"packer_user_variables" cty:"packer_user_variables" hcl:"packer_user_variables"`
+	PackerSensitiveVars   []string                       `mapstructure:"packer_sensitive_variables" cty:"packer_sensitive_variables" hcl:"packer_sensitive_variables"`
+	Command               *string                        `mapstructure:"command" cty:"command" hcl:"command"`
+	AnsibleEnvVars        []string                       `mapstructure:"ansible_env_vars" cty:"ansible_env_vars" hcl:"ansible_env_vars"`
+	AnsibleEnv            map[string]string              `mapstructure:"ansible_env" cty:"ansible_env" hcl:"ansible_env"`
+	ExtraArguments        []string                       `mapstructure:"extra_arguments" cty:"extra_arguments" hcl:"extra_arguments"`
+	ExtraVars             map[string]interface{}         `mapstructure:"extra_vars" cty:"extra_vars" hcl:"extra_vars"`
+	SensitiveValues       []string                       `mapstructure:"sensitive_values" cty:"sensitive_values" hcl:"sensitive_values"`
+	VaultPasswordFile     *string                        `mapstructure:"vault_password_file" cty:"vault_password_file" hcl:"vault_password_file"`
+	VaultPassword         *string                        `mapstructure:"vault_password" cty:"vault_password" hcl:"vault_password"`
+	VaultPasswordCommand  *string                        `mapstructure:"vault_password_command" cty:"vault_password_command" hcl:"vault_password_command"`
+	VaultIDs              []ansiblecommon.FlatVaultID    `mapstructure:"vault_ids" cty:"vault_ids" hcl:"vault_ids"`
+	GroupVars             *string                        `mapstructure:"group_vars" cty:"group_vars" hcl:"group_vars"`
+	HostVars              *string                        `mapstructure:"host_vars" cty:"host_vars" hcl:"host_vars"`
+	PlaybookDir           *string                        `mapstructure:"playbook_dir" cty:"playbook_dir" hcl:"playbook_dir"`
+	PlaybookFile          *string                        `mapstructure:"playbook_file" cty:"playbook_file" hcl:"playbook_file"`
+	PlaybookFiles         []string                       `mapstructure:"playbook_files" cty:"playbook_files" hcl:"playbook_files"`
+	PlaybookPaths         []string                       `mapstructure:"playbook_paths" cty:"playbook_paths" hcl:"playbook_paths"`
+	RolePaths             []string                       `mapstructure:"role_paths" cty:"role_paths" hcl:"role_paths"`
+	CollectionPaths       []string                       `mapstructure:"collection_paths" cty:"collection_paths" hcl:"collection_paths"`
+	GuestOSType           *string                        `mapstructure:"guest_os_type" cty:"guest_os_type" hcl:"guest_os_type"`
+	StagingDir            *string                        `mapstructure:"staging_directory" cty:"staging_directory" hcl:"staging_directory"`
+	CleanStagingDir       *bool                          `mapstructure:"clean_staging_directory" cty:"clean_staging_directory" hcl:"clean_staging_directory"`
+	StagingArchive        *bool                          `mapstructure:"staging_archive" cty:"staging_archive" hcl:"staging_archive"`
+	InventoryFile         *string                        `mapstructure:"inventory_file" cty:"inventory_file" hcl:"inventory_file"`
+	InventoryGroups       []string                       `mapstructure:"inventory_groups" cty:"inventory_groups" hcl:"inventory_groups"`
+	GroupChildren         map[string][]string            `mapstructure:"group_children" cty:"group_children" hcl:"group_children"`
+	GalaxyFile            *string                        `mapstructure:"galaxy_file" cty:"galaxy_file" hcl:"galaxy_file"`
+	GalaxyCommand         *string                        `mapstructure:"galaxy_command" cty:"galaxy_command" hcl:"galaxy_command"`
+	GalaxyForceInstall    *bool                          `mapstructure:"galaxy_force_install" cty:"galaxy_force_install" hcl:"galaxy_force_install"`
+	GalaxyRolesPath       *string                        `mapstructure:"galaxy_roles_path" cty:"galaxy_roles_path" hcl:"galaxy_roles_path"`
+	GalaxyCollectionsPath *string                        `mapstructure:"galaxy_collections_path" cty:"galaxy_collections_path" hcl:"galaxy_collections_path"`
+	GalaxyInstallLocation *string                        `mapstructure:"galaxy_install_location" cty:"galaxy_install_location" hcl:"galaxy_install_location"`
+	InterruptGracePeriod  *string                        `mapstructure:"interrupt_grace_period" cty:"interrupt_grace_period" hcl:"interrupt_grace_period"`
+	TerminateGracePeriod  *string                        `mapstructure:"terminate_grace_period" cty:"terminate_grace_period" hcl:"terminate_grace_period"`
+	StructuredOutput      *bool                          `mapstructure:"structured_output" cty:"structured_output" hcl:"structured_output"`
+	ShowRawOutput         *bool                          `mapstructure:"show_raw_output" cty:"show_raw_output" hcl:"show_raw_output"`
+	ReportFile            *string                        `mapstructure:"report_file" cty:"report_file" hcl:"report_file"`
+	FactsOutputFile       *string                        `mapstructure:"facts_output_file" cty:"facts_output_file" hcl:"facts_output_file"`
+	OutputsFile           *string                        `mapstructure:"outputs_file" cty:"outputs_file" hcl:"outputs_file"`
+	Retry                 *ansiblecommon.FlatRetryConfig `mapstructure:"retry" cty:"retry" hcl:"retry"`
+	Install               *FlatInstallConfig             `mapstructure:"install" cty:"install" hcl:"install"`
+	Fetch                 []FlatFetchFile                `mapstructure:"fetch" cty:"fetch" hcl:"fetch"`
 }
 
 // FlatMapstructure returns a new FlatConfig.
@@ -60,7 +83,15 @@ func (*FlatConfig) HCL2Spec() map[string]hcldec.Spec {
 		"packer_user_variables":      &hcldec.AttrSpec{Name: "packer_user_variables", Type: cty.Map(cty.String), Required: false},
 		"packer_sensitive_variables": &hcldec.AttrSpec{Name: "packer_sensitive_variables", Type: cty.List(cty.String), Required: false},
 		"command":                    &hcldec.AttrSpec{Name: "command", Type: cty.String, Required: false},
+		"ansible_env_vars":           &hcldec.AttrSpec{Name: "ansible_env_vars", Type: cty.List(cty.String), Required: false},
+		"ansible_env":                &hcldec.AttrSpec{Name: "ansible_env", Type: cty.Map(cty.String), Required: false},
 		"extra_arguments":            &hcldec.AttrSpec{Name: "extra_arguments", Type: cty.List(cty.String), Required: false},
+		"extra_vars":                 &hcldec.AttrSpec{Name: "extra_vars", Type: cty.Map(cty.String), Required: false},
+		"sensitive_values":           &hcldec.AttrSpec{Name: "sensitive_values", Type: cty.List(cty.String), Required: false},
+		"vault_password_file":        &hcldec.AttrSpec{Name: "vault_password_file", Type: cty.String, Required: false},
+		"vault_password":             &hcldec.AttrSpec{Name: "vault_password", Type: cty.String, Required: false},
+		"vault_password_command":     &hcldec.AttrSpec{Name: "vault_password_command", Type: cty.String, Required: false},
+		"vault_ids":                  &hcldec.BlockListSpec{TypeName: "vault_ids", Nested: hcldec.ObjectSpec((*ansiblecommon.FlatVaultID)(nil).HCL2Spec())},
 		"group_vars":                 &hcldec.AttrSpec{Name: "group_vars", Type: cty.String, Required: false},
 		"host_vars":                  &hcldec.AttrSpec{Name: "host_vars", Type: cty.String, Required: false},
 		"playbook_dir":               &hcldec.AttrSpec{Name: "playbook_dir", Type: cty.String, Required: false},
@@ -69,15 +100,29 @@ func (*FlatConfig) HCL2Spec() map[string]hcldec.Spec {
 		"playbook_paths":             &hcldec.AttrSpec{Name: "playbook_paths", Type: cty.List(cty.String), Required: false},
 		"role_paths":                 &hcldec.AttrSpec{Name: "role_paths", Type: cty.List(cty.String), Required: false},
 		"collection_paths":           &hcldec.AttrSpec{Name: "collection_paths", Type: cty.List(cty.String), Required: false},
+		"guest_os_type":              &hcldec.AttrSpec{Name: "guest_os_type", Type: cty.String, Required: false},
 		"staging_directory":          &hcldec.AttrSpec{Name: "staging_directory", Type: cty.String, Required: false},
 		"clean_staging_directory":    &hcldec.AttrSpec{Name: "clean_staging_directory", Type: cty.Bool, Required: false},
+		"staging_archive":            &hcldec.AttrSpec{Name: "staging_archive", Type: cty.Bool, Required: false},
 		"inventory_file":             &hcldec.AttrSpec{Name: "inventory_file", Type: cty.String, Required: false},
 		"inventory_groups":           &hcldec.AttrSpec{Name: "inventory_groups", Type: cty.List(cty.String), Required: false},
+		"group_children":             &hcldec.AttrSpec{Name: "group_children", Type: cty.Map(cty.String), Required: false},
 		"galaxy_file":                &hcldec.AttrSpec{Name: "galaxy_file", Type: cty.String, Required: false},
 		"galaxy_command":             &hcldec.AttrSpec{Name: "galaxy_command", Type: cty.String, Required: false},
 		"galaxy_force_install":       &hcldec.AttrSpec{Name: "galaxy_force_install", Type: cty.Bool, Required: false},
 		"galaxy_roles_path":          &hcldec.AttrSpec{Name: "galaxy_roles_path", Type: cty.String, Required: false},
 		"galaxy_collections_path":    &hcldec.AttrSpec{Name: "galaxy_collections_path", Type: cty.String, Required: false},
+		"galaxy_install_location":    &hcldec.AttrSpec{Name: "galaxy_install_location", Type: cty.String, Required: false},
+		"interrupt_grace_period":     &hcldec.AttrSpec{Name: "interrupt_grace_period", Type: cty.String, Required: false},
+		"terminate_grace_period":     &hcldec.AttrSpec{Name: "terminate_grace_period", Type: cty.String, Required: false},
+		"structured_output":          &hcldec.AttrSpec{Name: "structured_output", Type: cty.Bool, Required: false},
+		"show_raw_output":            &hcldec.AttrSpec{Name: "show_raw_output", Type: cty.Bool, Required: false},
+		"report_file":                &hcldec.AttrSpec{Name: "report_file", Type: cty.String, Required: false},
+		"facts_output_file":          &hcldec.AttrSpec{Name: "facts_output_file", Type: cty.String, Required: false},
+		"outputs_file":               &hcldec.AttrSpec{Name: "outputs_file", Type: cty.String, Required: false},
+		"retry":                      &hcldec.BlockSpec{TypeName: "retry", Nested: hcldec.ObjectSpec((*ansiblecommon.FlatRetryConfig)(nil).HCL2Spec())},
+		"install":                    &hcldec.BlockSpec{TypeName: "install", Nested: hcldec.ObjectSpec((*FlatInstallConfig)(nil).HCL2Spec())},
+		"fetch":                      &hcldec.BlockListSpec{TypeName: "fetch", Nested: hcldec.ObjectSpec((*FlatFetchFile)(nil).HCL2Spec())},
 	}
 	return s
 }
@@ -4,15 +4,27 @@
 package ansiblelocal
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
+	"errors"
+	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 
 	"fmt"
 
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/hashicorp/hcl/v2/hclparse"
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+
+	ansiblecommon "github.com/hashicorp/packer-plugin-ansible/provisioner/ansible-common"
 )
 
 func TestProvisioner_Impl(t *testing.T) {
@@ -47,6 +59,10 @@ func TestProvisionerPrepare_Defaults(t *testing.T) {
 		t.Fatalf("unexpected staging dir %s, expected %s",
 			p.config.StagingDir, DefaultStagingDir)
 	}
+	if p.config.InterruptGracePeriod != ansiblecommon.DefaultInterruptGracePeriod ||
+		p.config.TerminateGracePeriod != ansiblecommon.DefaultTerminateGracePeriod {
+		t.Fatalf("unexpected grace periods %s and %s", p.config.InterruptGracePeriod, p.config.TerminateGracePeriod)
+	}
 }
 
 func TestProvisionerPrepare_PlaybookFile(t *testing.T) {
@@ -416,3 +432,1351 @@ func removeFiles(files ...string) {
 		_ = os.Remove(file)
 	}
 }
+
+func TestProvisionerProvision_StructuredOutput(t *testing.T) {
+	var p Provisioner
+	config := testConfig()
+
+	playbook_file := createTempFile("")
+	defer removeFiles(playbook_file)
+
+	config["playbook_file"] = playbook_file
+	config["structured_output"] = true
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := &communicatorMock{}
+	if err := p.Provision(context.Background(), packersdk.TestUi(t), comm, make(map[string]interface{})); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	pluginDir := filepath.ToSlash(filepath.Join(p.config.StagingDir, "packer_callback_plugins"))
+	found := false
+	for _, dst := range comm.uploadDestination {
+		if dst == pluginDir+"/packer.py" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("callback plugin was not uploaded: %v", comm.uploadDestination)
+	}
+
+	lastCmd := comm.startCommand[len(comm.startCommand)-1]
+	if !strings.Contains(lastCmd, "ANSIBLE_CALLBACK_PLUGINS='"+pluginDir+"'") ||
+		!strings.Contains(lastCmd, "ANSIBLE_CALLBACKS_ENABLED='packer'") {
+		t.Fatalf("callback plugin was not enabled: %s", lastCmd)
+	}
+
+	config["ansible_env_vars"] = []string{"ANSIBLE_CALLBACKS_ENABLED=profile_tasks"}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	comm = &communicatorMock{}
+	if err := p.Provision(context.Background(), packersdk.TestUi(t), comm, make(map[string]interface{})); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	lastCmd = comm.startCommand[len(comm.startCommand)-1]
+	if !strings.Contains(lastCmd, "ANSIBLE_CALLBACKS_ENABLED='profile_tasks,packer'") {
+		t.Fatalf("the callbacks of ansible_env_vars should stay enabled: %s", lastCmd)
+	}
+}
+
+func TestProvisionerProvision_Retry(t *testing.T) {
+	testcases := []struct {
+		name          string
+		exitCodes     []int
+		expectedRuns  int
+		expectedError bool
+	}{
+		{
+			name:         "retries unreachable hosts",
+			exitCodes:    []int{3, 0},
+			expectedRuns: 2,
+		},
+		{
+			name:          "does not retry failed hosts",
+			exitCodes:     []int{2, 0},
+			expectedRuns:  1,
+			expectedError: true,
+		},
+		{
+			name:          "stops after max_attempts",
+			exitCodes:     []int{3, 3, 3},
+			expectedRuns:  2,
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var p Provisioner
+			config := testConfig()
+
+			playbook_file := createTempFile("")
+			defer removeFiles(playbook_file)
+
+			config["playbook_file"] = playbook_file
+			config["retry"] = map[string]interface{}{
+				"max_attempts": 2,
+				"backoff":      "1ms",
+			}
+			if err := p.Prepare(config); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+
+			runs := 0
+			comm := &communicatorMock{
+				exitStatus: func(command string) int {
+					if !strings.Contains(command, "ansible-playbook") {
+						return 0
+					}
+					runs++
+					return tc.exitCodes[runs-1]
+				},
+			}
+			err := p.Provision(context.Background(), packersdk.TestUi(t), comm, make(map[string]interface{}))
+			if tc.expectedError && err == nil {
+				t.Fatal("should have error")
+			}
+			if !tc.expectedError && err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if runs != tc.expectedRuns {
+				t.Fatalf("expected %d runs of ansible-playbook, got %d", tc.expectedRuns, runs)
+			}
+		})
+	}
+}
+
+func TestProvisionerProvision_ParserError(t *testing.T) {
+	var p Provisioner
+	config := testConfig()
+
+	playbook_file := createTempFile("")
+	defer removeFiles(playbook_file)
+
+	config["playbook_file"] = playbook_file
+	config["structured_output"] = true
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := &communicatorMock{
+		stderr: func(command string) string {
+			if strings.Contains(command, "ansible-playbook") {
+				return "ERROR! 'hosts' is required but was not set\n\nThe error appears to be in 'site.yml'\n"
+			}
+			return ""
+		},
+		exitStatus: func(command string) int {
+			if strings.Contains(command, "ansible-playbook") {
+				return ansiblecommon.ExitCodeParserError
+			}
+			return 0
+		},
+	}
+	err := p.Provision(context.Background(), packersdk.TestUi(t), comm, make(map[string]interface{}))
+	var parserErr *ansiblecommon.ParserError
+	if !errors.As(err, &parserErr) {
+		t.Fatalf("expected a parser error, got %v", err)
+	}
+	if parserErr.Message != "'hosts' is required but was not set" {
+		t.Fatalf("unexpected message %q", parserErr.Message)
+	}
+	if !strings.Contains(err.Error(), "(parser error): 'hosts' is required but was not set. Check the syntax") {
+		t.Fatalf("unexpected error %q", err)
+	}
+}
+
+func TestProvisionerProvision_ColoredOutput(t *testing.T) {
+	var p Provisioner
+	config := testConfig()
+
+	playbook_file := createTempFile("")
+	defer removeFiles(playbook_file)
+
+	config["playbook_file"] = playbook_file
+	config["retry"] = map[string]interface{}{
+		"max_attempts": 2,
+		"backoff":      "1ms",
+	}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The default command runs with ANSIBLE_FORCE_COLOR=1.
+	runs := 0
+	comm := &communicatorMock{
+		stdout: func(command string) string {
+			if !strings.Contains(command, "ansible-playbook") {
+				return ""
+			}
+			return "\x1b[0;33mTASK [Gathering Facts] *****\x1b[0m\n" +
+				"\x1b[1;31mfatal: [127.0.0.1]: UNREACHABLE! => {\"changed\": false, \"msg\": \"timed out\", \"unreachable\": true}\x1b[0m\n"
+		},
+		exitStatus: func(command string) int {
+			if !strings.Contains(command, "ansible-playbook") {
+				return 0
+			}
+			runs++
+			return ansiblecommon.ExitCodeParserError
+		},
+	}
+	err := p.Provision(context.Background(), packersdk.TestUi(t), comm, make(map[string]interface{}))
+	var unreachableErr *ansiblecommon.HostUnreachableError
+	if !errors.As(err, &unreachableErr) {
+		t.Fatalf("expected an unreachable error, got %v", err)
+	}
+	if unreachableErr.FailedTask == nil || unreachableErr.FailedTask.Host != "127.0.0.1" ||
+		unreachableErr.FailedTask.Task != "Gathering Facts" || unreachableErr.FailedTask.Msg != "timed out" {
+		t.Fatalf("unexpected failed task %#v", unreachableErr.FailedTask)
+	}
+	if runs != 2 {
+		t.Fatalf("expected the unreachable host to be retried, got %d runs", runs)
+	}
+
+	runs = 0
+	comm = &communicatorMock{
+		stderr: func(command string) string {
+			if strings.Contains(command, "ansible-playbook") {
+				return "\x1b[0;31mERROR! 'hosts' is required but was not set\x1b[0m\n"
+			}
+			return ""
+		},
+		exitStatus: func(command string) int {
+			if !strings.Contains(command, "ansible-playbook") {
+				return 0
+			}
+			runs++
+			return ansiblecommon.ExitCodeParserError
+		},
+	}
+	err = p.Provision(context.Background(), packersdk.TestUi(t), comm, make(map[string]interface{}))
+	var parserErr *ansiblecommon.ParserError
+	if !errors.As(err, &parserErr) {
+		t.Fatalf("expected a parser error, got %v", err)
+	}
+	if parserErr.Message != "'hosts' is required but was not set" {
+		t.Fatalf("unexpected message %q", parserErr.Message)
+	}
+	if runs != 1 {
+		t.Fatalf("parser errors should not be retried, got %d runs", runs)
+	}
+}
+
+func TestProvisionerPrepare_GroupChildren(t *testing.T) {
+	var p Provisioner
+
+	file, diags := hclparse.NewParser().ParseHCL([]byte(`
+inventory_groups = ["linux"]
+group_children = {
+  linux = ["web", "db"]
+}
+`), "ansible-local.pkr.hcl")
+	if diags.HasErrors() {
+		t.Fatalf("err: %s", diags)
+	}
+	val, diags := hcldec.Decode(file.Body, p.ConfigSpec(), nil)
+	if diags.HasErrors() {
+		t.Fatalf("err: %s", diags)
+	}
+
+	playbook_file := createTempFile("")
+	defer removeFiles(playbook_file)
+	config := testConfig()
+	config["playbook_file"] = playbook_file
+
+	if err := p.Prepare(val, config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := "[web]\n127.0.0.1\n[db]\n127.0.0.1\n[linux:children]\nweb\ndb\n"
+	if got := p.inventory().INIGroups("127.0.0.1\n"); got != expected {
+		t.Fatalf("expected inventory:\n%s\ngot:\n%s", expected, got)
+	}
+
+	config["group_children"] = map[string][]string{"linux": {"linux"}}
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error on a cycle in group_children")
+	}
+}
+
+func TestProvisionerProvision_ExtraVars(t *testing.T) {
+	var p Provisioner
+
+	file, diags := hclparse.NewParser().ParseHCL([]byte(`
+extra_vars = {
+  app_version = "1.2.3"
+  replicas    = 3
+  users = [
+    { name = "alice", admin = true },
+  ]
+}
+`), "ansible-local.pkr.hcl")
+	if diags.HasErrors() {
+		t.Fatalf("err: %s", diags)
+	}
+	val, diags := hcldec.Decode(file.Body, p.ConfigSpec(), nil)
+	if diags.HasErrors() {
+		t.Fatalf("err: %s", diags)
+	}
+
+	playbook_file := createTempFile("")
+	defer removeFiles(playbook_file)
+	config := testConfig()
+	config["playbook_file"] = playbook_file
+
+	if err := p.Prepare(val, config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := &communicatorMock{
+		exitStatus: func(command string) int {
+			if strings.Contains(command, "ansible-playbook") {
+				return 2
+			}
+			return 0
+		},
+	}
+	if err := p.Provision(context.Background(), packersdk.TestUi(t), comm, make(map[string]interface{})); err == nil {
+		t.Fatal("should have error")
+	}
+
+	dst := filepath.ToSlash(filepath.Join(p.config.StagingDir, "packer-extra-vars.json"))
+	upload, ok := comm.uploads[dst]
+	if !ok {
+		t.Fatalf("extra_vars file was not uploaded: %v", comm.uploadDestination)
+	}
+	if upload.mode.Perm() != 0600 {
+		t.Fatalf("extra_vars file should be uploaded with mode 0600, got %o", upload.mode.Perm())
+	}
+	var vars map[string]interface{}
+	if err := json.Unmarshal(upload.content, &vars); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := map[string]interface{}{
+		"app_version": "1.2.3",
+		"replicas":    float64(3),
+		"users": []interface{}{
+			map[string]interface{}{"name": "alice", "admin": true},
+		},
+	}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Fatalf("expected extra_vars %v, got %v", expected, vars)
+	}
+
+	playbookRun, removed := -1, -1
+	for i, cmd := range comm.startCommand {
+		if strings.Contains(cmd, "ansible-playbook") {
+			playbookRun = i
+			if !strings.Contains(cmd, "--extra-vars @"+dst) {
+				t.Fatalf("extra_vars file was not passed: %s", cmd)
+			}
+		}
+		if cmd == fmt.Sprintf("rm -f '%s'", dst) {
+			removed = i
+		}
+	}
+	if playbookRun == -1 || removed < playbookRun {
+		t.Fatalf("extra_vars file should be removed after the failed run: %v", comm.startCommand)
+	}
+}
+
+func TestProvisionerProvision_ExtraArguments(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh is not available")
+	}
+
+	var p Provisioner
+	config := testConfig()
+
+	playbook_file := createTempFile("")
+	defer removeFiles(playbook_file)
+
+	// The command prints the arguments it receives.
+	config["command"] = `printf '%s\0'`
+	config["playbook_file"] = playbook_file
+	config["staging_directory"] = t.TempDir()
+	config["packer_build_name"] = "my build"
+	config["packer_builder_type"] = "docker"
+	config["extra_arguments"] = []string{"--extra-vars", "motd='hi' from $HOME; `id`", "--tags=a b", ""}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := &communicatorMock{}
+	generatedData := map[string]interface{}{"PackerHTTPAddr": "10.0.2.2:8080"}
+	if err := p.Provision(context.Background(), packersdk.TestUi(t), comm, generatedData); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	command := comm.startCommand[len(comm.startCommand)-1]
+	out, err := exec.Command(sh, "-c", command).Output()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	args := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+	expected := []string{
+		p.config.StagingDir + "/" + filepath.Base(playbook_file),
+		"--extra-vars", `packer_build_name="my build"`,
+		"--extra-vars", "packer_builder_type=docker",
+		"--extra-vars", "packer_http_addr=10.0.2.2:8080",
+		"--extra-vars", "motd='hi' from $HOME; `id`", "--tags=a b", "",
+		"-c", "local", "-i",
+	}
+	if len(args) != len(expected)+1 || !reflect.DeepEqual(args[:len(expected)], expected) ||
+		!strings.HasPrefix(args[len(expected)], p.config.StagingDir+"/") {
+		t.Fatalf("expected the arguments %q, got %q", expected, args)
+	}
+}
+
+func TestProvisionerPrepare_Fetch(t *testing.T) {
+	playbook_file := createTempFile("")
+	defer removeFiles(playbook_file)
+
+	var p Provisioner
+	config := testConfig()
+	config["playbook_file"] = playbook_file
+	config["fetch"] = []map[string]interface{}{
+		{"source": "ansible.log"},
+		{"destination": "out/"},
+	}
+	err := p.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+	for _, msg := range []string{"fetch[0]: destination must be set", "fetch[1]: source must be set"} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Fatalf("expected %q in %s", msg, err)
+		}
+	}
+}
+
+func TestProvisionerProvision_Fetch(t *testing.T) {
+	playbook_file := createTempFile("")
+	defer removeFiles(playbook_file)
+
+	t.Run("after a failed playbook", func(t *testing.T) {
+		dir := t.TempDir()
+		var p Provisioner
+		config := testConfig()
+		config["playbook_file"] = playbook_file
+		config["fetch"] = []map[string]interface{}{
+			{"source": "ansible.log", "destination": filepath.Join(dir, "logs") + "/"},
+			{"source": "/var/lib/sbom/image.spdx.json", "destination": filepath.Join(dir, "sbom.json")},
+			{"source": "reports/", "destination": filepath.Join(dir, "reports")},
+		}
+		if err := p.Prepare(config); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		comm := &communicatorMock{
+			downloads: map[string]string{
+				p.config.StagingDir + "/ansible.log": "TASK [fail]",
+				"/var/lib/sbom/image.spdx.json":      "{}",
+			},
+			exitStatus: func(command string) int {
+				if strings.Contains(command, "ansible-playbook") {
+					return 2
+				}
+				return 0
+			},
+		}
+		err := p.Provision(context.Background(), packersdk.TestUi(t), comm, make(map[string]interface{}))
+		if err == nil || !strings.Contains(err.Error(), "Error executing Ansible") {
+			t.Fatalf("the playbook error should be returned, got: %v", err)
+		}
+
+		for file, content := range map[string]string{"logs/ansible.log": "TASK [fail]", "sbom.json": "{}"} {
+			b, err := os.ReadFile(filepath.Join(dir, file))
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if string(b) != content {
+				t.Fatalf("expected %s to contain %q, got %q", file, content, b)
+			}
+		}
+		if dst := comm.downloadDirs[p.config.StagingDir+"/reports/"]; dst != filepath.Join(dir, "reports") {
+			t.Fatalf("the reports directory should be downloaded, got %v", comm.downloadDirs)
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "ansible.log")
+		var p Provisioner
+		config := testConfig()
+		config["playbook_file"] = playbook_file
+		config["fetch"] = []map[string]interface{}{
+			{"source": "ansible.log", "destination": dst},
+		}
+		if err := p.Prepare(config); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		err := p.Provision(context.Background(), packersdk.TestUi(t), &communicatorMock{}, make(map[string]interface{}))
+		if err == nil || !strings.Contains(err.Error(), "Error fetching files") {
+			t.Fatalf("a missing file should fail the build, got: %v", err)
+		}
+		if _, err := os.Stat(dst); !os.IsNotExist(err) {
+			t.Fatalf("the file failing to download should be removed")
+		}
+	})
+}
+
+func TestProvisionerProvision_FactsOutputFile(t *testing.T) {
+	var p Provisioner
+	config := testConfig()
+
+	playbook_file := createTempFile("")
+	defer removeFiles(playbook_file)
+	factsFile := filepath.Join(t.TempDir(), "facts.json")
+	reportFile := filepath.Join(t.TempDir(), "report.json")
+
+	config["playbook_file"] = playbook_file
+	config["facts_output_file"] = factsFile
+	config["report_file"] = reportFile
+	config["extra_arguments"] = []string{"--tags", "web", "-e", "ansible_python_interpreter=/usr/bin/python3"}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	cacheDir := p.config.StagingDir + "/packer-facts"
+	comm := &communicatorMock{
+		stdout: func(command string) string {
+			if !strings.Contains(command, "ansible-playbook") {
+				return ""
+			}
+			if strings.Contains(command, "packer-facts.yml") {
+				return "facts output\n"
+			}
+			return "playbook output\n"
+		},
+		downloads: map[string]string{
+			cacheDir + "/packer-facts-127.0.0.1": `{"ansible_distribution": "Ubuntu"}`,
+		},
+	}
+	var out bytes.Buffer
+	ui := &packersdk.BasicUi{Reader: new(bytes.Buffer), Writer: &out, ErrorWriter: &out}
+	if err := p.Provision(context.Background(), ui, comm, make(map[string]interface{})); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	factsPlaybook := p.config.StagingDir + "/packer-facts.yml"
+	if upload, ok := comm.uploads[factsPlaybook]; !ok || !strings.Contains(string(upload.content), `hosts: "127.0.0.1"`) {
+		t.Fatalf("the facts playbook should be uploaded: %v", comm.uploadDestination)
+	}
+	var runs []string
+	for _, cmd := range comm.startCommand {
+		if strings.Contains(cmd, "ansible-playbook") {
+			runs = append(runs, cmd)
+		}
+	}
+	if len(runs) != 2 || strings.Contains(runs[0], "ANSIBLE_CACHE_PLUGIN") ||
+		!strings.Contains(runs[1], "ANSIBLE_CACHE_PLUGIN='jsonfile' ANSIBLE_CACHE_PLUGIN_CONNECTION='"+cacheDir+"'") ||
+		!strings.Contains(runs[1], "ansible-playbook "+factsPlaybook) {
+		t.Fatalf("the facts should be gathered by a closing playbook: %v", runs)
+	}
+	if !strings.Contains(runs[0], " --tags web ") || strings.Contains(runs[1], "--tags") {
+		t.Fatalf("only the extra_arguments needed to reach the host should be passed to the closing playbook: %v", runs)
+	}
+	if !strings.Contains(runs[1], " -e ansible_python_interpreter=/usr/bin/python3 ") {
+		t.Fatalf("the extra variables should be passed to the closing playbook: %v", runs)
+	}
+	last := comm.startCommand[len(comm.startCommand)-2:]
+	if last[0] != fmt.Sprintf("rm -f '%s'", factsPlaybook) || last[1] != fmt.Sprintf("rm -rf '%s'", cacheDir) {
+		t.Fatalf("the facts playbook and cache should be removed: %v", last)
+	}
+	if !strings.Contains(out.String(), "playbook output") || strings.Contains(out.String(), "facts output") {
+		t.Fatalf("only the output of the playbooks should be shown:\n%s", out.String())
+	}
+
+	b, err := os.ReadFile(reportFile)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if strings.Contains(string(b), "packer-facts.yml") {
+		t.Fatalf("the facts playbook should not be reported:\n%s", b)
+	}
+
+	b, err = os.ReadFile(factsFile)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(b) != "{\n  \"ansible_distribution\": \"Ubuntu\"\n}\n" {
+		t.Fatalf("unexpected facts file:\n%s", b)
+	}
+}
+
+func TestProvisionerProvision_FactsOutputFileInventory(t *testing.T) {
+	var p Provisioner
+	config := testConfig()
+
+	playbook_file := createTempFile("")
+	defer removeFiles(playbook_file)
+	inventory_file := createTempFile("")
+	defer removeFiles(inventory_file)
+	factsFile := filepath.Join(t.TempDir(), "facts.json")
+
+	config["playbook_file"] = playbook_file
+	config["inventory_file"] = inventory_file
+	config["facts_output_file"] = factsFile
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	cacheDir := p.config.StagingDir + "/packer-facts"
+	comm := &communicatorMock{
+		stdout: func(command string) string {
+			return `PACKER_ANSIBLE_EVENT {"event":"stats","stats":{"web-1":{"ok":1}}}` + "\n"
+		},
+		downloads: map[string]string{
+			cacheDir + "/packer-facts-web-1": `{"ansible_hostname": "web-1"}`,
+		},
+	}
+	if err := p.Provision(context.Background(), packersdk.TestUi(t), comm, make(map[string]interface{})); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	factsPlaybook := p.config.StagingDir + "/packer-facts.yml"
+	if upload, ok := comm.uploads[factsPlaybook]; !ok || !strings.Contains(string(upload.content), `hosts: "web-1"`) {
+		t.Fatalf("the facts of the provisioned host should be gathered: %v", comm.uploads[factsPlaybook])
+	}
+	b, err := os.ReadFile(factsFile)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(b) != "{\n  \"ansible_hostname\": \"web-1\"\n}\n" {
+		t.Fatalf("unexpected facts file:\n%s", b)
+	}
+}
+
+func TestProvisionerProvision_ReportFile(t *testing.T) {
+	var p Provisioner
+	config := testConfig()
+
+	playbook_file := createTempFile("")
+	defer removeFiles(playbook_file)
+	reportFile := filepath.Join(t.TempDir(), "report.json")
+
+	config["playbook_file"] = playbook_file
+	config["report_file"] = reportFile
+	config["extra_arguments"] = []string{"--extra-vars", "token=s3cr3t-token"}
+	config["sensitive_values"] = []string{"s3cr3t-token"}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := p.Provision(context.Background(), packersdk.TestUi(t), &communicatorMock{}, make(map[string]interface{})); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	b, err := os.ReadFile(reportFile)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var report ansiblecommon.Report
+	if err := json.Unmarshal(b, &report); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(report.Playbooks) != 1 {
+		t.Fatalf("expected 1 playbook, got:\n%s", b)
+	}
+	playbook := p.stagingPath(filepath.Base(playbook_file))
+	// The generated inventory file has a random name.
+	expected := []string{"ansible-playbook", playbook, "--extra-vars", "packer_builder_type=",
+		"--extra-vars", "token=" + ansiblecommon.Redacted, "-c", "local", "-i"}
+	command := report.Playbooks[0].Command
+	if report.Playbooks[0].Playbook != playbook || len(command) != len(expected)+1 ||
+		!reflect.DeepEqual(command[:len(expected)], expected) ||
+		!strings.HasPrefix(command[len(expected)], p.stagingPath("packer-provisioner-ansible-local")) {
+		t.Fatalf("the report should hold the arguments of ansible-playbook %v, got %s %v",
+			expected, report.Playbooks[0].Playbook, report.Playbooks[0].Command)
+	}
+}
+
+func TestProvisionerProvision_ReportFileStagingFailure(t *testing.T) {
+	var p Provisioner
+	config := testConfig()
+
+	playbook_file := createTempFile("")
+	defer removeFiles(playbook_file)
+	reportFile := filepath.Join(t.TempDir(), "report.json")
+
+	config["playbook_file"] = playbook_file
+	config["report_file"] = reportFile
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := &communicatorMock{
+		exitStatus: func(command string) int {
+			if strings.HasPrefix(command, "mkdir -p") {
+				return 1
+			}
+			return 0
+		},
+	}
+	err := p.Provision(context.Background(), packersdk.TestUi(t), comm, make(map[string]interface{}))
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	b, readErr := os.ReadFile(reportFile)
+	if readErr != nil {
+		t.Fatalf("the report should be written when the staging fails: %s", readErr)
+	}
+	var report ansiblecommon.Report
+	if err := json.Unmarshal(b, &report); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if report.Success || report.Error != err.Error() || len(report.Playbooks) != 0 {
+		t.Fatalf("the report should hold the staging error %q:\n%s", err, b)
+	}
+}
+
+func TestProvisionerProvision_OutputsFile(t *testing.T) {
+	var p Provisioner
+	config := testConfig()
+
+	playbook_file := createTempFile("")
+	defer removeFiles(playbook_file)
+	outputsFile := filepath.Join(t.TempDir(), "outputs.json")
+
+	config["playbook_file"] = playbook_file
+	config["outputs_file"] = outputsFile
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := &communicatorMock{
+		stdout: func(command string) string {
+			if !strings.Contains(command, "ANSIBLE_CALLBACKS_ENABLED='packer'") {
+				return ""
+			}
+			return `PACKER_ANSIBLE_EVENT {"event":"stats","custom_stats":{"_run":{"agent_version":"7.53.0","ports":[80,443]}}}` + "\n"
+		},
+	}
+	if err := p.Provision(context.Background(), packersdk.TestUi(t), comm, make(map[string]interface{})); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	b, err := os.ReadFile(outputsFile)
+	if err != nil {
+		t.Fatalf("outputs file was not written: %s", err)
+	}
+	var outputs map[string]interface{}
+	if err := json.Unmarshal(b, &outputs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := map[string]interface{}{"agent_version": "7.53.0", "ports": []interface{}{float64(80), float64(443)}}
+	if !reflect.DeepEqual(outputs, expected) {
+		t.Fatalf("expected outputs %v, got %v", expected, outputs)
+	}
+}
+
+func TestProvisionerProvision_SensitiveValues(t *testing.T) {
+	var p Provisioner
+	config := testConfig()
+
+	playbook_file := createTempFile("")
+	defer removeFiles(playbook_file)
+
+	config["playbook_file"] = playbook_file
+	config["extra_arguments"] = []string{"--extra-vars", "token=s3cr3t-token", "-e", "pass=vault-pass"}
+	config["packer_sensitive_variables"] = []string{"vault-pass"}
+	config["sensitive_values"] = []string{"s3cr3t-token"}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	out := new(bytes.Buffer)
+	ui := &packersdk.BasicUi{Reader: new(bytes.Buffer), Writer: out, ErrorWriter: out}
+	comm := &communicatorMock{
+		exitStatus: func(command string) int {
+			if strings.Contains(command, "ansible-playbook") {
+				return 2
+			}
+			return 0
+		},
+	}
+	err := p.Provision(context.Background(), ui, comm, make(map[string]interface{}))
+	if err == nil {
+		t.Fatal("should have error")
+	}
+	if !strings.Contains(out.String(), "token=<sensitive>") {
+		t.Fatalf("the command should be shown with sensitive values masked:\n%s", out.String())
+	}
+	for _, s := range []string{out.String(), err.Error()} {
+		if strings.Contains(s, "s3cr3t-token") || strings.Contains(s, "vault-pass") {
+			t.Fatalf("sensitive values should be masked:\n%s", s)
+		}
+	}
+}
+
+func TestProvisionerPrepare_AnsibleEnv(t *testing.T) {
+	playbook_file := createTempFile("")
+	defer removeFiles(playbook_file)
+
+	var p Provisioner
+	config := testConfig()
+	config["playbook_file"] = playbook_file
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if p.config.Command != "ansible-playbook" {
+		t.Fatalf("the default command should not set the environment, got %s", p.config.Command)
+	}
+
+	for _, tc := range []struct {
+		key   string
+		value interface{}
+	}{
+		{"ansible_env_vars", []string{"NO_VALUE"}},
+		{"ansible_env_vars", []string{"1ANSIBLE=1"}},
+		{"ansible_env_vars", []string{"HTTPS PROXY=x"}},
+		{"ansible_env", map[string]string{"A-B": "x"}},
+		{"ansible_env", map[string]string{"$(id)": "x"}},
+	} {
+		config := testConfig()
+		config["playbook_file"] = playbook_file
+		config[tc.key] = tc.value
+		if err := p.Prepare(config); err == nil {
+			t.Fatalf("%s = %v should be an error", tc.key, tc.value)
+		}
+	}
+}
+
+func TestProvisionerProvision_AnsibleEnv(t *testing.T) {
+	var p Provisioner
+	config := testConfig()
+
+	playbook_file := createTempFile("")
+	defer removeFiles(playbook_file)
+	galaxy_file := createTempFile("")
+	defer removeFiles(galaxy_file)
+	if err := os.WriteFile(galaxy_file, []byte("roles:\n  - geerlingguy.docker\n"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	config["playbook_file"] = playbook_file
+	config["galaxy_file"] = galaxy_file
+	config["ansible_env_vars"] = []string{"ANSIBLE_ROLES_PATH=/opt/roles", "MOTD=it's $HOME; rm -rf /"}
+	config["ansible_env"] = map[string]string{"TOKEN": "it's-s3cr3t", "HTTPS_PROXY": "http://proxy:3128"}
+	config["sensitive_values"] = []string{"it's-s3cr3t"}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	out := new(bytes.Buffer)
+	ui := &packersdk.BasicUi{Reader: new(bytes.Buffer), Writer: out, ErrorWriter: out}
+	comm := &communicatorMock{}
+	if err := p.Provision(context.Background(), ui, comm, make(map[string]interface{})); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	env := `ANSIBLE_FORCE_COLOR='1' PYTHONUNBUFFERED='1' ` +
+		`ANSIBLE_ROLES_PATH='/opt/roles' MOTD='it'"'"'s $HOME; rm -rf /' ` +
+		`HTTPS_PROXY='http://proxy:3128' TOKEN='it'"'"'s-s3cr3t' ` +
+		`ANSIBLE_ROLES_PATH=${ANSIBLE_ROLES_PATH:+$ANSIBLE_ROLES_PATH:}'` + p.config.GalaxyRolesPath + `' ansible-playbook `
+	galaxyEnv := `ANSIBLE_ROLES_PATH='/opt/roles' MOTD='it'"'"'s $HOME; rm -rf /' ` +
+		`HTTPS_PROXY='http://proxy:3128' TOKEN='it'"'"'s-s3cr3t' ansible-galaxy `
+	var playbookRun, galaxyRun bool
+	for _, cmd := range comm.startCommand {
+		playbookRun = playbookRun || strings.Contains(cmd, env)
+		galaxyRun = galaxyRun || strings.Contains(cmd, galaxyEnv)
+	}
+	if !playbookRun || !galaxyRun {
+		t.Fatalf("the environment should be quoted for ansible-playbook and ansible-galaxy: %v", comm.startCommand)
+	}
+
+	if !strings.Contains(out.String(), "TOKEN='<sensitive>'") {
+		t.Fatalf("the command should be shown with sensitive values masked:\n%s", out.String())
+	}
+	if strings.Contains(out.String(), "s3cr3t") {
+		t.Fatalf("sensitive values should be masked:\n%s", out.String())
+	}
+}
+
+func TestProvisionerProvision_Vault(t *testing.T) {
+	var p Provisioner
+	config := testConfig()
+
+	playbook_file := createTempFile("")
+	defer removeFiles(playbook_file)
+	password_file := createTempFile("")
+	defer removeFiles(password_file)
+	if err := os.WriteFile(password_file, []byte("dev-password"), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	config["playbook_file"] = playbook_file
+	config["vault_password"] = "hunter2"
+	config["vault_ids"] = []map[string]interface{}{
+		{"id": "dev", "password_file": password_file},
+	}
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := &communicatorMock{
+		exitStatus: func(command string) int {
+			if strings.Contains(command, "ansible-playbook") {
+				return 2
+			}
+			return 0
+		},
+	}
+	if err := p.Provision(context.Background(), packersdk.TestUi(t), comm, make(map[string]interface{})); err == nil {
+		t.Fatal("should have error")
+	}
+
+	passwordDst := filepath.ToSlash(filepath.Join(p.config.StagingDir, "packer-vault-password"))
+	idDst := filepath.ToSlash(filepath.Join(p.config.StagingDir, "packer-vault-id-0"))
+	for dst, content := range map[string]string{passwordDst: "hunter2", idDst: "dev-password"} {
+		upload, ok := comm.uploads[dst]
+		if !ok {
+			t.Fatalf("%s was not uploaded: %v", dst, comm.uploadDestination)
+		}
+		if string(upload.content) != content || upload.mode.Perm() != 0600 {
+			t.Fatalf("expected %s to be uploaded with mode 0600, got %q with mode %o", dst, upload.content, upload.mode.Perm())
+		}
+	}
+
+	playbookRun := -1
+	removed := map[string]int{}
+	for i, cmd := range comm.startCommand {
+		if strings.Contains(cmd, "hunter2") || strings.Contains(cmd, "dev-password") {
+			t.Fatalf("vault passwords should not be in commands: %s", cmd)
+		}
+		if strings.Contains(cmd, "ansible-playbook") {
+			playbookRun = i
+			if !strings.Contains(cmd, "--vault-password-file "+passwordDst) ||
+				!strings.Contains(cmd, "--vault-id dev@"+idDst) {
+				t.Fatalf("vault password files were not passed: %s", cmd)
+			}
+		}
+		for _, dst := range []string{passwordDst, idDst} {
+			if cmd == fmt.Sprintf("rm -f '%s'", dst) {
+				removed[dst] = i
+			}
+		}
+	}
+	for _, dst := range []string{passwordDst, idDst} {
+		if i, ok := removed[dst]; !ok || i < playbookRun {
+			t.Fatalf("%s should be removed after the failed run: %v", dst, comm.startCommand)
+		}
+	}
+}
+
+func TestProvisionerProvision_GalaxyFile(t *testing.T) {
+	var p Provisioner
+	config := testConfig()
+
+	playbook_file := createTempFile("")
+	defer removeFiles(playbook_file)
+	galaxy_file := createTempFile("")
+	defer removeFiles(galaxy_file)
+	content := `
+roles:
+  - geerlingguy.docker,6.1.0
+collections:
+  - community.general
+  - name: ./collections/my_ns/my_coll
+    type: dir
+`
+	if err := os.WriteFile(galaxy_file, []byte(content), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	config["playbook_file"] = playbook_file
+	config["galaxy_file"] = galaxy_file
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := &communicatorMock{}
+	if err := p.Provision(context.Background(), packersdk.TestUi(t), comm, make(map[string]interface{})); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	dst := filepath.ToSlash(filepath.Join(p.config.StagingDir, filepath.Base(galaxy_file)))
+	upload, ok := comm.uploads[dst]
+	if !ok {
+		t.Fatalf("galaxy file was not uploaded: %v", comm.uploadDestination)
+	}
+	if string(upload.content) != content {
+		t.Fatalf("expected the galaxy file unchanged, so that relative paths resolve as usual:\n%s\ngot:\n%s", content, upload.content)
+	}
+
+	var galaxyCmds []string
+	for _, cmd := range comm.startCommand {
+		if strings.Contains(cmd, "ansible-galaxy") {
+			galaxyCmds = append(galaxyCmds, cmd)
+		}
+	}
+	expectedCmds := []string{
+		fmt.Sprintf("cd '%s' && ansible-galaxy install -r %s -p %s", p.config.StagingDir, dst, p.config.GalaxyRolesPath),
+		fmt.Sprintf("cd '%s' && ansible-galaxy collection install -r %s -p %s", p.config.StagingDir, dst, p.config.GalaxyCollectionsPath),
+	}
+	if !reflect.DeepEqual(galaxyCmds, expectedCmds) {
+		t.Fatalf("expected galaxy commands %v, got %v", expectedCmds, galaxyCmds)
+	}
+}
+
+// readStagingArchive returns the content of the files of a staging archive
+// by name, and the target of the symbolic links prefixed with "-> ".
+func readStagingArchive(t *testing.T, content []byte) map[string]string {
+	gz, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	archived := map[string]string{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			b, _ := io.ReadAll(tr)
+			archived[hdr.Name] = string(b)
+		case tar.TypeSymlink:
+			archived[hdr.Name] = "-> " + hdr.Linkname
+		}
+	}
+	return archived
+}
+
+func TestProvisionerProvision_StagingArchive(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"playbooks/site.yml":              "---\n",
+		"playbooks/templates/motd.j2":     "hello\n",
+		"group_vars/all.yml":              "a: 1\n",
+		"roles/common/tasks/main.yml":     "---\n",
+		"collections/example/MANIFEST.md": "",
+	}
+	for name, content := range files {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	newProvisioner := func() *Provisioner {
+		var p Provisioner
+		config := testConfig()
+		config["playbook_dir"] = filepath.Join(dir, "playbooks")
+		config["playbook_file"] = filepath.Join(dir, "playbooks", "site.yml")
+		config["group_vars"] = filepath.Join(dir, "group_vars")
+		config["role_paths"] = []string{filepath.Join(dir, "roles", "common")}
+		config["collection_paths"] = []string{filepath.Join(dir, "collections", "example")}
+		config["staging_archive"] = true
+		if err := p.Prepare(config); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return &p
+	}
+
+	t.Run("archive", func(t *testing.T) {
+		p := newProvisioner()
+		comm := &communicatorMock{}
+		if err := p.Provision(context.Background(), packersdk.TestUi(t), comm, make(map[string]interface{})); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if len(comm.uploadDirs) != 0 {
+			t.Fatalf("no directory should be uploaded: %v", comm.uploadDirs)
+		}
+
+		dst := p.config.StagingDir + "/packer-staging.tar.gz"
+		upload, ok := comm.uploads[dst]
+		if !ok {
+			t.Fatalf("staging archive was not uploaded: %v", comm.uploadDestination)
+		}
+		archived := readStagingArchive(t, upload.content)
+		expected := map[string]string{
+			"site.yml":                        "---\n",
+			"templates/motd.j2":               "hello\n",
+			"group_vars/all.yml":              "a: 1\n",
+			"roles/common/tasks/main.yml":     "---\n",
+			"collections/example/MANIFEST.md": "",
+		}
+		for name, content := range expected {
+			if archived[name] != content {
+				t.Fatalf("expected %s in the archive, got %v", name, archived)
+			}
+		}
+		if len(archived) != len(expected)+1 {
+			t.Fatalf("expected the files and the inventory in the archive, got %v", archived)
+		}
+
+		extract := fmt.Sprintf("cd '%s' && tar -xzf 'packer-staging.tar.gz' && rm -f 'packer-staging.tar.gz'", p.config.StagingDir)
+		var commands []string
+		for _, cmd := range comm.startCommand {
+			if strings.Contains(cmd, "ansible-playbook") {
+				break
+			}
+			commands = append(commands, cmd)
+		}
+		expectedCommands := []string{
+			"command -v tar >/dev/null 2>&1 && command -v gzip >/dev/null 2>&1",
+			fmt.Sprintf("mkdir -p '%s'", p.config.StagingDir),
+			extract,
+		}
+		if !reflect.DeepEqual(commands, expectedCommands) {
+			t.Fatalf("expected commands %v, got %v", expectedCommands, commands)
+		}
+	})
+
+	t.Run("missing tar", func(t *testing.T) {
+		p := newProvisioner()
+		comm := &communicatorMock{
+			exitStatus: func(command string) int {
+				if strings.HasPrefix(command, "command -v tar") {
+					return 1
+				}
+				return 0
+			},
+		}
+		if err := p.Provision(context.Background(), packersdk.TestUi(t), comm, make(map[string]interface{})); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if len(comm.uploadDirs) != 4 {
+			t.Fatalf("the directories should be uploaded one by one: %v", comm.uploadDirs)
+		}
+		if _, ok := comm.uploads[p.config.StagingDir+"/packer-staging.tar.gz"]; ok {
+			t.Fatal("no staging archive should be uploaded")
+		}
+	})
+}
+
+func TestProvisionerProvision_StagingArchiveSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"playbooks/site.yml":                 "---\n",
+		"shared/webserver/tasks/main.yml":    "- name: nginx\n",
+		"shared/webserver/templates/site.j2": "server {}\n",
+		"shared/vars.yml":                    "port: 80\n",
+	}
+	for name, content := range files {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	// A role shared between projects, with a relative link, and a file, with
+	// an absolute link, both outside of playbook_dir.
+	if err := os.Mkdir(filepath.Join(dir, "playbooks", "roles"), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	links := map[string]string{
+		filepath.Join(dir, "playbooks", "roles", "webserver"): filepath.Join("..", "..", "shared", "webserver"),
+		filepath.Join(dir, "playbooks", "vars.yml"):           filepath.Join(dir, "shared", "vars.yml"),
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Skipf("symbolic links are not supported: %s", err)
+		}
+	}
+
+	var p Provisioner
+	config := testConfig()
+	config["playbook_dir"] = filepath.Join(dir, "playbooks")
+	config["playbook_file"] = filepath.Join(dir, "playbooks", "site.yml")
+	config["staging_archive"] = true
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	comm := &communicatorMock{}
+	if err := p.Provision(context.Background(), packersdk.TestUi(t), comm, make(map[string]interface{})); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	upload, ok := comm.uploads[p.config.StagingDir+"/packer-staging.tar.gz"]
+	if !ok {
+		t.Fatalf("staging archive was not uploaded: %v", comm.uploadDestination)
+	}
+	archived := readStagingArchive(t, upload.content)
+	expected := map[string]string{
+		"site.yml":                          "---\n",
+		"roles/webserver/tasks/main.yml":    "- name: nginx\n",
+		"roles/webserver/templates/site.j2": "server {}\n",
+		"vars.yml":                          "port: 80\n",
+	}
+	for name, content := range expected {
+		if archived[name] != content {
+			t.Fatalf("expected the content of the link target %s in the archive, got %v", name, archived)
+		}
+	}
+	if len(archived) != len(expected)+1 {
+		t.Fatalf("expected the files and the inventory in the archive, got %v", archived)
+	}
+}
+func TestProvisionerProvision_WindowsGuest(t *testing.T) {
+	var p Provisioner
+	config := testConfig()
+
+	playbook_file := createTempFile("")
+	defer removeFiles(playbook_file)
+
+	config["playbook_file"] = playbook_file
+	config["guest_os_type"] = "windows"
+	config["staging_directory"] = `C:\Packer\ansible staging`
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if p.config.StagingDir != "C:/Packer/ansible staging" {
+		t.Fatalf("backslashes should be replaced in staging_directory, got %s", p.config.StagingDir)
+	}
+	if p.config.GalaxyRolesPath != "C:/Packer/ansible staging/galaxy_roles" {
+		t.Fatalf("unexpected galaxy_roles_path %s", p.config.GalaxyRolesPath)
+	}
+
+	comm := &communicatorMock{}
+	if err := p.Provision(context.Background(), packersdk.TestUi(t), comm, make(map[string]interface{})); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(comm.startCommand) != 2 {
+		t.Fatalf("expected 2 commands, got %v", comm.startCommand)
+	}
+	if script := decodePowerShell(t, comm.startCommand[0]); !strings.Contains(script,
+		"New-Item -ItemType Directory -Force -Path 'C:/Packer/ansible staging' | Out-Null") {
+		t.Fatalf("unexpected script creating the staging directory:\n%s", script)
+	}
+	script := decodePowerShell(t, comm.startCommand[1])
+	if !strings.Contains(script, "Set-Location -LiteralPath 'C:/Packer/ansible staging'; if (-not $?) { exit $LASTEXITCODE }; ansible-playbook 'C:/Packer/ansible staging/") {
+		t.Fatalf("unexpected script running the playbook:\n%s", script)
+	}
+	for _, dst := range comm.uploadDestination {
+		if !strings.HasPrefix(dst, "C:/Packer/ansible staging/") {
+			t.Fatalf("unexpected upload destination %s", dst)
+		}
+	}
+
+	p = Provisioner{}
+	delete(config, "staging_directory")
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.HasPrefix(p.config.StagingDir, "C:/Windows/Temp/packer-provisioner-ansible-local/") {
+		t.Fatalf("unexpected default staging directory for windows %s", p.config.StagingDir)
+	}
+
+	p = Provisioner{}
+	config["galaxy_roles_path"] = `D:\roles`
+	err := p.Prepare(config)
+	if err == nil || !strings.Contains(err.Error(), `galaxy_roles_path must be on the drive of staging_directory with guest_os_type windows, got "D:/roles"`) {
+		t.Fatalf("galaxy_roles_path on another drive should be an error, got: %v", err)
+	}
+}
+
+func TestProvisionerProvision_Install(t *testing.T) {
+	playbook_file := createTempFile("")
+	defer removeFiles(playbook_file)
+	wheelhouse := t.TempDir()
+
+	newProvisioner := func(install map[string]interface{}) *Provisioner {
+		var p Provisioner
+		config := testConfig()
+		config["playbook_file"] = playbook_file
+		config["install"] = install
+		if err := p.Prepare(config); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return &p
+	}
+	check := "command -v 'ansible-playbook' >/dev/null 2>&1"
+
+	t.Run("missing", func(t *testing.T) {
+		p := newProvisioner(map[string]interface{}{"version": "2.16.3", "wheelhouse": wheelhouse})
+		installed := false
+		userCheck := `PATH="$HOME/.local/bin:$PATH"; ` + check
+		comm := &communicatorMock{
+			exitStatus: func(command string) int {
+				// Debian 12 refuses pip installs outside of a virtualenv
+				// (PEP 668), and the user directory of the commands isn't in
+				// the PATH.
+				if strings.HasPrefix(command, "'python3' -m pip install") {
+					return 1
+				}
+				if strings.Contains(command, `"$HOME/.ansible/venv/bin/python" -m pip install`) {
+					installed = true
+				}
+				if command == check || (command == userCheck && !installed) {
+					return 1
+				}
+				return 0
+			},
+		}
+		if err := p.Provision(context.Background(), packersdk.TestUi(t), comm, make(map[string]interface{})); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		dst := p.config.StagingDir + "/packer-wheelhouse"
+		expected := []string{
+			check,
+			userCheck,
+			fmt.Sprintf("mkdir -p '%s'", dst),
+			`'python3' -m venv "$HOME/.ansible/venv" && ` +
+				fmt.Sprintf(`"$HOME/.ansible/venv/bin/python" -m pip install --disable-pip-version-check --no-index --find-links '%s' 'ansible-core==2.16.3' && `, dst) +
+				`mkdir -p "$HOME/.local/bin" && ln -sf "$HOME/.ansible/venv"/bin/ansible* "$HOME/.local/bin"/`,
+			check,
+			userCheck,
+			fmt.Sprintf("rm -rf '%s'", dst),
+			fmt.Sprintf("mkdir -p '%s'", p.config.StagingDir),
+		}
+		if !reflect.DeepEqual(comm.startCommand[:len(expected)], expected) {
+			t.Fatalf("expected commands %v, got %v", expected, comm.startCommand)
+		}
+		if _, ok := comm.uploadDirs[dst]; !ok {
+			t.Fatalf("the wheelhouse was not uploaded: %v", comm.uploadDirs)
+		}
+		lastCmd := comm.startCommand[len(comm.startCommand)-1]
+		if !strings.Contains(lastCmd, `PATH="$HOME/.local/bin:$PATH" ansible-playbook `) {
+			t.Fatalf("the directory of the installed commands should be added to the PATH: %s", lastCmd)
+		}
+	})
+
+	t.Run("found", func(t *testing.T) {
+		p := newProvisioner(map[string]interface{}{"method": "pipx"})
+		comm := &communicatorMock{}
+		if err := p.Provision(context.Background(), packersdk.TestUi(t), comm, make(map[string]interface{})); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		for _, cmd := range comm.startCommand {
+			if strings.Contains(cmd, "pipx") {
+				t.Fatalf("Ansible should not be installed when found: %s", cmd)
+			}
+		}
+	})
+
+	t.Run("none", func(t *testing.T) {
+		p := newProvisioner(map[string]interface{}{"method": "none"})
+		comm := &communicatorMock{
+			exitStatus: func(command string) int {
+				if command == check {
+					return 1
+				}
+				return 0
+			},
+		}
+		err := p.Provision(context.Background(), packersdk.TestUi(t), comm, make(map[string]interface{}))
+		if err == nil || !strings.Contains(err.Error(), "ansible-playbook was not found on the remote machine") {
+			t.Fatalf("expected a missing command error, got %v", err)
+		}
+		if len(comm.startCommand) != 1 || len(comm.uploadDestination) != 0 {
+			t.Fatalf("nothing should be staged when the command is missing: %v %v", comm.startCommand, comm.uploadDestination)
+		}
+	})
+}
@@ -0,0 +1,269 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblelocal
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/hashicorp/packer-plugin-sdk/guestexec"
+)
+
+// guestShell builds the commands run on the remote machine in the syntax of
+// its shell.
+type guestShell interface {
+	// Quote quotes s as a single word.
+	Quote(s string) string
+	// Args renders args as words of a command line, each received as is by
+	// the command whatever characters it contains.
+	Args(args []string) string
+	// CreateDir creates dir and its parents.
+	CreateDir(dir string) string
+	// RemoveDir removes dir and its content.
+	RemoveDir(dir string) string
+	// RemoveFile removes file, if it exists.
+	RemoveFile(file string) string
+	// Cd changes the working directory to dir.
+	Cd(dir string) string
+	// SetEnv sets the environment variable name to value.
+	SetEnv(name, value string) string
+	// AppendEnvPath appends paths to the colon separated path list in the
+	// environment variable name, for a command run in the directory dir.
+	AppendEnvPath(name, dir string, paths []string) string
+	// WithEnv runs command with the environment variables set by env.
+	WithEnv(env []string, command string) string
+	// Chain runs commands in order, stopping at the first failing one.
+	Chain(commands ...string) string
+	// HasCommand exits successfully if the command name is found.
+	HasCommand(name string) string
+	// HasTar exits successfully if the staging archive can be extracted.
+	HasTar() string
+	// Command returns the command running script through the communicator.
+	Command(script string) string
+}
+
+// newGuestShell returns the shell of the remote machine of osType.
+func newGuestShell(osType string) (guestShell, error) {
+	switch osType {
+	case guestexec.UnixOSType:
+		return unixShell{}, nil
+	case guestexec.WindowsOSType:
+		return powershellShell{}, nil
+	}
+	return nil, fmt.Errorf("guest_os_type must be %s or %s, got %q", guestexec.UnixOSType, guestexec.WindowsOSType, osType)
+}
+
+// validEnvName reports whether name is a valid environment variable name
+// in both the POSIX shell and PowerShell.
+func validEnvName(name string) bool {
+	return isPlainWord(name, "_") && !('0' <= name[0] && name[0] <= '9')
+}
+
+// isPlainWord reports whether word is not empty and only contains ASCII
+// letters, digits and the characters of plain.
+func isPlainWord(word, plain string) bool {
+	for _, r := range word {
+		if !('a' <= r && r <= 'z') && !('A' <= r && r <= 'Z') && !('0' <= r && r <= '9') && !strings.ContainsRune(plain, r) {
+			return false
+		}
+	}
+	return word != ""
+}
+
+// unixShell builds POSIX shell commands.
+type unixShell struct{}
+
+func (unixShell) Quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
+
+func (sh unixShell) Args(args []string) string {
+	words := make([]string, len(args))
+	for i, arg := range args {
+		words[i] = arg
+		if !isPlainWord(arg, "_@%+=:,./-") {
+			words[i] = sh.Quote(arg)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+func (sh unixShell) CreateDir(dir string) string {
+	return "mkdir -p " + sh.Quote(dir)
+}
+
+func (sh unixShell) RemoveDir(dir string) string {
+	return "rm -rf " + sh.Quote(dir)
+}
+
+func (sh unixShell) RemoveFile(file string) string {
+	return "rm -f " + sh.Quote(file)
+}
+
+func (sh unixShell) Cd(dir string) string {
+	return "cd " + sh.Quote(dir)
+}
+
+func (sh unixShell) SetEnv(name, value string) string {
+	return name + "=" + sh.Quote(value)
+}
+
+func (sh unixShell) AppendEnvPath(name, dir string, paths []string) string {
+	return fmt.Sprintf("%s=${%s:+$%s:}%s", name, name, name, sh.Quote(strings.Join(paths, ":")))
+}
+
+func (unixShell) WithEnv(env []string, command string) string {
+	return strings.Join(append(env, command), " ")
+}
+
+func (unixShell) Chain(commands ...string) string {
+	return strings.Join(commands, " && ")
+}
+
+func (sh unixShell) HasCommand(name string) string {
+	return "command -v " + sh.Quote(name) + " >/dev/null 2>&1"
+}
+
+func (unixShell) HasTar() string {
+	return "command -v tar >/dev/null 2>&1 && command -v gzip >/dev/null 2>&1"
+}
+
+func (unixShell) Command(script string) string {
+	return script
+}
+
+// powershellShell builds PowerShell scripts, run through powershell.exe.
+type powershellShell struct{}
+
+func (powershellShell) Quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func (sh powershellShell) Args(args []string) string {
+	words := make([]string, len(args))
+	for i, arg := range args {
+		// PowerShell 5 splits some unquoted parameters like -a.b or -a:b in
+		// two when passing them to a native command.
+		if isPlainWord(arg, "_/\\-") || (!strings.HasPrefix(arg, "-") && isPlainWord(arg, "_/\\-.:=")) {
+			words[i] = arg
+			continue
+		}
+		words[i] = sh.Quote(nativeArg(arg))
+	}
+	return strings.Join(words, " ")
+}
+
+// nativeArg escapes arg for the command line built by PowerShell 5 for a
+// native command, which is only enclosed in double quotes if arg contains
+// whitespace, so that the command parses it back as arg. Empty arguments
+// would be dropped otherwise.
+func nativeArg(arg string) string {
+	if arg == "" {
+		return `""`
+	}
+	var b strings.Builder
+	backslashes := 0
+	for _, r := range arg {
+		switch r {
+		case '\\':
+			backslashes++
+			b.WriteRune(r)
+			continue
+		case '"':
+			b.WriteString(strings.Repeat(`\`, backslashes+1))
+		}
+		backslashes = 0
+		b.WriteRune(r)
+	}
+	if strings.ContainsAny(arg, " \t") {
+		b.WriteString(strings.Repeat(`\`, backslashes))
+	}
+	return b.String()
+}
+
+func (sh powershellShell) CreateDir(dir string) string {
+	return fmt.Sprintf("New-Item -ItemType Directory -Force -Path %s | Out-Null", sh.Quote(dir))
+}
+
+func (sh powershellShell) RemoveDir(dir string) string {
+	return fmt.Sprintf("if (Test-Path -LiteralPath %s) { Remove-Item -LiteralPath %s -Recurse -Force }", sh.Quote(dir), sh.Quote(dir))
+}
+
+func (sh powershellShell) RemoveFile(file string) string {
+	return fmt.Sprintf("if (Test-Path -LiteralPath %s) { Remove-Item -LiteralPath %s -Force }", sh.Quote(file), sh.Quote(file))
+}
+
+func (sh powershellShell) Cd(dir string) string {
+	return "Set-Location -LiteralPath " + sh.Quote(dir)
+}
+
+func (sh powershellShell) SetEnv(name, value string) string {
+	return fmt.Sprintf("$env:%s = %s", name, sh.Quote(value))
+}
+
+// AppendEnvPath separates the paths with colons too: Ansible doesn't run
+// natively on Windows but under WSL or Cygwin, where it can't resolve the
+// drive letters of the Windows paths. The paths are thus made relative to
+// dir, and resolved by Ansible from the working directory.
+func (sh powershellShell) AppendEnvPath(name, dir string, paths []string) string {
+	rel := make([]string, len(paths))
+	for i, p := range paths {
+		rel[i], _ = relativePath(dir, p)
+	}
+	return fmt.Sprintf("$env:%s = (@($env:%s, %s) | Where-Object { $_ }) -join ':'", name, name, sh.Quote(strings.Join(rel, ":")))
+}
+
+// relativePath returns the slash separated Windows path p relative to dir,
+// ignoring the case like Windows does. It returns p and false if p is on
+// another drive than dir, or only one of them is absolute.
+func relativePath(dir, p string) (string, bool) {
+	dirElems := strings.Split(strings.Trim(dir, "/"), "/")
+	elems := strings.Split(strings.Trim(p, "/"), "/")
+	if !strings.EqualFold(dirElems[0], elems[0]) || strings.HasPrefix(dir, "/") != strings.HasPrefix(p, "/") {
+		return p, false
+	}
+	common := 0
+	for common < len(dirElems) && common < len(elems) && strings.EqualFold(dirElems[common], elems[common]) {
+		common++
+	}
+	rel := elems[common:]
+	for i := common; i < len(dirElems); i++ {
+		rel = append([]string{".."}, rel...)
+	}
+	if len(rel) == 0 {
+		return ".", true
+	}
+	return strings.Join(rel, "/"), true
+}
+
+func (powershellShell) WithEnv(env []string, command string) string {
+	return strings.Join(append(env, command), "; ")
+}
+
+func (powershellShell) Chain(commands ...string) string {
+	// PowerShell 5 has no &&: $? is false after a failed native command.
+	return strings.Join(commands, "; if (-not $?) { exit $LASTEXITCODE }; ")
+}
+
+func (sh powershellShell) HasCommand(name string) string {
+	return fmt.Sprintf("if (-not (Get-Command %s -ErrorAction SilentlyContinue)) { exit 1 }", sh.Quote(name))
+}
+
+func (powershellShell) HasTar() string {
+	// The tar of Windows reads gzipped archives by itself.
+	return "if (-not (Get-Command tar -ErrorAction SilentlyContinue)) { exit 1 }"
+}
+
+// Command encodes script so that it goes through the Windows command line
+// without being quoted again.
+func (powershellShell) Command(script string) string {
+	script = "$ErrorActionPreference = 'Stop'; $ProgressPreference = 'SilentlyContinue'; " + script + "; exit $LASTEXITCODE"
+	var b []byte
+	for _, r := range utf16.Encode([]rune(script)) {
+		b = append(b, byte(r), byte(r>>8))
+	}
+	return "powershell.exe -NoProfile -NonInteractive -ExecutionPolicy Bypass -EncodedCommand " + base64.StdEncoding.EncodeToString(b)
+}
@@ -0,0 +1,203 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblelocal
+
+import (
+	"encoding/base64"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// decodePowerShell returns the script run by a command of powershellShell.
+func decodePowerShell(t *testing.T, command string) string {
+	const prefix = "powershell.exe -NoProfile -NonInteractive -ExecutionPolicy Bypass -EncodedCommand "
+	if !strings.HasPrefix(command, prefix) {
+		t.Fatalf("not an encoded PowerShell command: %s", command)
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(command, prefix))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = uint16(b[2*i]) | uint16(b[2*i+1])<<8
+	}
+	return string(utf16.Decode(u))
+}
+
+func TestGuestShell(t *testing.T) {
+	// Each case is run with the paths under root, /tmp for unix and C:/tmp
+	// for windows.
+	testcases := []struct {
+		actual  func(sh guestShell, root string) string
+		unix    string
+		windows string
+	}{
+		{
+			actual:  func(sh guestShell, root string) string { return sh.CreateDir(root + "/it's here") },
+			unix:    `mkdir -p '/tmp/it'"'"'s here'`,
+			windows: `New-Item -ItemType Directory -Force -Path 'C:/tmp/it''s here' | Out-Null`,
+		},
+		{
+			actual:  func(sh guestShell, root string) string { return sh.RemoveDir(root + "/staging") },
+			unix:    `rm -rf '/tmp/staging'`,
+			windows: `if (Test-Path -LiteralPath 'C:/tmp/staging') { Remove-Item -LiteralPath 'C:/tmp/staging' -Recurse -Force }`,
+		},
+		{
+			actual:  func(sh guestShell, root string) string { return sh.RemoveFile(root + "/vars.json") },
+			unix:    `rm -f '/tmp/vars.json'`,
+			windows: `if (Test-Path -LiteralPath 'C:/tmp/vars.json') { Remove-Item -LiteralPath 'C:/tmp/vars.json' -Force }`,
+		},
+		{
+			actual: func(sh guestShell, root string) string {
+				return sh.Chain(sh.Cd(root+"/staging"), sh.WithEnv([]string{
+					sh.AppendEnvPath("ANSIBLE_ROLES_PATH", root+"/staging", []string{root + "/staging/roles", root + "/Staging/galaxy_roles", root + "/opt/roles"}),
+					sh.SetEnv("ANSIBLE_CALLBACKS_ENABLED", "packer"),
+				}, "ansible-playbook site.yml"))
+			},
+			unix: `cd '/tmp/staging' && ANSIBLE_ROLES_PATH=${ANSIBLE_ROLES_PATH:+$ANSIBLE_ROLES_PATH:}'/tmp/staging/roles:/tmp/Staging/galaxy_roles:/tmp/opt/roles' ANSIBLE_CALLBACKS_ENABLED='packer' ansible-playbook site.yml`,
+			windows: `Set-Location -LiteralPath 'C:/tmp/staging'; if (-not $?) { exit $LASTEXITCODE }; ` +
+				`$env:ANSIBLE_ROLES_PATH = (@($env:ANSIBLE_ROLES_PATH, 'roles:galaxy_roles:../opt/roles') | Where-Object { $_ }) -join ':'; ` +
+				`$env:ANSIBLE_CALLBACKS_ENABLED = 'packer'; ansible-playbook site.yml`,
+		},
+	}
+	unix, err := newGuestShell("unix")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	windows, err := newGuestShell("windows")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for _, tc := range testcases {
+		if actual := tc.actual(unix, "/tmp"); actual != tc.unix {
+			t.Errorf("unix: expected:\n%s\ngot:\n%s", tc.unix, actual)
+		}
+		if actual := tc.actual(windows, "C:/tmp"); actual != tc.windows {
+			t.Errorf("windows: expected:\n%s\ngot:\n%s", tc.windows, actual)
+		}
+	}
+
+	if _, err := newGuestShell("darwin"); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestRelativePath(t *testing.T) {
+	testcases := []struct {
+		dir, path, expected string
+		ok                  bool
+	}{
+		{"C:/tmp/staging", "C:/tmp/staging/roles", "roles", true},
+		{"C:/tmp/staging/", "c:/TMP/Staging/galaxy_roles", "galaxy_roles", true},
+		{"C:/tmp/staging", "C:/tmp/staging", ".", true},
+		{"C:/tmp/staging", "C:/opt/roles", "../../opt/roles", true},
+		{"C:/tmp/staging", "D:/opt/roles", "D:/opt/roles", false},
+		{"C:/tmp/staging", "roles", "roles", false},
+	}
+	for _, tc := range testcases {
+		actual, ok := relativePath(tc.dir, tc.path)
+		if actual != tc.expected || ok != tc.ok {
+			t.Errorf("relativePath(%q, %q): expected %q, %v, got %q, %v", tc.dir, tc.path, tc.expected, tc.ok, actual, ok)
+		}
+	}
+}
+
+func TestGuestShellArgs(t *testing.T) {
+	testcases := []struct {
+		args    []string
+		unix    string
+		windows string
+	}{
+		{
+			args:    []string{"-c", "local", "-i", "/tmp/staging/inventory"},
+			unix:    `-c local -i /tmp/staging/inventory`,
+			windows: `-c local -i /tmp/staging/inventory`,
+		},
+		{
+			args:    []string{"--extra-vars", "region=eu-west-1 stage=prod"},
+			unix:    `--extra-vars 'region=eu-west-1 stage=prod'`,
+			windows: `--extra-vars 'region=eu-west-1 stage=prod'`,
+		},
+		{
+			args:    []string{"owner=O'Brien"},
+			unix:    `'owner=O'"'"'Brien'`,
+			windows: `'owner=O''Brien'`,
+		},
+		{
+			args:    []string{"$HOME", "`id`", "$(id)", "${PATH}"},
+			unix:    "'$HOME' '`id`' '$(id)' '${PATH}'",
+			windows: "'$HOME' '`id`' '$(id)' '${PATH}'",
+		},
+		{
+			args:    []string{"; rm -rf /", "a|b", "a && b", "*.yml", "a>b"},
+			unix:    `'; rm -rf /' 'a|b' 'a && b' '*.yml' 'a>b'`,
+			windows: `'; rm -rf /' 'a|b' 'a && b' '*.yml' 'a>b'`,
+		},
+		{
+			args:    []string{"", "--check"},
+			unix:    `'' --check`,
+			windows: `'""' --check`,
+		},
+		{
+			args:    []string{`msg="hello world"`, `quote="`},
+			unix:    `'msg="hello world"' 'quote="'`,
+			windows: `'msg=\"hello world\"' 'quote=\"'`,
+		},
+		{
+			args:    []string{`C:\with space\`, `C:\plain\`, `a\"b`},
+			unix:    `'C:\with space\' 'C:\plain\' 'a\"b'`,
+			windows: `'C:\with space\\' C:\plain\ 'a\\\"b'`,
+		},
+		{
+			args:    []string{"-e.yml", "-o:x", "@file", "a,b", "--%", "~/x"},
+			unix:    `-e.yml -o:x @file a,b --% '~/x'`,
+			windows: `'-e.yml' '-o:x' '@file' 'a,b' '--%' '~/x'`,
+		},
+		{
+			args:    []string{"line\nbreak", "tab\there", "caf\u00e9"},
+			unix:    "'line\nbreak' 'tab\there' 'caf\u00e9'",
+			windows: "'line\nbreak' 'tab\there' 'caf\u00e9'",
+		},
+	}
+	for _, tc := range testcases {
+		if actual := (unixShell{}).Args(tc.args); actual != tc.unix {
+			t.Errorf("unix: expected:\n%s\ngot:\n%s", tc.unix, actual)
+		}
+		if actual := (powershellShell{}).Args(tc.args); actual != tc.windows {
+			t.Errorf("windows: expected:\n%s\ngot:\n%s", tc.windows, actual)
+		}
+	}
+
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh is not available")
+	}
+	for _, tc := range testcases {
+		out, err := exec.Command(sh, "-c", `printf '%s\0' `+(unixShell{}).Args(tc.args)).Output()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		actual := strings.Split(string(out), "\x00")
+		if !reflect.DeepEqual(actual[:len(actual)-1], tc.args) {
+			t.Errorf("sh should receive %q, got %q", tc.args, actual[:len(actual)-1])
+		}
+	}
+}
+
+func TestPowerShellCommand(t *testing.T) {
+	sh := powershellShell{}
+	script := decodePowerShell(t, sh.Command("tar -xzf 'packer-staging.tar.gz'"))
+	expected := "$ErrorActionPreference = 'Stop'; $ProgressPreference = 'SilentlyContinue'; tar -xzf 'packer-staging.tar.gz'; exit $LASTEXITCODE"
+	if script != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, script)
+	}
+
+	if cmd := (unixShell{}).Command("ls"); cmd != "ls" {
+		t.Fatalf("unix commands should be run as is, got %s", cmd)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package ansiblelocal
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/tmp"
+)
+
+// stagingArchiveFile is the name of the staging archive in the staging
+// directory, removed once extracted.
+const stagingArchiveFile = "packer-staging.tar.gz"
+
+// stagingArchive collects the files uploaded to the staging directory in a
+// gzipped tarball, so that they are uploaded and extracted at once.
+type stagingArchive struct {
+	// The staging directory on the remote machine.
+	root string
+	file *os.File
+	gz   *gzip.Writer
+	tw   *tar.Writer
+	dirs map[string]bool
+}
+
+func newStagingArchive(root string) (*stagingArchive, error) {
+	f, err := tmp.File("packer-ansible-local-staging")
+	if err != nil {
+		return nil, err
+	}
+	gz := gzip.NewWriter(f)
+	return &stagingArchive{
+		root: strings.TrimSuffix(filepath.ToSlash(root), "/"),
+		file: f,
+		gz:   gz,
+		tw:   tar.NewWriter(gz),
+		dirs: map[string]bool{".": true},
+	}, nil
+}
+
+// rel returns the path of dst relative to the staging directory, and false
+// if dst is outside of it.
+func (a *stagingArchive) rel(dst string) (string, bool) {
+	dst = strings.TrimSuffix(filepath.ToSlash(dst), "/")
+	if dst == a.root {
+		return ".", true
+	}
+	if rel := strings.TrimPrefix(dst, a.root+"/"); rel != dst {
+		return path.Clean(rel), true
+	}
+	return "", false
+}
+
+// addDir adds the directory rel and its parents.
+func (a *stagingArchive) addDir(rel string) error {
+	if a.dirs[rel] {
+		return nil
+	}
+	if err := a.addDir(path.Dir(rel)); err != nil {
+		return err
+	}
+	a.dirs[rel] = true
+	return a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     rel + "/",
+		Mode:     0755,
+		ModTime:  time.Now(),
+	})
+}
+
+// addFile adds the local file src as rel.
+func (a *stagingArchive) addFile(rel, src string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return a.add(rel, info.Mode().Perm(), info.Size(), info.ModTime(), f)
+}
+
+// addContent adds content as the file rel.
+func (a *stagingArchive) addContent(rel string, content []byte, mode os.FileMode) error {
+	return a.add(rel, mode, int64(len(content)), time.Now(), bytes.NewReader(content))
+}
+
+func (a *stagingArchive) add(rel string, mode os.FileMode, size int64, modTime time.Time, r io.Reader) error {
+	if err := a.addDir(path.Dir(rel)); err != nil {
+		return err
+	}
+	err := a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     rel,
+		Mode:     int64(mode),
+		Size:     size,
+		ModTime:  modTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(a.tw, r)
+	return err
+}
+
+// addTree adds the content of the local directory src in rel. Symbolic
+// links are followed and their targets added, like the communicators do when
+// uploading a directory, so that links leaving src still work on the remote
+// machine.
+func (a *stagingArchive) addTree(rel, src string) error {
+	return a.addTreeOf(rel, src, map[string]bool{})
+}
+
+// addTreeOf adds the tree of src, a directory under those in ancestors.
+func (a *stagingArchive) addTreeOf(rel, src string, ancestors map[string]bool) error {
+	real, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return err
+	}
+	if ancestors[real] {
+		return fmt.Errorf("%s: symbolic link loop", src)
+	}
+	ancestors[real] = true
+	defer delete(ancestors, real)
+
+	if err := a.addDir(rel); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		p := filepath.Join(src, entry.Name())
+		name := path.Join(rel, entry.Name())
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			err = a.addTreeOf(name, p, ancestors)
+		} else {
+			err = a.addFile(name, p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close finishes the archive and returns its local path.
+func (a *stagingArchive) close() (string, error) {
+	if err := a.tw.Close(); err != nil {
+		return "", err
+	}
+	if err := a.gz.Close(); err != nil {
+		return "", err
+	}
+	return a.file.Name(), a.file.Close()
+}
+
+// remove removes the local archive.
+func (a *stagingArchive) remove() {
+	_ = a.file.Close()
+	_ = os.Remove(a.file.Name())
+}
@@ -7,6 +7,7 @@
 package ansible
 
 import (
+	"context"
 	"fmt"
 
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
@@ -26,7 +27,7 @@ func (l *provisionLogicTracker) setupAdapter(ui packersdk.Ui, comm packersdk.Com
 	return "", fmt.Errorf("chose sadpath")
 }
 
-func (l *provisionLogicTracker) executeAnsible(ui packersdk.Ui, comm packersdk.Communicator, privKeyFile string) error {
+func (l *provisionLogicTracker) executeAnsible(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator, privKeyFile string) error {
 	l.executeAnsibleCalled = true
 	if l.happyPath {
 		return fmt.Errorf("Chose sadpath")
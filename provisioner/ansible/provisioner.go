@@ -10,11 +10,12 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/x509"
 	"encoding/pem"
 	"errors"
 	"fmt"
@@ -25,14 +26,15 @@ import (
 	"os/exec"
 	"os/user"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 	"unicode"
 
 	"golang.org/x/crypto/ssh"
 
+	"github.com/hashicorp/go-version"
 	"github.com/hashicorp/hcl/v2/hcldec"
 	"github.com/hashicorp/packer-plugin-sdk/adapter"
 	"github.com/hashicorp/packer-plugin-sdk/common"
@@ -41,6 +43,8 @@ import (
 	"github.com/hashicorp/packer-plugin-sdk/template/config"
 	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
 	"github.com/hashicorp/packer-plugin-sdk/tmp"
+
+	ansiblecommon "github.com/hashicorp/packer-plugin-ansible/provisioner/ansible-common"
 )
 
 type Config struct {
@@ -95,6 +99,28 @@ type Config struct {
 	// insensitive) it will be hidden from output. For example, passing
 	// "my_password=secr3t" will hide "secr3t" from output.
 	ExtraArguments []string `mapstructure:"extra_arguments"`
+	// Extra variables passed to `ansible-playbook`, of any type and nesting.
+	// They are written to a JSON file readable only by the current user and
+	// passed with `-e @file`, so that their values don't need to be quoted
+	// and aren't shown in the output. The file is removed after the run.
+	//
+	// ```hcl
+	// extra_vars = {
+	//   app_version = "1.2.3"
+	//   debug       = false
+	//   users = [
+	//     { name = "alice", groups = ["wheel"] },
+	//   ]
+	// }
+	// ```
+	ExtraVars map[string]interface{} `mapstructure:"extra_vars"`
+	// Values to mask as `<sensitive>` in the output of the provisioner, its
+	// `report_file` and its logs, in addition to the values of the variables
+	// marked as sensitive in the template.
+	SensitiveValues []string `mapstructure:"sensitive_values"`
+	// The Ansible Vault passwords. See the [Ansible Vault](#ansible-vault)
+	// section below.
+	ansiblecommon.VaultConfig `mapstructure:",squash"`
 	// Environment variables to set before
 	//   running Ansible. Usage example:
 	//
@@ -114,8 +140,13 @@ type Config struct {
 	//   "ansible_env_vars": [ "WINRM_PASSWORD={{.WinRMPassword}}" ],
 	//   ```
 	AnsibleEnvVars []string `mapstructure:"ansible_env_vars"`
-	// The playbook to be run by Ansible.
-	PlaybookFile string `mapstructure:"playbook_file" required:"true"`
+	// The playbook to be run by Ansible. This option is exclusive with
+	// `playbook_files`, one of them must be set.
+	PlaybookFile string `mapstructure:"playbook_file"`
+	// The playbooks to be run by Ansible, in the order given. All playbooks
+	// share the same proxy adapter, inventory file and galaxy install. This
+	// option is exclusive with `playbook_file`, one of them must be set.
+	PlaybookFiles []string `mapstructure:"playbook_files"`
 	// Specifies --ssh-extra-args on command line defaults to -o IdentitiesOnly=yes
 	AnsibleSSHExtraArgs []string `mapstructure:"ansible_ssh_extra_args"`
 	// The groups into which the Ansible host should
@@ -124,6 +155,19 @@ type Config struct {
 	// The groups which should be present in
 	//  inventory file but remain empty.
 	EmptyGroups []string `mapstructure:"empty_groups"`
+	// The child groups of parent groups, by parent group name. Parent groups
+	// are written as `:children` sections in INI inventories and as nested
+	// groups in YAML inventories. A parent group listed in `groups` is
+	// replaced by its leaf groups, so that the host is only placed in leaf
+	// groups.
+	//
+	// ```hcl
+	// groups         = ["web"]
+	// group_children = {
+	//   linux = ["web", "db"]
+	// }
+	// ```
+	GroupChildren map[string][]string `mapstructure:"group_children"`
 	//  The alias by which the Ansible host should be
 	// known. Defaults to `default`. This setting is ignored when using a custom
 	// inventory file.
@@ -156,11 +200,18 @@ type Config struct {
 	// Supported values:
 	//
 	// * ECDSA (default)
+	// * ED25519
 	// * RSA
 	//
+	// The generated private key is written in the OpenSSH format.
+	//
 	// NOTE: using RSA may cause problems if the key is used to authenticate with rsa-sha1
 	// as modern OpenSSH versions reject this by default as it is unsafe.
 	AdapterKeyType string `mapstructure:"ansible_proxy_key_type"`
+	// The size in bits of the keys generated for the adapter when
+	// `ansible_proxy_key_type` is `RSA`. Must be at least 2048. Defaults to
+	// `2048`, the size of the RSA keys of previous versions.
+	AdapterKeyBits int `mapstructure:"ansible_proxy_key_bits"`
 	// The command to run on the machine being
 	//  provisioned by Packer to handle the SFTP protocol that Ansible will use to
 	//  transfer files. The command should read and write on stdin and stdout,
@@ -171,6 +222,12 @@ type Config struct {
 	//  ansible during the packer run.
 	SkipVersionCheck bool `mapstructure:"skip_version_check"`
 	UseSFTP          bool `mapstructure:"use_sftp"`
+	// A version constraint that the Ansible installation running the
+	// playbooks must satisfy, such as `">= 2.15, < 2.18"`. It is checked
+	// against the version of ansible-core (ansible-base for Ansible 2.10,
+	// ansible up to Ansible 2.9), not of the `ansible` community package, when
+	// the configuration is validated. Can't be used with `skip_version_check`.
+	AnsibleVersionConstraint string `mapstructure:"ansible_version_constraint"`
 	// The directory in which to place the
 	//  temporary generated Ansible inventory file. By default, this is the
 	//  system-specific temporary file location. The fully-qualified name of this
@@ -188,6 +245,35 @@ type Config struct {
 	// HostAlias, User, Port) as well as any variables available to you via the
 	// "build" template engine.
 	InventoryFileTemplate string `mapstructure:"inventory_file_template"`
+	// The format of the inventory file generated by Packer, either `ini` or
+	// `yaml`. Defaults to `ini`. The `yaml` format is required by `host_vars`
+	// and `group_vars` and can't be used with `inventory_file_template`.
+	InventoryFormat string `mapstructure:"inventory_format"`
+	// Variables of the Ansible host, added to the generated inventory file
+	// along with the connection variables set by Packer, which they override.
+	// Values keep their type: booleans, numbers, lists and nested maps are
+	// written as such. Requires `inventory_format = "yaml"`.
+	//
+	// ```hcl
+	// host_vars = {
+	//   ansible_python_interpreter = "/usr/bin/python3"
+	//   disks                      = ["/dev/sdb", "/dev/sdc"]
+	// }
+	// ```
+	HostVars map[string]interface{} `mapstructure:"host_vars"`
+	// Variables of the groups of the generated inventory file, by group name.
+	// Every group must be listed in `groups` or `empty_groups`, or be `all`.
+	// Requires `inventory_format = "yaml"`.
+	//
+	// ```hcl
+	// group_vars = {
+	//   web = {
+	//     http_port = 8080
+	//     tls       = true
+	//   }
+	// }
+	// ```
+	GroupVars map[string]map[string]interface{} `mapstructure:"group_vars"`
 	// The inventory file to use during provisioning.
 	//  When unspecified, Packer will create a temporary inventory file and will
 	//  use the `host_alias`.
@@ -201,7 +287,9 @@ type Config struct {
 	// A requirements file which provides a way to
 	//  install roles or collections with the [ansible-galaxy
 	//  cli](https://docs.ansible.com/ansible/latest/galaxy/user_guide.html#the-ansible-galaxy-command-line-tool)
-	//  on the local machine before executing `ansible-playbook`. By default, this is empty.
+	//  on the local machine before executing `ansible-playbook`. The file is
+	//  validated when the build starts: roles need a `src` or a `name`, and
+	//  collections a `name` and a known source `type`. By default, this is empty.
 	GalaxyFile string `mapstructure:"galaxy_file"`
 	// The command to invoke ansible-galaxy. By default, this is
 	// `ansible-galaxy`.
@@ -224,6 +312,18 @@ type Config struct {
 	//   `ansible-galaxy` command. By default, this is empty, and thus `--collections-path`
 	//   option is not added to the command.
 	CollectionsPath string `mapstructure:"collections_path"`
+	// A directory on your local system in which the roles and collections of
+	//   `galaxy_file` are installed once and reused by the next builds. Each
+	//   install is keyed by a hash of the requirements, the `ansible-galaxy`
+	//   version, the force flags, the `ANSIBLE_GALAXY_` environment variables
+	//   selecting the galaxy servers, and the name, size and modification
+	//   time of the files of the local roles and collections, like `src:
+	//   ./roles/web` or `type: dir`: when the key is found, `ansible-galaxy`
+	//   is not run at all. `ansible-playbook` finds the cached roles and
+	//   collections through `ANSIBLE_ROLES_PATH` and `ANSIBLE_COLLECTIONS_PATH`,
+	//   before `roles_path` and `collections_path` or the Ansible default paths.
+	//   By default, this is empty and nothing is cached.
+	GalaxyCacheDir string `mapstructure:"galaxy_cache_dir"`
 	// When `true`, set up a localhost proxy adapter
 	// so that Ansible has an IP address to connect to, even if your guest does not
 	// have an IP address. For example, the adapter is necessary for Docker builds
@@ -258,6 +358,62 @@ type Config struct {
 	//
 	// Default: `false`
 	WinRMUseHTTP bool `mapstructure:"ansible_winrm_use_http"`
+	// Show a concise line for every play and task result instead of the raw
+	// Ansible output, followed by the task counts of every play and the play
+	// recap. Every event is also sent to the machine-readable output as an
+	// `ansible-event`. This enables a callback plugin shipped with Packer;
+	// the raw output is still written to the Packer log. By default, this is
+	// `false`.
+	StructuredOutput bool `mapstructure:"structured_output"`
+	// Also show the raw Ansible output when `structured_output` is enabled.
+	// By default, this is `false`.
+	ShowRawOutput bool `mapstructure:"show_raw_output"`
+	// Write a JSON report to this path when the run finishes, including when
+	// it fails. The report holds the start and end time and duration of the
+	// run and of every playbook, the Ansible version, the sanitized command
+	// line of every playbook, the play recap of every host and the name and
+	// message of every failed task. This enables a callback plugin shipped
+	// with Packer. By default, this is empty.
+	ReportFile string `mapstructure:"report_file"`
+	// Write the facts of the host to this path as a JSON object once the
+	// playbooks are done, such as `ansible_distribution`, `ansible_kernel` or
+	// `ansible_interfaces`. The facts are gathered by a closing playbook, so
+	// that they reflect the changes of the playbooks, and cached as JSON in a
+	// temporary directory from which they are copied. The closing playbook is
+	// neither shown nor part of `report_file`, and runs with the
+	// `extra_arguments` but the ones selecting what the playbooks run or how:
+	// `--tags`, `--skip-tags`, `--limit`, `--start-at-task`, `--check`,
+	// `--diff` and `--step`. With the generated inventory, it runs on
+	// `host_alias`. With `inventory_file`, it runs on `host_alias` if the
+	// playbooks ran on it, else on the only host they ran on; the build fails
+	// if they ran on several other hosts, or if the facts cannot be gathered,
+	// such as when the host is unreachable. The values of `sensitive_values`,
+	// of the sensitive variables and of the vault passwords are masked in the
+	// file. By default, this is empty.
+	FactsOutputFile string `mapstructure:"facts_output_file"`
+	// Write the custom stats set by the playbooks with the `set_stats`
+	// module to this path as a flat JSON object once the playbooks are done,
+	// for later provisioners and post-processors. The stats of the run and of
+	// the host are merged, so that `per_host` doesn't matter. This enables a
+	// callback plugin shipped with Packer. The values of `sensitive_values`,
+	// of the sensitive variables and of the vault passwords are masked in
+	// the file. By default, this is empty.
+	OutputsFile string `mapstructure:"outputs_file"`
+	// How long to wait for Ansible to stop after it has been sent an interrupt
+	// because the build was cancelled or timed out, before sending it a
+	// terminate signal. Defaults to `10s`.
+	InterruptGracePeriod time.Duration `mapstructure:"interrupt_grace_period"`
+	// How long to wait for Ansible to stop after it has been sent a terminate
+	// signal, before killing it. Defaults to `10s`.
+	TerminateGracePeriod time.Duration `mapstructure:"terminate_grace_period"`
+	// Retries a playbook when ansible-playbook fails with one of the given
+	// exit codes, for example because the guest dropped its SSH connection
+	// shortly after booting. See the [Retry](#retry) section below.
+	Retry ansiblecommon.RetryConfig `mapstructure:"retry"`
+	// Installs Ansible in a Python virtualenv and runs `command` and
+	// `galaxy_command` from it. See the [Virtualenv](#virtualenv) section
+	// below.
+	Virtualenv   *VirtualenvConfig `mapstructure:"virtualenv"`
 	userWasEmpty bool
 }
 
@@ -267,17 +423,44 @@ type Provisioner struct {
 	done              chan struct{}
 	ansibleVersion    string
 	ansibleMajVersion uint
+	pythonVersion     string
+	versionChecked    bool
 	generatedData     map[string]interface{}
+	callbackPluginDir string
+	factsCacheDir     string
+	extraVarsFile     string
+	vaultArgs         []string
+	report            *ansiblecommon.Report
+	outputs           *ansiblecommon.Outputs
+	// The hosts in the play recaps of the playbooks, among which is the
+	// host of facts_output_file with a user inventory file.
+	provisionedHosts map[string]bool
+	galaxyReqs       *ansiblecommon.GalaxyRequirements
+	galaxyCacheEntry string
+	redactor         *ansiblecommon.Redactor
+	// Set when the inventory file was generated by Packer and can be
+	// regenerated if the proxy adapter moves to another port.
+	generatedInventory bool
+	// The arguments Packer itself adds to extra_arguments, such as the
+	// WinRM scheme of ansible_winrm_use_http.
+	internalArgs []string
 
 	setupAdapterFunc   func(ui packersdk.Ui, comm packersdk.Communicator) (string, error)
-	executeAnsibleFunc func(ui packersdk.Ui, comm packersdk.Communicator, privKeyFile string) error
+	executeAnsibleFunc func(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator, privKeyFile string) error
 }
 
-func (p *Provisioner) ConfigSpec() hcldec.ObjectSpec { return p.config.FlatMapstructure().HCL2Spec() }
+func (p *Provisioner) ConfigSpec() hcldec.ObjectSpec {
+	spec := ansiblecommon.DynamicAttributes(p.config.FlatMapstructure().HCL2Spec(), "extra_vars", "host_vars", "group_vars")
+	spec["group_children"] = ansiblecommon.GroupChildrenSpec("group_children")
+	return spec
+}
 
 func (p *Provisioner) Prepare(raws ...interface{}) error {
 	p.done = make(chan struct{})
 
+	if err := ansiblecommon.DecodeDynamicValues(&p.config, raws); err != nil {
+		return err
+	}
 	err := config.Decode(&p.config, &config.DecodeOpts{
 		PluginType:         "ansible",
 		Interpolate:        true,
@@ -305,17 +488,51 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 		p.config.HostAlias = "default"
 	}
 
+	if p.config.InterruptGracePeriod == 0 {
+		p.config.InterruptGracePeriod = ansiblecommon.DefaultInterruptGracePeriod
+	}
+
+	if p.config.TerminateGracePeriod == 0 {
+		p.config.TerminateGracePeriod = ansiblecommon.DefaultTerminateGracePeriod
+	}
+
 	var errs *packersdk.MultiError
-	err = validateFileConfig(p.config.PlaybookFile, "playbook_file", true)
-	if err != nil {
-		errs = packersdk.MultiErrorAppend(errs, err)
+	errs = packersdk.MultiErrorAppend(errs, p.config.Retry.Prepare()...)
+	errs = packersdk.MultiErrorAppend(errs, p.config.VaultConfig.Prepare()...)
+
+	if p.config.Virtualenv != nil {
+		errs = packersdk.MultiErrorAppend(errs, p.config.Virtualenv.Prepare()...)
 	}
 
-	// Check that the galaxy file exists, if configured
+	// Check that either playbook_file or playbook_files is specified
+	if len(p.config.PlaybookFiles) != 0 && p.config.PlaybookFile != "" {
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("Either playbook_file or playbook_files can be specified, not both"))
+	}
+	if len(p.config.PlaybookFiles) == 0 {
+		err = validateFileConfig(p.config.PlaybookFile, "playbook_file", true)
+		if err != nil {
+			errs = packersdk.MultiErrorAppend(errs, err)
+		}
+	}
+	for _, playbookFile := range p.config.PlaybookFiles {
+		if err := validateFileConfig(playbookFile, "playbook_files", true); err != nil {
+			errs = packersdk.MultiErrorAppend(errs, err)
+		}
+	}
+
+	// Check that the galaxy file exists and is valid, if configured
+	p.galaxyReqs = nil
 	if len(p.config.GalaxyFile) > 0 {
 		err = validateFileConfig(p.config.GalaxyFile, "galaxy_file", true)
 		if err != nil {
 			errs = packersdk.MultiErrorAppend(errs, err)
+		} else if p.galaxyReqs, err = ansiblecommon.ParseGalaxyFile(p.config.GalaxyFile); err != nil {
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("galaxy_file: %s", err))
+		}
+	}
+	if p.config.GalaxyCacheDir != "" {
+		if p.config.GalaxyCacheDir, err = filepath.Abs(p.config.GalaxyCacheDir); err != nil {
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("galaxy_cache_dir: %s", err))
 		}
 	}
 
@@ -345,6 +562,25 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("local_port: %d must be a valid port", p.config.LocalPort))
 	}
 
+	switch p.config.InventoryFormat {
+	case "":
+		p.config.InventoryFormat = "ini"
+	case "ini", "yaml":
+	default:
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf(
+			"Invalid value for inventory_format: %q. Supported values are ini or yaml.", p.config.InventoryFormat))
+	}
+	if p.config.InventoryFormat == "yaml" {
+		if p.config.InventoryFileTemplate != "" {
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("inventory_file_template can't be used with inventory_format yaml"))
+		}
+	} else if len(p.config.HostVars) > 0 || len(p.config.GroupVars) > 0 {
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("host_vars and group_vars require inventory_format yaml"))
+	}
+	if err := p.inventory(nil).Validate(); err != nil {
+		errs = packersdk.MultiErrorAppend(errs, err)
+	}
+
 	if len(p.config.InventoryDirectory) > 0 {
 		err = validateInventoryDirectoryConfig(p.config.InventoryDirectory)
 		if err != nil {
@@ -353,11 +589,23 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 		}
 	}
 
-	if !p.config.SkipVersionCheck {
-		err = p.getVersion()
+	if p.config.AnsibleVersionConstraint != "" {
+		if _, err := version.NewConstraint(p.config.AnsibleVersionConstraint); err != nil {
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("ansible_version_constraint: %s", err))
+		} else if p.config.SkipVersionCheck {
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("ansible_version_constraint can't be used with skip_version_check"))
+		}
+	}
+
+	// The version of a virtualenv is checked once it is selected by the
+	// version of its python, by Provision.
+	p.versionChecked = false
+	if !p.config.SkipVersionCheck && p.config.Virtualenv == nil {
+		err = p.getVersion(context.Background())
 		if err != nil {
 			errs = packersdk.MultiErrorAppend(errs, err)
 		}
+		p.versionChecked = true
 	}
 
 	if p.config.User == "" {
@@ -389,13 +637,26 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 	p.config.AdapterKeyType = strings.ToUpper(p.config.AdapterKeyType)
 
 	switch p.config.AdapterKeyType {
-	case "RSA", "ECDSA":
+	case "RSA":
+		if p.config.AdapterKeyBits == 0 {
+			p.config.AdapterKeyBits = 2048
+		}
+		if p.config.AdapterKeyBits < 2048 {
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf(
+				"ansible_proxy_key_bits must be at least 2048, got %d", p.config.AdapterKeyBits))
+		}
+	case "ECDSA", "ED25519":
+		if p.config.AdapterKeyBits != 0 {
+			errs = packersdk.MultiErrorAppend(errs, fmt.Errorf(
+				"ansible_proxy_key_bits can only be set when ansible_proxy_key_type is RSA"))
+		}
 	default:
 		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf(
-			"Invalid value for ansible_proxy_key_type: %q. Supported values are ECDSA or RSA.",
+			"Invalid value for ansible_proxy_key_type: %q. Supported values are ECDSA, ED25519 or RSA.",
 			p.config.AdapterKeyType))
 	}
 
+	p.internalArgs = nil
 	if p.config.WinRMUseHTTP {
 		addWinRMScheme := true
 		for _, arg := range p.config.ExtraArguments {
@@ -407,52 +668,86 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 		}
 		if addWinRMScheme {
 			log.Printf("setting http as winrm scheme")
-			p.config.ExtraArguments = append(p.config.ExtraArguments, "-e", "ansible_winrm_scheme=http")
+			p.internalArgs = append(p.internalArgs, "-e", "ansible_winrm_scheme=http")
 		}
 	}
 
+	ansiblecommon.FilterLogs(p.sensitiveValues()...)
+
 	if errs != nil && len(errs.Errors) > 0 {
 		return errs
 	}
 	return nil
 }
 
-func (p *Provisioner) getVersion() error {
-	out, err := exec.Command(p.config.Command, "--version").Output()
+func (p *Provisioner) getVersion(ctx context.Context) error {
+	out, err := versionCommand(ctx, p.config.Command).Output()
 	if err != nil {
 		return fmt.Errorf(
 			"Error running \"%s --version\": %s", p.config.Command, err.Error())
 	}
 
-	versionRe := regexp.MustCompile(`\w (\d+\.\d+[.\d+]*)`)
-	matches := versionRe.FindStringSubmatch(string(out))
-	if matches == nil {
-		return fmt.Errorf(
-			"Could not find %s version in output:\n%s", p.config.Command, string(out))
+	v, err := ansiblecommon.ParseAnsibleVersion(string(out))
+	if err != nil {
+		return fmt.Errorf("%s: %s", p.config.Command, err)
 	}
+	v.Community = p.communityVersion(ctx)
+	log.Printf("%s version: %s", p.config.Command, v)
 
-	version := matches[1]
-	log.Printf("%s version: %s", p.config.Command, version)
-	p.ansibleVersion = version
-
-	majVer, err := strconv.ParseUint(strings.Split(version, ".")[0], 10, 0)
-	if err != nil {
-		return fmt.Errorf("Could not parse major version from \"%s\".", version)
+	p.ansibleVersion = v.Core.Original()
+	p.ansibleMajVersion = uint(v.Major())
+	p.pythonVersion = ""
+	if v.Python != nil {
+		p.pythonVersion = v.Python.Original()
 	}
-	p.ansibleMajVersion = uint(majVer)
 
+	if p.config.AnsibleVersionConstraint != "" {
+		if err := v.Check(p.config.AnsibleVersionConstraint); err != nil {
+			return fmt.Errorf("ansible_version_constraint: %s: %s", p.config.Command, err)
+		}
+	}
 	return nil
 }
 
+// versionCommand returns the command printing the version of command, killed
+// once ctx is done even if its children keep its output open.
+func versionCommand(ctx context.Context, command string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, command, "--version")
+	cmd.WaitDelay = time.Second
+	return cmd
+}
+
+// communityVersion returns the version of the ansible community package
+// installed along with the command, if any.
+func (p *Provisioner) communityVersion(ctx context.Context) *version.Version {
+	command := "ansible-community"
+	if path, err := exec.LookPath(p.config.Command); err == nil {
+		sibling := filepath.Join(filepath.Dir(path), command)
+		if _, err := os.Stat(sibling); err == nil {
+			command = sibling
+		}
+	}
+	out, err := versionCommand(ctx, command).Output()
+	if err != nil {
+		return nil
+	}
+	v, err := ansiblecommon.ParseCommunityVersion(string(out))
+	if err != nil {
+		log.Printf("%s", err)
+		return nil
+	}
+	return v
+}
+
 func (p *Provisioner) setupAdapter(ui packersdk.Ui, comm packersdk.Communicator) (string, error) {
 	ui.Say("Setting up proxy adapter for Ansible....")
 
-	k, err := newUserKey(p.config.SSHAuthorizedKeyFile, p.config.AdapterKeyType)
+	k, err := newUserKey(p.config.SSHAuthorizedKeyFile, p.config.AdapterKeyType, p.config.AdapterKeyBits)
 	if err != nil {
 		return "", err
 	}
 
-	hostSigner, err := newSigner(p.config.SSHHostKeyFile, p.config.AdapterKeyType)
+	hostSigner, err := newSigner(p.config.SSHHostKeyFile, p.config.AdapterKeyType, p.config.AdapterKeyBits)
 	if err != nil {
 		return "", fmt.Errorf("error creating host signer: %s", err)
 	}
@@ -530,6 +825,10 @@ const DefaultWinRMInventoryFilev2 = "{{ .HostAlias}} ansible_host={{ .Host }} an
 
 func (p *Provisioner) createInventoryFile() error {
 	log.Printf("Creating inventory file for Ansible run...")
+	if p.config.InventoryFormat == "yaml" {
+		return p.createYAMLInventoryFile()
+	}
+
 	tf, err := os.CreateTemp(p.config.InventoryDirectory, "packer-provisioner-ansible")
 	if err != nil {
 		return fmt.Errorf("Error preparing inventory file: %s", err)
@@ -568,16 +867,8 @@ func (p *Provisioner) createInventoryFile() error {
 		log.Printf("[TRACE] error writing the generated inventory file: %s", err)
 	}
 
-	for _, group := range p.config.Groups {
-		if _, err := fmt.Fprintf(w, "[%s]\n%s", group, host); err != nil {
-			log.Printf("[TRACE] error writing group %q to generated inventory file: %s", group, err)
-		}
-	}
-
-	for _, group := range p.config.EmptyGroups {
-		if _, err := fmt.Fprintf(w, "[%s]\n", group); err != nil {
-			log.Printf("[TRACE] error writing empty group %q to generated inventory file: %s", group, err)
-		}
+	if _, err := w.WriteString(p.inventory(nil).INIGroups(host)); err != nil {
+		log.Printf("[TRACE] error writing groups to generated inventory file: %s", err)
 	}
 
 	if err := w.Flush(); err != nil {
@@ -597,8 +888,128 @@ func (p *Provisioner) createInventoryFile() error {
 	return nil
 }
 
+// inventory returns the inventory of the host, connVars being its connection
+// variables.
+func (p *Provisioner) inventory(connVars map[string]interface{}) *ansiblecommon.Inventory {
+	hostVars := make(map[string]interface{}, len(connVars)+len(p.config.HostVars))
+	for k, v := range connVars {
+		hostVars[k] = v
+	}
+	for k, v := range p.config.HostVars {
+		hostVars[k] = v
+	}
+	return &ansiblecommon.Inventory{
+		Host:          p.config.HostAlias,
+		HostVars:      hostVars,
+		Groups:        p.config.Groups,
+		EmptyGroups:   p.config.EmptyGroups,
+		GroupChildren: p.config.GroupChildren,
+		GroupVars:     p.config.GroupVars,
+	}
+}
+
+func (p *Provisioner) createYAMLInventoryFile() error {
+	connVars := map[string]interface{}{
+		"ansible_host": p.generatedData["Host"],
+		"ansible_user": p.config.User,
+		"ansible_port": p.generatedData["Port"],
+	}
+	if !p.config.UseProxy.False() {
+		connVars["ansible_host"] = "127.0.0.1"
+		connVars["ansible_port"] = p.config.LocalPort
+	} else if p.generatedData["ConnType"] == "winrm" {
+		connVars["ansible_connection"] = "winrm"
+		connVars["ansible_winrm_transport"] = "basic"
+		connVars["ansible_shell_type"] = "powershell"
+	}
+
+	b, err := p.inventory(connVars).YAML()
+	if err != nil {
+		return fmt.Errorf("Error generating inventory file: %s", err)
+	}
+
+	tf, err := os.CreateTemp(p.config.InventoryDirectory, "packer-provisioner-ansible*.yml")
+	if err != nil {
+		return fmt.Errorf("Error preparing inventory file: %s", err)
+	}
+	if _, err := tf.Write(b); err != nil {
+		_ = tf.Close()
+		_ = os.Remove(tf.Name())
+		return fmt.Errorf("Error preparing inventory file: %s", err)
+	}
+	if err := tf.Close(); err != nil {
+		log.Printf("[TRACE] error closing generated inventory file: %s", err)
+	}
+	p.config.InventoryFile = tf.Name()
+
+	return nil
+}
+
 func (p *Provisioner) Provision(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator, generatedData map[string]interface{}) error {
+	p.redactor = ansiblecommon.NewRedactor(p.sensitiveValues()...)
+	ui = &ansiblecommon.RedactingUi{Ui: ui, Redactor: p.redactor}
+	finishReport := p.startReport(ui)
+	err := p.redactor.Error(p.provision(ctx, ui, comm, generatedData))
+	finishReport(err)
+	return err
+}
+
+// startReport starts the report of report_file, if any, before anything can
+// fail. The returned function finishes the report with the error of the
+// run and writes it.
+func (p *Provisioner) startReport(ui packersdk.Ui) func(err error) {
+	if p.config.ReportFile == "" {
+		return func(error) {}
+	}
+	p.report = ansiblecommon.NewReport("")
+	p.report.Redactor = p.redactor
+	return func(err error) {
+		// The versions are only known once the virtualenv is created.
+		p.report.AnsibleVersion = p.ansibleVersion
+		p.report.PythonVersion = p.pythonVersion
+		p.report.Finish(err)
+		if writeErr := p.report.WriteFile(p.config.ReportFile); writeErr != nil {
+			ui.Error(fmt.Sprintf("Error writing report file: %s", writeErr))
+		}
+		p.report = nil
+	}
+}
+
+// sensitiveValues returns the values of the sensitive variables of the
+// template, sensitive_values and the vault passwords, which are masked in
+// the output.
+func (p *Provisioner) sensitiveValues() []string {
+	values := append([]string{}, p.config.PackerSensitiveVars...)
+	values = append(values, p.config.SensitiveValues...)
+	return append(values, p.config.VaultConfig.Passwords()...)
+}
+
+// prepareVirtualenv creates the virtualenv if needed, runs the Ansible
+// commands from it and checks their version.
+func (p *Provisioner) prepareVirtualenv(ctx context.Context, ui packersdk.Ui) error {
+	if err := p.config.Virtualenv.Create(ctx, ui,
+		p.config.InterruptGracePeriod, p.config.TerminateGracePeriod); err != nil {
+		return err
+	}
+	p.config.Command = p.config.Virtualenv.Command(p.config.Command)
+	p.config.GalaxyCommand = p.config.Virtualenv.Command(p.config.GalaxyCommand)
+	if !p.config.SkipVersionCheck && !p.versionChecked {
+		if err := p.getVersion(ctx); err != nil {
+			return err
+		}
+		p.versionChecked = true
+	}
+	return nil
+}
+
+func (p *Provisioner) provision(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator, generatedData map[string]interface{}) error {
 	ui.Say("Provisioning with Ansible...")
+	if p.config.Virtualenv != nil {
+		if err := p.prepareVirtualenv(ctx, ui); err != nil {
+			return err
+		}
+	}
+
 	// Interpolate env vars to check for generated values like password and port
 	p.generatedData = generatedData
 	p.config.ctx.Data = generatedData
@@ -708,6 +1119,7 @@ func (p *Provisioner) Provision(ctx context.Context, ui packersdk.Ui, comm packe
 		if err != nil {
 			return err
 		}
+		p.generatedInventory = true
 		if !p.config.KeepInventoryFile {
 			// Delete the generated inventory file
 			defer func() {
@@ -717,128 +1129,160 @@ func (p *Provisioner) Provision(ctx context.Context, ui packersdk.Ui, comm packe
 		}
 	}
 
-	if err := p.executeAnsibleFunc(ui, comm, privKeyFile); err != nil {
-		return fmt.Errorf("Error executing Ansible: %s", err)
+	if err := p.executeAnsibleFunc(ctx, ui, comm, privKeyFile); err != nil {
+		return fmt.Errorf("Error executing Ansible: %w", err)
 	}
 
 	return nil
 }
 
-func (p *Provisioner) executeGalaxy(ui packersdk.Ui, comm packersdk.Communicator) error {
-	galaxyFile := filepath.ToSlash(p.config.GalaxyFile)
-
-	// ansible-galaxy install -r requirements.yml
-	roleArgs := []string{"install", "-r", galaxyFile}
-	// Instead of modifying args depending on config values and removing or modifying values from
-	// the slice between role and collection installs, just use 2 slices and simplify everything
-	collectionArgs := []string{"collection", "install", "-r", galaxyFile}
+func (p *Provisioner) executeGalaxy(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator) error {
+	var flags []string
 	// Add force to arguments
 	if p.config.GalaxyForceInstall {
-		roleArgs = append(roleArgs, "-f")
-		collectionArgs = append(collectionArgs, "-f")
+		flags = append(flags, "-f")
 	}
 	// Add --force-with-deps to arguments
 	if p.config.GalaxyForceWithDeps {
-		roleArgs = append(roleArgs, "--force-with-deps")
-		collectionArgs = append(collectionArgs, "--force-with-deps")
+		flags = append(flags, "--force-with-deps")
 	}
 
-	// Add roles_path argument if specified
-	if p.config.RolesPath != "" {
-		roleArgs = append(roleArgs, "-p", filepath.ToSlash(p.config.RolesPath))
-	}
-	// Add collections_path argument if specified
-	if p.config.CollectionsPath != "" {
-		collectionArgs = append(collectionArgs, "-p", filepath.ToSlash(p.config.CollectionsPath))
+	if p.config.GalaxyCacheDir == "" {
+		return p.installGalaxy(ctx, ui, comm, flags, p.config.RolesPath, p.config.CollectionsPath)
 	}
 
-	// Search galaxy_file for roles and collections keywords
-	f, err := os.ReadFile(galaxyFile)
+	// The parsed requirements have the included files inlined, so that a
+	// change to any of them changes the cache key.
+	requirements, err := p.galaxyReqs.YAML()
 	if err != nil {
 		return err
 	}
-	hasRoles, _ := regexp.Match(`(?m)^roles:`, f)
-	hasCollections, _ := regexp.Match(`(?m)^collections:`, f)
 
-	// If roles keyword present (v2 format), or no collections keyword present (v1), install roles
-	if hasRoles || !hasCollections {
-		if roleInstallError := p.invokeGalaxyCommand(roleArgs, ui, comm); roleInstallError != nil {
-			return roleInstallError
-		}
+	version, err := p.galaxyVersion(ctx)
+	if err != nil {
+		return err
 	}
-
-	// If collections keyword present (v2 format), install collections
-	if hasCollections {
-		if collectionInstallError := p.invokeGalaxyCommand(collectionArgs, ui, comm); collectionInstallError != nil {
-			return collectionInstallError
-		}
+	cache := &ansiblecommon.GalaxyCache{Dir: p.config.GalaxyCacheDir}
+	key, err := ansiblecommon.GalaxyCacheKey(requirements, version, flags, p.galaxyEnv(), p.galaxyReqs.LocalSources())
+	if err != nil {
+		return err
 	}
-
+	if dir, ok := cache.Get(key); ok {
+		ui.Say(fmt.Sprintf("Using the galaxy requirements cached in %s", dir))
+		p.galaxyCacheEntry = dir
+		return nil
+	}
+	ui.Say(fmt.Sprintf("Caching the galaxy requirements in %s", cache.Entry(key)))
+	dir, err := cache.Fill(key, func(dir string) error {
+		return p.installGalaxy(ctx, ui, comm, flags,
+			filepath.Join(dir, ansiblecommon.GalaxyRoles), filepath.Join(dir, ansiblecommon.GalaxyCollections))
+	})
+	if err != nil {
+		return err
+	}
+	p.galaxyCacheEntry = dir
 	return nil
 }
 
-// Intended to be invoked from p.executeGalaxy depending on the Ansible Galaxy parameters passed to Packer
-func (p *Provisioner) invokeGalaxyCommand(args []string, ui packersdk.Ui, comm packersdk.Communicator) error {
-	ui.Say("Executing Ansible Galaxy")
-	cmd := exec.Command(p.config.GalaxyCommand, args...)
+// installGalaxy installs the requirements of galaxy_file with ansible-galaxy
+// into rolesPath and collectionsPath, or the ansible-galaxy default paths
+// when they are empty. ansible-galaxy reads galaxy_file itself, so that the
+// relative paths in it are resolved as usual.
+func (p *Provisioner) installGalaxy(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator, flags []string, rolesPath, collectionsPath string) error {
+	for _, step := range p.galaxyReqs.Steps(filepath.ToSlash(p.config.GalaxyFile)) {
+		args := append(step.Args, flags...)
+		// Add roles_path or collections_path argument if specified
+		if step.Kind == ansiblecommon.GalaxyRoles && rolesPath != "" {
+			args = append(args, "-p", filepath.ToSlash(rolesPath))
+		}
+		if step.Kind == ansiblecommon.GalaxyCollections && collectionsPath != "" {
+			args = append(args, "-p", filepath.ToSlash(collectionsPath))
+		}
 
-	// Setting up AnsibleEnvVars at beginning so additional checks can take them into account
-	cmd.Env = os.Environ()
-	if len(p.config.AnsibleEnvVars) > 0 {
-		cmd.Env = append(cmd.Env, p.config.AnsibleEnvVars...)
+		galaxyUi := &ansiblecommon.GalaxyUi{Ui: ui, Step: step}
+		galaxyUi.Start()
+		if err := p.invokeGalaxyCommand(ctx, args, galaxyUi, comm); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return err
-	}
-	stderr, err := cmd.StderrPipe()
+// galaxyVersion returns the output of `ansible-galaxy --version`, which
+// identifies the ansible-galaxy installing the requirements.
+func (p *Provisioner) galaxyVersion(ctx context.Context) (string, error) {
+	cmd := exec.CommandContext(ctx, p.config.GalaxyCommand, "--version")
+	cmd.Env = p.galaxyEnv()
+	out, err := cmd.Output()
 	if err != nil {
-		return err
-	}
-	wg := sync.WaitGroup{}
-	repeat := func(r io.ReadCloser) {
-		reader := bufio.NewReader(r)
-		for {
-			line, err := reader.ReadString('\n')
-			if line != "" {
-				line = strings.TrimRightFunc(line, unicode.IsSpace)
-				ui.Say(line)
-			}
-			if err != nil {
-				if err == io.EOF {
-					break
-				} else {
-					ui.Error(err.Error())
-					break
-				}
-			}
-		}
-		wg.Done()
+		return "", fmt.Errorf("%s --version: %s", p.config.GalaxyCommand, err)
 	}
-	wg.Add(2)
-	go repeat(stdout)
-	go repeat(stderr)
+	return string(out), nil
+}
 
-	if err := cmd.Start(); err != nil {
-		return err
+func (p *Provisioner) galaxyEnv() []string {
+	env := os.Environ()
+	if p.config.Virtualenv != nil {
+		env = append(env, p.config.Virtualenv.Env()...)
 	}
-	wg.Wait()
-	err = cmd.Wait()
-	if err != nil {
-		return fmt.Errorf("Non-zero exit status: %s", err)
+	return append(env, p.config.AnsibleEnvVars...)
+}
+
+// The Ansible default roles and collections paths, searched after the cached
+// galaxy requirements when roles_path and collections_path are not set.
+const (
+	defaultRolesPath       = "~/.ansible/roles:/usr/share/ansible/roles:/etc/ansible/roles"
+	defaultCollectionsPath = "~/.ansible/collections:/usr/share/ansible/collections"
+)
+
+// galaxyCachePath returns the search path of the kind of galaxy requirements
+// cached in entry, followed by path or defaultPath if path is empty.
+func galaxyCachePath(entry, kind, path, defaultPath string) string {
+	if path == "" {
+		path = defaultPath
 	}
-	return nil
+	return filepath.Join(entry, kind) + string(os.PathListSeparator) + path
+}
+
+// Intended to be invoked from p.executeGalaxy depending on the Ansible Galaxy parameters passed to Packer
+func (p *Provisioner) invokeGalaxyCommand(ctx context.Context, args []string, ui packersdk.Ui, comm packersdk.Communicator) error {
+	ui.Say("Executing Ansible Galaxy")
+	// Setting up AnsibleEnvVars at beginning so additional checks can take them into account
+	return ansiblecommon.RunHostGalaxy(ctx, ui, p.config.GalaxyCommand, args, p.galaxyEnv(),
+		p.config.InterruptGracePeriod, p.config.TerminateGracePeriod)
 }
 
 func (p *Provisioner) createCmdArgs(httpAddr, inventory, playbook, privKeyFile string) (args []string, envVars []string) {
 	args = []string{}
 
+	if p.config.Virtualenv != nil {
+		envVars = append(envVars, p.config.Virtualenv.Env()...)
+	}
+
+	// The cached galaxy requirements come first, ansible_env_vars can still
+	// override the paths.
+	if p.galaxyCacheEntry != "" {
+		envVars = append(envVars,
+			"ANSIBLE_ROLES_PATH="+galaxyCachePath(p.galaxyCacheEntry, ansiblecommon.GalaxyRoles, p.config.RolesPath, defaultRolesPath),
+			"ANSIBLE_COLLECTIONS_PATH="+galaxyCachePath(p.galaxyCacheEntry, ansiblecommon.GalaxyCollections, p.config.CollectionsPath, defaultCollectionsPath))
+	}
+
 	// Setting up AnsibleEnvVars at beginning so additional checks can take them into account
 	if len(p.config.AnsibleEnvVars) > 0 {
 		envVars = append(envVars, p.config.AnsibleEnvVars...)
 	}
 
+	if p.callbackPluginDir != "" {
+		// The callbacks enabled in the environment of Packer or in
+		// ansible_env_vars stay enabled.
+		env := append(os.Environ(), envVars...)
+		envVars = append(envVars, ansiblecommon.CallbackEnvVars(p.callbackPluginDir, env)...)
+	}
+
+	if p.factsCacheDir != "" {
+		envVars = append(envVars, ansiblecommon.FactsCacheEnvVars(p.factsCacheDir)...)
+	}
+
 	if p.config.PackerBuildName != "" {
 		// HCL configs don't currently have the PakcerBuildName. Don't
 		// cause weirdness with a half-set variable
@@ -852,6 +1296,11 @@ func (p *Provisioner) createCmdArgs(httpAddr, inventory, playbook, privKeyFile s
 		args = append(args, "-e", fmt.Sprintf("packer_http_addr=%s", httpAddr))
 	}
 
+	if p.extraVarsFile != "" {
+		args = append(args, "-e", "@"+p.extraVarsFile)
+	}
+	args = append(args, p.vaultArgs...)
+
 	if p.generatedData["ConnType"] == "ssh" && len(privKeyFile) > 0 {
 		// Add ssh extra args to set IdentitiesOnly
 		if len(p.config.AnsibleSSHExtraArgs) > 0 {
@@ -861,7 +1310,14 @@ func (p *Provisioner) createCmdArgs(httpAddr, inventory, playbook, privKeyFile s
 		}
 	}
 
-	args = append(args, p.config.ExtraArguments...)
+	// The closing playbook gathering the facts only needs the extra
+	// arguments with which the playbooks reached the host.
+	if p.factsCacheDir == "" {
+		args = append(args, p.config.ExtraArguments...)
+	} else {
+		args = append(args, ansiblecommon.FactsArgs(p.config.ExtraArguments)...)
+	}
+	args = append(args, p.internalArgs...)
 
 	// Add password to ansible call.
 	if !checkArg("ansible_password", args) && p.config.UseProxy.False() && p.generatedData["ConnType"] == "winrm" {
@@ -885,20 +1341,272 @@ func (p *Provisioner) createCmdArgs(httpAddr, inventory, playbook, privKeyFile s
 	return args, envVars
 }
 
-func (p *Provisioner) executeAnsible(ui packersdk.Ui, comm packersdk.Communicator, privKeyFile string) error {
-	playbook, _ := filepath.Abs(p.config.PlaybookFile)
-	inventory := p.config.InventoryFile
-	httpAddr := p.generatedData["PackerHTTPAddr"].(string)
+// playbooks returns the absolute paths of the playbooks to run, in order.
+func (p *Provisioner) playbooks() []string {
+	playbookFiles := p.config.PlaybookFiles
+	if p.config.PlaybookFile != "" {
+		playbookFiles = []string{p.config.PlaybookFile}
+	}
+	playbooks := make([]string, 0, len(playbookFiles))
+	for _, playbookFile := range playbookFiles {
+		playbook, _ := filepath.Abs(playbookFile)
+		playbooks = append(playbooks, playbook)
+	}
+	return playbooks
+}
+
+func (p *Provisioner) executeAnsible(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator, privKeyFile string) error {
+	if p.config.OutputsFile != "" {
+		p.outputs = ansiblecommon.NewOutputs()
+		p.outputs.Redactor = p.redactor
+		defer func() {
+			p.outputs = nil
+		}()
+	}
+	if p.config.FactsOutputFile != "" {
+		p.provisionedHosts = map[string]bool{}
+		defer func() {
+			p.provisionedHosts = nil
+		}()
+	}
 
 	// Fetch external dependencies
 	if len(p.config.GalaxyFile) > 0 {
-		if err := p.executeGalaxy(ui, comm); err != nil {
+		defer func() {
+			p.galaxyCacheEntry = ""
+		}()
+		if err := p.executeGalaxy(ctx, ui, comm); err != nil {
 			return fmt.Errorf("Error executing Ansible Galaxy: %s", err)
 		}
 	}
+
+	if p.usesCallbackPlugin() {
+		dir, err := tmp.Dir("packer-provisioner-ansible")
+		if err != nil {
+			return fmt.Errorf("Error preparing callback plugin: %s", err)
+		}
+		defer func() {
+			_ = os.RemoveAll(dir)
+			p.callbackPluginDir = ""
+		}()
+		if err := ansiblecommon.WriteCallbackPlugin(dir); err != nil {
+			return fmt.Errorf("Error preparing callback plugin: %s", err)
+		}
+		p.callbackPluginDir = dir
+	}
+
+	if len(p.config.ExtraVars) > 0 {
+		file, err := p.writeExtraVarsFile()
+		if err != nil {
+			return fmt.Errorf("Error writing extra_vars file: %s", err)
+		}
+		p.extraVarsFile = file
+		defer func() {
+			_ = os.Remove(file)
+			p.extraVarsFile = ""
+		}()
+	}
+
+	var vaultFiles []string
+	defer func() {
+		for _, file := range vaultFiles {
+			_ = os.Remove(file)
+		}
+		p.vaultArgs = nil
+	}()
+	vaultArgs, err := p.config.VaultConfig.Args(func(name string, content []byte, mode os.FileMode) (string, error) {
+		file, err := ansiblecommon.WriteTempFile("packer-"+name+"-*", content, mode)
+		if err == nil {
+			vaultFiles = append(vaultFiles, file)
+		}
+		return file, err
+	}, false)
+	if err != nil {
+		return fmt.Errorf("Error writing vault password files: %s", err)
+	}
+	p.vaultArgs = vaultArgs
+
+	// Key files of rebuilt proxy adapters are removed here, the original one
+	// is removed by Provision.
+	origPrivKeyFile := privKeyFile
+	defer func() {
+		if privKeyFile != origPrivKeyFile {
+			_ = os.Remove(privKeyFile)
+		}
+	}()
+
+	for _, playbook := range p.playbooks() {
+		err := p.config.Retry.Run(ctx, ui, "Playbook "+playbook, func(attempt int) (int, error) {
+			if attempt > 1 {
+				pkf, err := p.checkAdapter(ui, comm, privKeyFile)
+				if err != nil {
+					return -1, err
+				}
+				if pkf != privKeyFile && privKeyFile != origPrivKeyFile {
+					_ = os.Remove(privKeyFile)
+				}
+				privKeyFile = pkf
+			}
+			return p.executeAnsiblePlaybook(ctx, ui, comm, privKeyFile, playbook)
+		})
+		if err != nil {
+			return fmt.Errorf("Playbook %s failed: %w", playbook, err)
+		}
+	}
+
+	if p.config.FactsOutputFile != "" {
+		if err := p.writeFactsFile(ctx, ui, comm, privKeyFile); err != nil {
+			return fmt.Errorf("Error writing facts file: %s", err)
+		}
+	}
+
+	if p.outputs != nil {
+		if err := p.outputs.WriteFile(p.config.OutputsFile); err != nil {
+			return fmt.Errorf("Error writing outputs file: %s", err)
+		}
+	}
+	return nil
+}
+
+// writeFactsFile gathers the facts of the host with a closing playbook,
+// cached in a temporary directory, and writes them to facts_output_file.
+// The closing playbook isn't one of the playbooks: it is neither reported
+// nor shown, and only runs with the extra_arguments needed to reach the host.
+func (p *Provisioner) writeFactsFile(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator, privKeyFile string) error {
+	host := p.config.HostAlias
+	if !p.generatedInventory {
+		var err error
+		if host, err = ansiblecommon.FactsHost(host, p.provisionedHosts); err != nil {
+			return err
+		}
+	}
+
+	ui.Say(fmt.Sprintf("Gathering the facts of %s...", host))
+	dir, err := tmp.Dir("packer-provisioner-ansible-facts")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	playbook := filepath.Join(dir, ansiblecommon.FactsPlaybookFile)
+	if err := os.WriteFile(playbook, ansiblecommon.FactsPlaybook(host), 0644); err != nil {
+		return err
+	}
+
+	p.factsCacheDir = filepath.Join(dir, "cache")
+	defer func() {
+		p.factsCacheDir = ""
+	}()
+	quiet := &ansiblecommon.QuietUi{Ui: ui}
+	output := &ansiblecommon.EventUi{Ui: quiet, Structured: true}
+	if _, err := p.runAnsiblePlaybook(ctx, quiet, output, nil, privKeyFile, playbook); err != nil {
+		return err
+	}
+	cached, err := os.ReadFile(filepath.Join(p.factsCacheDir, ansiblecommon.FactsCacheFile(host)))
+	if err != nil {
+		return fmt.Errorf("no facts were gathered for %s: %s", host, err)
+	}
+	return ansiblecommon.WriteFactsFile(p.config.FactsOutputFile, cached, p.redactor)
+}
+
+// writeExtraVarsFile writes extra_vars to a temporary JSON file only
+// readable by the current user and returns its path.
+func (p *Provisioner) writeExtraVarsFile() (string, error) {
+	b, err := ansiblecommon.ExtraVarsJSON(p.config.ExtraVars)
+	if err != nil {
+		return "", err
+	}
+	return ansiblecommon.WriteTempFile("packer-extra-vars-*.json", b, 0600)
+}
+
+// checkAdapter makes sure that the proxy adapter, if any, still accepts
+// connections before a playbook is retried, and rebuilds it otherwise. It
+// returns the private key file Ansible must use.
+func (p *Provisioner) checkAdapter(ui packersdk.Ui, comm packersdk.Communicator, privKeyFile string) (string, error) {
+	if p.adapter == nil {
+		return privKeyFile, nil
+	}
+
+	addr := fmt.Sprintf("127.0.0.1:%d", p.config.LocalPort)
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err == nil {
+		_ = conn.Close()
+		log.Printf("reusing the SSH proxy on %s", addr)
+		return privKeyFile, nil
+	}
+
+	ui.Say(fmt.Sprintf("SSH proxy on %s is not reachable (%s), rebuilding it...", addr, err))
+	close(p.done)
+	p.adapter.Shutdown()
+	p.done = make(chan struct{})
+	port := p.config.LocalPort
+	pkf, err := p.setupAdapterFunc(ui, comm)
+	if err != nil {
+		return "", err
+	}
+	go p.adapter.Serve()
+
+	if p.config.LocalPort != port && p.generatedInventory {
+		old := p.config.InventoryFile
+		if err := p.createInventoryFile(); err != nil {
+			return "", err
+		}
+		if !p.config.KeepInventoryFile {
+			_ = os.Remove(old)
+		}
+	}
+	return pkf, nil
+}
+
+// usesCallbackPlugin reports whether the packer callback plugin is needed to
+// collect events from ansible-playbook.
+func (p *Provisioner) usesCallbackPlugin() bool {
+	return p.config.StructuredOutput || p.config.ReportFile != "" || p.config.OutputsFile != "" ||
+		p.config.FactsOutputFile != ""
+}
+
+// recordEvent passes an event of the callback plugin to the report and the
+// outputs, if any.
+func (p *Provisioner) recordEvent(ev *ansiblecommon.Event) {
+	if p.report != nil {
+		p.report.Record(ev)
+	}
+	if p.outputs != nil {
+		p.outputs.Record(ev)
+	}
+	if p.provisionedHosts != nil && ev.Event == "stats" {
+		for host := range ev.Stats {
+			p.provisionedHosts[host] = true
+		}
+	}
+}
+
+// executeAnsiblePlaybook runs a single playbook and returns the exit status
+// of ansible-playbook, or -1 if it didn't run.
+func (p *Provisioner) executeAnsiblePlaybook(ctx context.Context, ui packersdk.Ui, comm packersdk.Communicator, privKeyFile, playbook string) (int, error) {
+	output := &ansiblecommon.EventUi{
+		Ui:         ui,
+		Structured: p.config.StructuredOutput,
+		ShowRaw:    p.config.ShowRawOutput,
+	}
+	output.OnEvent = p.recordEvent
+	return p.runAnsiblePlaybook(ctx, ui, output, p.report, privKeyFile, playbook)
+}
+
+// runAnsiblePlaybook runs ansible-playbook on playbook with its output sent
+// to output, and records the run in report if it isn't nil.
+func (p *Provisioner) runAnsiblePlaybook(ctx context.Context, ui packersdk.Ui, output *ansiblecommon.EventUi, report *ansiblecommon.Report, privKeyFile, playbook string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	inventory := p.config.InventoryFile
+	httpAddr := p.generatedData["PackerHTTPAddr"].(string)
+
 	args, envvars := p.createCmdArgs(httpAddr, inventory, playbook, privKeyFile)
 
 	cmd := exec.Command(p.config.Command, args...)
+	ansiblecommon.SetProcessGroup(cmd)
 
 	cmd.Env = os.Environ()
 	if len(envvars) > 0 {
@@ -907,11 +1615,11 @@ func (p *Provisioner) executeAnsible(ui packersdk.Ui, comm packersdk.Communicato
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return err
+		return -1, err
 	}
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
-		return err
+		return -1, err
 	}
 
 	wg := sync.WaitGroup{}
@@ -921,7 +1629,7 @@ func (p *Provisioner) executeAnsible(ui packersdk.Ui, comm packersdk.Communicato
 			line, err := reader.ReadString('\n')
 			if line != "" {
 				line = strings.TrimRightFunc(line, unicode.IsSpace)
-				ui.Say(line)
+				output.Say(line)
 			}
 			if err != nil {
 				if err == io.EOF {
@@ -939,9 +1647,43 @@ func (p *Provisioner) executeAnsible(ui packersdk.Ui, comm packersdk.Communicato
 	go repeat(stderr)
 
 	// remove winrm password from command, if it's been added
-	flattenedCmd := strings.Join(cmd.Args, " ")
-	sanitized := flattenedCmd
+	ui.Say(fmt.Sprintf("Executing Ansible: %s", p.sanitize(strings.Join(cmd.Args, " "))))
+
+	if report != nil {
+		sanitizedArgs := make([]string, 0, len(cmd.Args))
+		for _, arg := range cmd.Args {
+			sanitizedArgs = append(sanitizedArgs, p.sanitize(arg))
+		}
+		report.StartPlaybook(playbook, sanitizedArgs)
+	}
 
+	if err := cmd.Start(); err != nil {
+		if report != nil {
+			report.FinishPlaybook(-1, err)
+		}
+		return -1, err
+	}
+	stop := ansiblecommon.StopOnCancel(ctx, ui, cmd.Process,
+		p.config.InterruptGracePeriod, p.config.TerminateGracePeriod)
+	wg.Wait()
+	err = cmd.Wait()
+	stop()
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	exitCode := cmd.ProcessState.ExitCode()
+	var exitErr *exec.ExitError
+	if ctx.Err() == nil && errors.As(err, &exitErr) {
+		err = output.ExitError(exitCode)
+	}
+	if report != nil {
+		report.FinishPlaybook(exitCode, err)
+	}
+	return exitCode, err
+}
+
+// sanitize hides the secrets passed to Ansible in s.
+func (p *Provisioner) sanitize(s string) string {
 	for _, arg := range p.config.ExtraArguments {
 		args := strings.SplitN(arg, "=", 2)
 		if len(args) != 2 {
@@ -949,7 +1691,7 @@ func (p *Provisioner) executeAnsible(ui packersdk.Ui, comm packersdk.Communicato
 		}
 		if strings.Contains(strings.ToLower(args[0]), "password") ||
 			strings.Contains(strings.ToLower(args[0]), "secret") {
-			sanitized = strings.Replace(sanitized,
+			s = strings.Replace(s,
 				args[1], "*****", -1)
 		}
 	}
@@ -957,22 +1699,11 @@ func (p *Provisioner) executeAnsible(ui packersdk.Ui, comm packersdk.Communicato
 	for _, key := range []string{"WinRMPassword", "Password"} {
 		secret, ok := p.generatedData[key]
 		if ok && secret != "" {
-			sanitized = strings.Replace(sanitized,
+			s = strings.Replace(s,
 				secret.(string), "*****", -1)
 		}
 	}
-	ui.Say(fmt.Sprintf("Executing Ansible: %s", sanitized))
-
-	if err := cmd.Start(); err != nil {
-		return err
-	}
-	wg.Wait()
-	err = cmd.Wait()
-	if err != nil {
-		return fmt.Errorf("Non-zero exit status: %s", err)
-	}
-
-	return nil
+	return s
 }
 
 func validateFileConfig(name string, config string, req bool) error {
@@ -1005,7 +1736,7 @@ type userKey struct {
 	privKeyFile string
 }
 
-func newUserKey(pubKeyFile string, keyType string) (*userKey, error) {
+func newUserKey(pubKeyFile string, keyType string, keyBits int) (*userKey, error) {
 	userKey := new(userKey)
 	if len(pubKeyFile) > 0 {
 		pubKeyBytes, err := os.ReadFile(pubKeyFile)
@@ -1025,86 +1756,62 @@ func newUserKey(pubKeyFile string, keyType string) (*userKey, error) {
 		return nil, errors.New("failed to create temp file for generated key")
 	}
 
-	switch keyType {
-	case "RSA":
-		err = generateRSAKeyToFile(userKey, tf)
-	case "ECDSA":
-		err = generateECDSAKeyToFile(userKey, tf)
-	default:
-		err = fmt.Errorf("unknown key type: %q", keyType)
-	}
+	privKey, err := generateKey(keyType, keyBits)
 	if err != nil {
 		return nil, err
 	}
-
-	err = tf.Close()
+	userKey.PublicKey, err = ssh.NewPublicKey(privKey.Public())
 	if err != nil {
-		return nil, errors.New("failed to close private key temp file")
+		return nil, fmt.Errorf("Failed to extract public key from generated key pair: %s", err)
 	}
-	userKey.privKeyFile = tf.Name()
 
-	return userKey, nil
-}
-
-func generateECDSAKeyToFile(uk *userKey, target *os.File) error {
-	privKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
-	if err != nil {
-		return errors.New("Failed to generate key pair")
-	}
-	uk.PublicKey, err = ssh.NewPublicKey(&privKey.PublicKey)
+	// To support Ansible calling back to us we need to write this file down,
+	// in the OpenSSH format that every connection plugin can read.
+	privateKeyBlock, err := ssh.MarshalPrivateKey(privKey, "")
 	if err != nil {
-		return fmt.Errorf("Failed to extract public key from generated key pair: %s", err)
+		return nil, fmt.Errorf("Failed to serialise private key for adapter: %s", err)
 	}
-
-	// To support Ansible calling back to us we need to write
-	// this file down
-	privateKeyDer, err := x509.MarshalPKCS8PrivateKey(privKey)
+	err = pem.Encode(tf, privateKeyBlock)
 	if err != nil {
-		return fmt.Errorf("Failed to serialise private key for adapter: %s", err)
-	}
-	privateKeyBlock := &pem.Block{
-		Type:    "PRIVATE KEY",
-		Headers: nil,
-		Bytes:   privateKeyDer,
+		return nil, errors.New("failed to write private key to temp file")
 	}
 
-	err = pem.Encode(target, privateKeyBlock)
+	err = tf.Close()
 	if err != nil {
-		return errors.New("failed to write private key to temp file")
+		return nil, errors.New("failed to close private key temp file")
 	}
+	userKey.privKeyFile = tf.Name()
 
-	return nil
+	return userKey, nil
 }
 
-func generateRSAKeyToFile(uk *userKey, target *os.File) error {
-	privKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return errors.New("Failed to generate key pair")
-	}
-	uk.PublicKey, err = ssh.NewPublicKey(&privKey.PublicKey)
-	if err != nil {
-		return fmt.Errorf("Failed to extract public key from generated key pair: %s", err)
-	}
+// generateKey generates a key pair of keyType, of keyBits bits for RSA.
+func generateKey(keyType string, keyBits int) (crypto.Signer, error) {
+	var privKey crypto.Signer
+	var err error
 
-	privateKeyBlock := &pem.Block{
-		Type:    "RSA PRIVATE KEY",
-		Headers: nil,
-		Bytes:   x509.MarshalPKCS1PrivateKey(privKey),
+	switch keyType {
+	case "RSA":
+		privKey, err = rsa.GenerateKey(rand.Reader, keyBits)
+	case "ECDSA":
+		privKey, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "ED25519":
+		_, privKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unknown key type: %q", keyType)
 	}
-
-	err = pem.Encode(target, privateKeyBlock)
 	if err != nil {
-		return errors.New("failed to write private key to temp file")
+		return nil, errors.New("Failed to generate key pair")
 	}
 
-	return nil
+	return privKey, nil
 }
 
 type signer struct {
 	ssh.Signer
 }
 
-func newSigner(privKeyFile string, keyType string) (*signer, error) {
+func newSigner(privKeyFile string, keyType string, keyBits int) (*signer, error) {
 	signer := new(signer)
 
 	if len(privKeyFile) > 0 {
@@ -1121,22 +1828,9 @@ func newSigner(privKeyFile string, keyType string) (*signer, error) {
 		return signer, nil
 	}
 
-	var privKey interface{}
-	var err error
-
-	switch keyType {
-	case "RSA":
-		privKey, err = rsa.GenerateKey(rand.Reader, 2048)
-		if err != nil {
-			return nil, errors.New("Failed to generate server key pair")
-		}
-	case "ECDSA":
-		privKey, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
-		if err != nil {
-			return nil, errors.New("Failed to generate server key pair")
-		}
-	default:
-		return nil, fmt.Errorf("Unsupported key type: %q", keyType)
+	privKey, err := generateKey(keyType, keyBits)
+	if err != nil {
+		return nil, errors.New("Failed to generate server key pair")
 	}
 
 	signer.Signer, err = ssh.NewSignerFromKey(privKey)
@@ -4,48 +4,72 @@ package ansible
 
 import (
 	"github.com/hashicorp/hcl/v2/hcldec"
+	ansiblecommon "github.com/hashicorp/packer-plugin-ansible/provisioner/ansible-common"
 	"github.com/zclconf/go-cty/cty"
 )
 
 // FlatConfig is an auto-generated flat version of Config.
 // Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
 type FlatConfig struct {
-	PackerBuildName       *string           `mapstructure:"packer_build_name" cty:"packer_build_name" hcl:"packer_build_name"`
-	PackerBuilderType     *string           `mapstructure:"packer_builder_type" cty:"packer_builder_type" hcl:"packer_builder_type"`
-	PackerCoreVersion     *string           `mapstructure:"packer_core_version" cty:"packer_core_version" hcl:"packer_core_version"`
-	PackerDebug           *bool             `mapstructure:"packer_debug" cty:"packer_debug" hcl:"packer_debug"`
-	PackerForce           *bool             `mapstructure:"packer_force" cty:"packer_force" hcl:"packer_force"`
-	PackerOnError         *string           `mapstructure:"packer_on_error" cty:"packer_on_error" hcl:"packer_on_error"`
-	PackerUserVars        map[string]string `mapstructure:"packer_user_variables" cty:"packer_user_variables" hcl:"packer_user_variables"`
-	PackerSensitiveVars   []string          `mapstructure:"packer_sensitive_variables" cty:"packer_sensitive_variables" hcl:"packer_sensitive_variables"`
-	Command               *string           `mapstructure:"command" cty:"command" hcl:"command"`
-	ExtraArguments        []string          `mapstructure:"extra_arguments" cty:"extra_arguments" hcl:"extra_arguments"`
-	AnsibleEnvVars        []string          `mapstructure:"ansible_env_vars" cty:"ansible_env_vars" hcl:"ansible_env_vars"`
-	PlaybookFile          *string           `mapstructure:"playbook_file" required:"true" cty:"playbook_file" hcl:"playbook_file"`
-	AnsibleSSHExtraArgs   []string          `mapstructure:"ansible_ssh_extra_args" cty:"ansible_ssh_extra_args" hcl:"ansible_ssh_extra_args"`
-	Groups                []string          `mapstructure:"groups" cty:"groups" hcl:"groups"`
-	EmptyGroups           []string          `mapstructure:"empty_groups" cty:"empty_groups" hcl:"empty_groups"`
-	HostAlias             *string           `mapstructure:"host_alias" cty:"host_alias" hcl:"host_alias"`
-	User                  *string           `mapstructure:"user" cty:"user" hcl:"user"`
-	LocalPort             *int              `mapstructure:"local_port" cty:"local_port" hcl:"local_port"`
-	SSHHostKeyFile        *string           `mapstructure:"ssh_host_key_file" cty:"ssh_host_key_file" hcl:"ssh_host_key_file"`
-	SSHAuthorizedKeyFile  *string           `mapstructure:"ssh_authorized_key_file" cty:"ssh_authorized_key_file" hcl:"ssh_authorized_key_file"`
-	AdapterKeyType        *string           `mapstructure:"ansible_proxy_key_type" cty:"ansible_proxy_key_type" hcl:"ansible_proxy_key_type"`
-	SFTPCmd               *string           `mapstructure:"sftp_command" cty:"sftp_command" hcl:"sftp_command"`
-	SkipVersionCheck      *bool             `mapstructure:"skip_version_check" cty:"skip_version_check" hcl:"skip_version_check"`
-	UseSFTP               *bool             `mapstructure:"use_sftp" cty:"use_sftp" hcl:"use_sftp"`
-	InventoryDirectory    *string           `mapstructure:"inventory_directory" cty:"inventory_directory" hcl:"inventory_directory"`
-	InventoryFileTemplate *string           `mapstructure:"inventory_file_template" cty:"inventory_file_template" hcl:"inventory_file_template"`
-	InventoryFile         *string           `mapstructure:"inventory_file" cty:"inventory_file" hcl:"inventory_file"`
-	KeepInventoryFile     *bool             `mapstructure:"keep_inventory_file" cty:"keep_inventory_file" hcl:"keep_inventory_file"`
-	GalaxyFile            *string           `mapstructure:"galaxy_file" cty:"galaxy_file" hcl:"galaxy_file"`
-	GalaxyCommand         *string           `mapstructure:"galaxy_command" cty:"galaxy_command" hcl:"galaxy_command"`
-	GalaxyForceInstall    *bool             `mapstructure:"galaxy_force_install" cty:"galaxy_force_install" hcl:"galaxy_force_install"`
-	GalaxyForceWithDeps   *bool             `mapstructure:"galaxy_force_with_deps" cty:"galaxy_force_with_deps" hcl:"galaxy_force_with_deps"`
-	RolesPath             *string           `mapstructure:"roles_path" cty:"roles_path" hcl:"roles_path"`
-	CollectionsPath       *string           `mapstructure:"collections_path" cty:"collections_path" hcl:"collections_path"`
-	UseProxy              *bool             `mapstructure:"use_proxy" cty:"use_proxy" hcl:"use_proxy"`
-	WinRMUseHTTP          *bool             `mapstructure:"ansible_winrm_use_http" cty:"ansible_winrm_use_http" hcl:"ansible_winrm_use_http"`
+	PackerBuildName          *string                           `mapstructure:"packer_build_name" cty:"packer_build_name" hcl:"packer_build_name"`
+	PackerBuilderType        *string                           `mapstructure:"packer_builder_type" cty:"packer_builder_type" hcl:"packer_builder_type"`
+	PackerCoreVersion        *string                           `mapstructure:"packer_core_version" cty:"packer_core_version" hcl:"packer_core_version"`
+	PackerDebug              *bool                             `mapstructure:"packer_debug" cty:"packer_debug" hcl:"packer_debug"`
+	PackerForce              *bool                             `mapstructure:"packer_force" cty:"packer_force" hcl:"packer_force"`
+	PackerOnError            *string                           `mapstructure:"packer_on_error" cty:"packer_on_error" hcl:"packer_on_error"`
+	PackerUserVars           map[string]string                 `mapstructure:"packer_user_variables" cty:"packer_user_variables" hcl:"packer_user_variables"`
+	PackerSensitiveVars      []string                          `mapstructure:"packer_sensitive_variables" cty:"packer_sensitive_variables" hcl:"packer_sensitive_variables"`
+	Command                  *string                           `mapstructure:"command" cty:"command" hcl:"command"`
+	ExtraArguments           []string                          `mapstructure:"extra_arguments" cty:"extra_arguments" hcl:"extra_arguments"`
+	ExtraVars                map[string]interface{}            `mapstructure:"extra_vars" cty:"extra_vars" hcl:"extra_vars"`
+	SensitiveValues          []string                          `mapstructure:"sensitive_values" cty:"sensitive_values" hcl:"sensitive_values"`
+	VaultPasswordFile        *string                           `mapstructure:"vault_password_file" cty:"vault_password_file" hcl:"vault_password_file"`
+	VaultPassword            *string                           `mapstructure:"vault_password" cty:"vault_password" hcl:"vault_password"`
+	VaultPasswordCommand     *string                           `mapstructure:"vault_password_command" cty:"vault_password_command" hcl:"vault_password_command"`
+	VaultIDs                 []ansiblecommon.FlatVaultID       `mapstructure:"vault_ids" cty:"vault_ids" hcl:"vault_ids"`
+	AnsibleEnvVars           []string                          `mapstructure:"ansible_env_vars" cty:"ansible_env_vars" hcl:"ansible_env_vars"`
+	PlaybookFile             *string                           `mapstructure:"playbook_file" required:"true" cty:"playbook_file" hcl:"playbook_file"`
+	PlaybookFiles            []string                          `mapstructure:"playbook_files" required:"true" cty:"playbook_files" hcl:"playbook_files"`
+	AnsibleSSHExtraArgs      []string                          `mapstructure:"ansible_ssh_extra_args" cty:"ansible_ssh_extra_args" hcl:"ansible_ssh_extra_args"`
+	Groups                   []string                          `mapstructure:"groups" cty:"groups" hcl:"groups"`
+	EmptyGroups              []string                          `mapstructure:"empty_groups" cty:"empty_groups" hcl:"empty_groups"`
+	GroupChildren            map[string][]string               `mapstructure:"group_children" cty:"group_children" hcl:"group_children"`
+	HostAlias                *string                           `mapstructure:"host_alias" cty:"host_alias" hcl:"host_alias"`
+	User                     *string                           `mapstructure:"user" cty:"user" hcl:"user"`
+	LocalPort                *int                              `mapstructure:"local_port" cty:"local_port" hcl:"local_port"`
+	SSHHostKeyFile           *string                           `mapstructure:"ssh_host_key_file" cty:"ssh_host_key_file" hcl:"ssh_host_key_file"`
+	SSHAuthorizedKeyFile     *string                           `mapstructure:"ssh_authorized_key_file" cty:"ssh_authorized_key_file" hcl:"ssh_authorized_key_file"`
+	AdapterKeyType           *string                           `mapstructure:"ansible_proxy_key_type" cty:"ansible_proxy_key_type" hcl:"ansible_proxy_key_type"`
+	AdapterKeyBits           *int                              `mapstructure:"ansible_proxy_key_bits" cty:"ansible_proxy_key_bits" hcl:"ansible_proxy_key_bits"`
+	SFTPCmd                  *string                           `mapstructure:"sftp_command" cty:"sftp_command" hcl:"sftp_command"`
+	SkipVersionCheck         *bool                             `mapstructure:"skip_version_check" cty:"skip_version_check" hcl:"skip_version_check"`
+	UseSFTP                  *bool                             `mapstructure:"use_sftp" cty:"use_sftp" hcl:"use_sftp"`
+	AnsibleVersionConstraint *string                           `mapstructure:"ansible_version_constraint" cty:"ansible_version_constraint" hcl:"ansible_version_constraint"`
+	InventoryDirectory       *string                           `mapstructure:"inventory_directory" cty:"inventory_directory" hcl:"inventory_directory"`
+	InventoryFileTemplate    *string                           `mapstructure:"inventory_file_template" cty:"inventory_file_template" hcl:"inventory_file_template"`
+	InventoryFormat          *string                           `mapstructure:"inventory_format" cty:"inventory_format" hcl:"inventory_format"`
+	HostVars                 map[string]interface{}            `mapstructure:"host_vars" cty:"host_vars" hcl:"host_vars"`
+	GroupVars                map[string]map[string]interface{} `mapstructure:"group_vars" cty:"group_vars" hcl:"group_vars"`
+	InventoryFile            *string                           `mapstructure:"inventory_file" cty:"inventory_file" hcl:"inventory_file"`
+	KeepInventoryFile        *bool                             `mapstructure:"keep_inventory_file" cty:"keep_inventory_file" hcl:"keep_inventory_file"`
+	GalaxyFile               *string                           `mapstructure:"galaxy_file" cty:"galaxy_file" hcl:"galaxy_file"`
+	GalaxyCommand            *string                           `mapstructure:"galaxy_command" cty:"galaxy_command" hcl:"galaxy_command"`
+	GalaxyForceInstall       *bool                             `mapstructure:"galaxy_force_install" cty:"galaxy_force_install" hcl:"galaxy_force_install"`
+	GalaxyForceWithDeps      *bool                             `mapstructure:"galaxy_force_with_deps" cty:"galaxy_force_with_deps" hcl:"galaxy_force_with_deps"`
+	RolesPath                *string                           `mapstructure:"roles_path" cty:"roles_path" hcl:"roles_path"`
+	CollectionsPath          *string                           `mapstructure:"collections_path" cty:"collections_path" hcl:"collections_path"`
+	GalaxyCacheDir           *string                           `mapstructure:"galaxy_cache_dir" cty:"galaxy_cache_dir" hcl:"galaxy_cache_dir"`
+	UseProxy                 *bool                             `mapstructure:"use_proxy" cty:"use_proxy" hcl:"use_proxy"`
+	WinRMUseHTTP             *bool                             `mapstructure:"ansible_winrm_use_http" cty:"ansible_winrm_use_http" hcl:"ansible_winrm_use_http"`
+	StructuredOutput         *bool                             `mapstructure:"structured_output" cty:"structured_output" hcl:"structured_output"`
+	ShowRawOutput            *bool                             `mapstructure:"show_raw_output" cty:"show_raw_output" hcl:"show_raw_output"`
+	ReportFile               *string                           `mapstructure:"report_file" cty:"report_file" hcl:"report_file"`
+	FactsOutputFile          *string                           `mapstructure:"facts_output_file" cty:"facts_output_file" hcl:"facts_output_file"`
+	OutputsFile              *string                           `mapstructure:"outputs_file" cty:"outputs_file" hcl:"outputs_file"`
+	InterruptGracePeriod     *string                           `mapstructure:"interrupt_grace_period" cty:"interrupt_grace_period" hcl:"interrupt_grace_period"`
+	TerminateGracePeriod     *string                           `mapstructure:"terminate_grace_period" cty:"terminate_grace_period" hcl:"terminate_grace_period"`
+	Retry                    *ansiblecommon.FlatRetryConfig    `mapstructure:"retry" cty:"retry" hcl:"retry"`
+	Virtualenv               *FlatVirtualenvConfig             `mapstructure:"virtualenv" cty:"virtualenv" hcl:"virtualenv"`
 }
 
 // FlatMapstructure returns a new FlatConfig.
@@ -70,22 +94,35 @@ func (*FlatConfig) HCL2Spec() map[string]hcldec.Spec {
 		"packer_sensitive_variables": &hcldec.AttrSpec{Name: "packer_sensitive_variables", Type: cty.List(cty.String), Required: false},
 		"command":                    &hcldec.AttrSpec{Name: "command", Type: cty.String, Required: false},
 		"extra_arguments":            &hcldec.AttrSpec{Name: "extra_arguments", Type: cty.List(cty.String), Required: false},
+		"extra_vars":                 &hcldec.AttrSpec{Name: "extra_vars", Type: cty.Map(cty.String), Required: false},
+		"sensitive_values":           &hcldec.AttrSpec{Name: "sensitive_values", Type: cty.List(cty.String), Required: false},
+		"vault_password_file":        &hcldec.AttrSpec{Name: "vault_password_file", Type: cty.String, Required: false},
+		"vault_password":             &hcldec.AttrSpec{Name: "vault_password", Type: cty.String, Required: false},
+		"vault_password_command":     &hcldec.AttrSpec{Name: "vault_password_command", Type: cty.String, Required: false},
+		"vault_ids":                  &hcldec.BlockListSpec{TypeName: "vault_ids", Nested: hcldec.ObjectSpec((*ansiblecommon.FlatVaultID)(nil).HCL2Spec())},
 		"ansible_env_vars":           &hcldec.AttrSpec{Name: "ansible_env_vars", Type: cty.List(cty.String), Required: false},
 		"playbook_file":              &hcldec.AttrSpec{Name: "playbook_file", Type: cty.String, Required: false},
+		"playbook_files":             &hcldec.AttrSpec{Name: "playbook_files", Type: cty.List(cty.String), Required: false},
 		"ansible_ssh_extra_args":     &hcldec.AttrSpec{Name: "ansible_ssh_extra_args", Type: cty.List(cty.String), Required: false},
 		"groups":                     &hcldec.AttrSpec{Name: "groups", Type: cty.List(cty.String), Required: false},
 		"empty_groups":               &hcldec.AttrSpec{Name: "empty_groups", Type: cty.List(cty.String), Required: false},
+		"group_children":             &hcldec.AttrSpec{Name: "group_children", Type: cty.Map(cty.String), Required: false},
 		"host_alias":                 &hcldec.AttrSpec{Name: "host_alias", Type: cty.String, Required: false},
 		"user":                       &hcldec.AttrSpec{Name: "user", Type: cty.String, Required: false},
 		"local_port":                 &hcldec.AttrSpec{Name: "local_port", Type: cty.Number, Required: false},
 		"ssh_host_key_file":          &hcldec.AttrSpec{Name: "ssh_host_key_file", Type: cty.String, Required: false},
 		"ssh_authorized_key_file":    &hcldec.AttrSpec{Name: "ssh_authorized_key_file", Type: cty.String, Required: false},
 		"ansible_proxy_key_type":     &hcldec.AttrSpec{Name: "ansible_proxy_key_type", Type: cty.String, Required: false},
+		"ansible_proxy_key_bits":     &hcldec.AttrSpec{Name: "ansible_proxy_key_bits", Type: cty.Number, Required: false},
 		"sftp_command":               &hcldec.AttrSpec{Name: "sftp_command", Type: cty.String, Required: false},
 		"skip_version_check":         &hcldec.AttrSpec{Name: "skip_version_check", Type: cty.Bool, Required: false},
 		"use_sftp":                   &hcldec.AttrSpec{Name: "use_sftp", Type: cty.Bool, Required: false},
+		"ansible_version_constraint": &hcldec.AttrSpec{Name: "ansible_version_constraint", Type: cty.String, Required: false},
 		"inventory_directory":        &hcldec.AttrSpec{Name: "inventory_directory", Type: cty.String, Required: false},
 		"inventory_file_template":    &hcldec.AttrSpec{Name: "inventory_file_template", Type: cty.String, Required: false},
+		"inventory_format":           &hcldec.AttrSpec{Name: "inventory_format", Type: cty.String, Required: false},
+		"host_vars":                  &hcldec.AttrSpec{Name: "host_vars", Type: cty.Map(cty.String), Required: false},
+		"group_vars":                 &hcldec.AttrSpec{Name: "group_vars", Type: cty.Map(cty.String), Required: false},
 		"inventory_file":             &hcldec.AttrSpec{Name: "inventory_file", Type: cty.String, Required: false},
 		"keep_inventory_file":        &hcldec.AttrSpec{Name: "keep_inventory_file", Type: cty.Bool, Required: false},
 		"galaxy_file":                &hcldec.AttrSpec{Name: "galaxy_file", Type: cty.String, Required: false},
@@ -94,8 +131,18 @@ func (*FlatConfig) HCL2Spec() map[string]hcldec.Spec {
 		"galaxy_force_with_deps":     &hcldec.AttrSpec{Name: "galaxy_force_with_deps", Type: cty.Bool, Required: false},
 		"roles_path":                 &hcldec.AttrSpec{Name: "roles_path", Type: cty.String, Required: false},
 		"collections_path":           &hcldec.AttrSpec{Name: "collections_path", Type: cty.String, Required: false},
+		"galaxy_cache_dir":           &hcldec.AttrSpec{Name: "galaxy_cache_dir", Type: cty.String, Required: false},
 		"use_proxy":                  &hcldec.AttrSpec{Name: "use_proxy", Type: cty.Bool, Required: false},
 		"ansible_winrm_use_http":     &hcldec.AttrSpec{Name: "ansible_winrm_use_http", Type: cty.Bool, Required: false},
+		"structured_output":          &hcldec.AttrSpec{Name: "structured_output", Type: cty.Bool, Required: false},
+		"show_raw_output":            &hcldec.AttrSpec{Name: "show_raw_output", Type: cty.Bool, Required: false},
+		"report_file":                &hcldec.AttrSpec{Name: "report_file", Type: cty.String, Required: false},
+		"facts_output_file":          &hcldec.AttrSpec{Name: "facts_output_file", Type: cty.String, Required: false},
+		"outputs_file":               &hcldec.AttrSpec{Name: "outputs_file", Type: cty.String, Required: false},
+		"interrupt_grace_period":     &hcldec.AttrSpec{Name: "interrupt_grace_period", Type: cty.String, Required: false},
+		"terminate_grace_period":     &hcldec.AttrSpec{Name: "terminate_grace_period", Type: cty.String, Required: false},
+		"retry":                      &hcldec.BlockSpec{TypeName: "retry", Nested: hcldec.ObjectSpec((*ansiblecommon.FlatRetryConfig)(nil).HCL2Spec())},
+		"virtualenv":                 &hcldec.BlockSpec{TypeName: "virtualenv", Nested: hcldec.ObjectSpec((*FlatVirtualenvConfig)(nil).HCL2Spec())},
 	}
 	return s
 }
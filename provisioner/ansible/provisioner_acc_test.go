@@ -4,6 +4,7 @@
 package ansible
 
 import (
+	"context"
 	_ "embed"
 	"fmt"
 	"io"
@@ -26,7 +27,7 @@ func TestAccAnsibleProvisioner_basic(t *testing.T) {
 		Setup: func() error {
 			var p Provisioner
 			p.config.Command = "ansible-playbook"
-			return p.getVersion()
+			return p.getVersion(context.Background())
 		},
 		Template: testPlaybookFileTemplate,
 		Type:     "ansible",
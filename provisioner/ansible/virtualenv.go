@@ -0,0 +1,284 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+//go:generate packer-sdc mapstructure-to-hcl2 -type VirtualenvConfig
+//go:generate packer-sdc struct-markdown
+
+package ansible
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/flock"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+
+	ansiblecommon "github.com/hashicorp/packer-plugin-ansible/provisioner/ansible-common"
+)
+
+// virtualenvReadyFile is written in a virtualenv once its requirements are
+// installed, so that a virtualenv left half-built by an interrupted build is
+// created again.
+const virtualenvReadyFile = ".packer-ready"
+
+// virtualenvMu keeps parallel builds from creating the same virtualenv at
+// the same time. The lock file next to the virtualenv does the same for the
+// builds of other Packer processes.
+var virtualenvMu sync.Mutex
+
+// VirtualenvConfig sets up a Python virtualenv on the machine running Packer,
+// in which the Ansible commands are installed and run. The virtualenv is
+// created the first time it is needed and reused by the next builds as long
+// as `python`, its version, `requirements` and the wheels of `wheelhouse`
+// don't change.
+//
+// ```hcl
+//
+//	virtualenv {
+//	  requirements = ["ansible-core>=2.16,<2.17", "jmespath"]
+//	}
+//
+// ```
+type VirtualenvConfig struct {
+	// The pip requirement specifiers to install in the virtualenv, such as
+	// `ansible-core==2.16.3`.
+	Requirements []string `mapstructure:"requirements" required:"true"`
+	// The directory in which the virtualenvs are created, each one in a
+	// subdirectory named after a hash of `python`, its version,
+	// `requirements` and the wheels of `wheelhouse`.
+	// Defaults to `ansible-virtualenvs` in the Packer cache directory.
+	Path string `mapstructure:"path"`
+	// The Python interpreter creating the virtualenv. Defaults to `python3`.
+	Python string `mapstructure:"python"`
+	// A directory of wheels from which the requirements are installed,
+	// without accessing a package index. Useful on build hosts without
+	// Internet access.
+	Wheelhouse string `mapstructure:"wheelhouse"`
+
+	// The output of `python --version`, probed by Create so that a
+	// virtualenv is created again when the interpreter is upgraded.
+	pythonVersion string
+	// The names, sizes and modification times of the wheels of Wheelhouse.
+	wheels []string
+}
+
+// Prepare validates the virtualenv options and sets their defaults.
+func (c *VirtualenvConfig) Prepare() []error {
+	var errs []error
+	if len(c.Requirements) == 0 {
+		errs = append(errs, fmt.Errorf("virtualenv: requirements must be set"))
+	}
+	if c.Python == "" {
+		c.Python = "python3"
+	}
+	if c.Path == "" {
+		path, err := packersdk.CachePath("ansible-virtualenvs")
+		if err != nil {
+			errs = append(errs, fmt.Errorf("virtualenv: %s", err))
+		}
+		c.Path = path
+	}
+	if c.Wheelhouse != "" {
+		if info, err := os.Stat(c.Wheelhouse); err != nil {
+			errs = append(errs, fmt.Errorf("virtualenv: wheelhouse: %s is invalid: %s", c.Wheelhouse, err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("virtualenv: wheelhouse: %s must point to a directory", c.Wheelhouse))
+		} else if c.wheels, err = listWheels(c.Wheelhouse); err != nil {
+			errs = append(errs, fmt.Errorf("virtualenv: wheelhouse: %s", err))
+		}
+	}
+	return errs
+}
+
+// probePython runs `python --version`, whose output keys the virtualenv
+// along with the options.
+func (c *VirtualenvConfig) probePython(ctx context.Context) error {
+	out, err := versionCommand(ctx, c.Python).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Error running \"%s --version\": %s", c.Python, err)
+	}
+	c.pythonVersion = strings.TrimSpace(string(out))
+	return nil
+}
+
+// listWheels returns the names, sizes and modification times of the files
+// of wheelhouse, so that a virtualenv is created again when they change.
+func listWheels(wheelhouse string) ([]string, error) {
+	entries, err := os.ReadDir(wheelhouse)
+	if err != nil {
+		return nil, err
+	}
+	var wheels []string
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		if info.Mode().IsRegular() {
+			wheels = append(wheels, fmt.Sprintf("%s %d %d", entry.Name(), info.Size(), info.ModTime().UnixNano()))
+		}
+	}
+	return wheels, nil
+}
+
+// Dir returns the directory of the virtualenv.
+func (c *VirtualenvConfig) Dir() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "python=%s\n", c.Python)
+	fmt.Fprintf(h, "python_version=%s\n", c.pythonVersion)
+	for _, req := range c.Requirements {
+		fmt.Fprintf(h, "requirement=%s\n", req)
+	}
+	if c.Wheelhouse != "" {
+		fmt.Fprintf(h, "wheelhouse=%s\n", c.Wheelhouse)
+		for _, wheel := range c.wheels {
+			fmt.Fprintf(h, "wheel=%s\n", wheel)
+		}
+	}
+	return filepath.Join(c.Path, hex.EncodeToString(h.Sum(nil))[:16])
+}
+
+// virtualenvLayout returns the directory of the commands of a virtualenv
+// and the name of its Python interpreter in that directory on goos.
+func virtualenvLayout(goos string) (bin, python string) {
+	if goos == "windows" {
+		return "Scripts", "python.exe"
+	}
+	return "bin", "python"
+}
+
+// binDir returns the directory of the commands of the virtualenv.
+func (c *VirtualenvConfig) binDir() string {
+	bin, _ := virtualenvLayout(runtime.GOOS)
+	return filepath.Join(c.Dir(), bin)
+}
+
+// Command returns the path of command in the virtualenv. Commands given with
+// a path are returned unchanged.
+func (c *VirtualenvConfig) Command(command string) string {
+	if strings.ContainsRune(command, filepath.Separator) {
+		return command
+	}
+	return filepath.Join(c.binDir(), command)
+}
+
+// Env returns the environment variables activating the virtualenv.
+func (c *VirtualenvConfig) Env() []string {
+	bin := c.binDir()
+	return []string{
+		"VIRTUAL_ENV=" + c.Dir(),
+		"PATH=" + bin + string(os.PathListSeparator) + os.Getenv("PATH"),
+	}
+}
+
+// Ready reports whether the virtualenv exists with its requirements
+// installed.
+func (c *VirtualenvConfig) Ready() bool {
+	_, err := os.Stat(filepath.Join(c.Dir(), virtualenvReadyFile))
+	return err == nil
+}
+
+// Create probes the version of python, which selects the virtualenv, and
+// creates it and installs its requirements, unless it is already Ready. The
+// commands creating it are stopped like StopOnCancel with
+// the given grace periods once ctx is done, and the virtualenv is removed.
+func (c *VirtualenvConfig) Create(ctx context.Context, ui packersdk.Ui, interruptGrace, terminateGrace time.Duration) error {
+	if err := c.probePython(ctx); err != nil {
+		return err
+	}
+
+	virtualenvMu.Lock()
+	defer virtualenvMu.Unlock()
+
+	dir := c.Dir()
+	if c.Ready() {
+		log.Printf("reusing the virtualenv %s", dir)
+		return nil
+	}
+
+	// The virtualenv is built in place, as its scripts refer to its
+	// directory, with a lock keeping other Packer processes away.
+	if err := os.MkdirAll(c.Path, 0755); err != nil {
+		return err
+	}
+	lock := flock.New(dir + ".lock")
+	locked, err := lock.TryLock()
+	if err == nil && !locked {
+		ui.Say(fmt.Sprintf("Waiting for another build creating virtualenv %s...", dir))
+		_, err = lock.TryLockContext(ctx, 100*time.Millisecond)
+	}
+	if err != nil {
+		return fmt.Errorf("Error locking virtualenv %s: %w", dir, err)
+	}
+	defer func() {
+		_ = lock.Unlock()
+	}()
+	if c.Ready() {
+		log.Printf("reusing the virtualenv %s", dir)
+		return nil
+	}
+
+	ui.Say(fmt.Sprintf("Creating virtualenv %s...", dir))
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	run := func(name string, args ...string) error {
+		return runVirtualenvCommand(ctx, ui, interruptGrace, terminateGrace, name, args...)
+	}
+	err = run(c.Python, "-m", "venv", dir)
+	if err == nil {
+		args := []string{"-m", "pip", "install", "--disable-pip-version-check"}
+		if c.Wheelhouse != "" {
+			args = append(args, "--no-index", "--find-links", c.Wheelhouse)
+		}
+		ui.Message(fmt.Sprintf("Installing %s", strings.Join(c.Requirements, ", ")))
+		_, python := virtualenvLayout(runtime.GOOS)
+		err = run(filepath.Join(c.binDir(), python), append(args, c.Requirements...)...)
+	}
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, virtualenvReadyFile), []byte(strings.Join(c.Requirements, "\n")+"\n"), 0644)
+	}
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return fmt.Errorf("Error creating virtualenv %s: %w", dir, err)
+	}
+	return nil
+}
+
+// runVirtualenvCommand runs a command creating a virtualenv, in its own
+// process group so that pip and its builds are stopped along with it.
+func runVirtualenvCommand(ctx context.Context, ui packersdk.Ui, interruptGrace, terminateGrace time.Duration, name string, args ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cmd := exec.Command(name, args...)
+	ansiblecommon.SetProcessGroup(cmd)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	stop := ansiblecommon.StopOnCancel(ctx, ui, cmd.Process, interruptGrace, terminateGrace)
+	err := cmd.Wait()
+	stop()
+	log.Printf("%s %s:\n%s", name, strings.Join(args, " "), out.String())
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("%s %s: %s\n%s", name, strings.Join(args, " "), err, out.String())
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+// Copyright IBM Corp. 2013, 2025
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !windows
+// +build !windows
+
+package ansible
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofrs/flock"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/stretchr/testify/assert"
+)
+
+// writePythonStub writes a python3 stub that creates fake virtualenvs, with an
+// ansible-playbook printing version, and logs its pip installs to pipLog. Its
+// own version is $PYTHON_VERSION.
+func writePythonStub(t *testing.T, dir, version, pipLog string) string {
+	stub := path.Join(dir, "python3")
+	script := fmt.Sprintf(`#!/usr/bin/env bash
+if [ "$1" = --version ]; then
+  echo "Python ${PYTHON_VERSION:-3.11.9}"
+  exit 0
+fi
+case "$2" in
+  venv)
+    mkdir -p "$3/bin"
+    cp "$0" "$3/bin/python"
+    printf '#!/usr/bin/env bash\necho "ansible-playbook [core %s]"\n' > "$3/bin/ansible-playbook"
+    chmod +x "$3/bin/ansible-playbook"
+    ;;
+  pip)
+    echo "${@:3}" >> %q
+    ;;
+esac
+`, version, pipLog)
+	if err := os.WriteFile(stub, []byte(script), 0777); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return stub
+}
+
+func TestVirtualenvConfig_Create(t *testing.T) {
+	dir := t.TempDir()
+	pipLog := path.Join(dir, "pip.log")
+	wheelhouse := path.Join(dir, "wheels")
+	if err := os.Mkdir(wheelhouse, 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	c := &VirtualenvConfig{
+		Path:         path.Join(dir, "venvs"),
+		Python:       writePythonStub(t, dir, "2.16.3", pipLog),
+		Requirements: []string{"ansible-core==2.16.3", "jmespath"},
+		Wheelhouse:   wheelhouse,
+	}
+	assert.Empty(t, c.Prepare())
+	assert.False(t, c.Ready())
+
+	ui := packersdk.TestUi(t)
+	for i := 0; i < 2; i++ {
+		if err := c.Create(context.Background(), ui, time.Second, time.Second); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	assert.True(t, c.Ready())
+
+	b, err := os.ReadFile(pipLog)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	assert.Equal(t, "install --disable-pip-version-check --no-index --find-links "+wheelhouse+" ansible-core==2.16.3 jmespath\n", string(b),
+		"the virtualenv should be reused")
+
+	assert.Equal(t, filepath.Join(c.Dir(), "bin", "ansible-playbook"), c.Command("ansible-playbook"))
+	assert.Equal(t, "/opt/ansible/bin/ansible-playbook", c.Command("/opt/ansible/bin/ansible-playbook"))
+	assert.Contains(t, c.Env(), "VIRTUAL_ENV="+c.Dir())
+
+	other := *c
+	other.Requirements = []string{"ansible-core==2.17.0"}
+	assert.NotEqual(t, c.Dir(), other.Dir(), "virtualenvs should be keyed by their requirements")
+	assert.False(t, other.Ready())
+
+	if err := os.WriteFile(path.Join(wheelhouse, "jmespath-1.0.1-py3-none-any.whl"), []byte("wheel"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	rewheeled := *c
+	assert.Empty(t, rewheeled.Prepare())
+	assert.NotEqual(t, c.Dir(), rewheeled.Dir(), "virtualenvs should be keyed by their wheels")
+	assert.False(t, rewheeled.Ready())
+
+	t.Setenv("PYTHON_VERSION", "3.12.3")
+	upgraded := *c
+	if err := upgraded.probePython(context.Background()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	assert.NotEqual(t, c.Dir(), upgraded.Dir(), "virtualenvs should be keyed by the version of python")
+	assert.False(t, upgraded.Ready())
+
+	missing := *c
+	missing.Python = path.Join(dir, "missing")
+	assert.Empty(t, missing.Prepare(), "python should not be run by Prepare")
+	assert.Error(t, missing.Create(context.Background(), ui, time.Second, time.Second), "python should be found")
+}
+
+func TestVirtualenvConfig_CreateLocked(t *testing.T) {
+	dir := t.TempDir()
+	c := &VirtualenvConfig{
+		Path:         path.Join(dir, "venvs"),
+		Python:       writePythonStub(t, dir, "2.16.3", path.Join(dir, "pip.log")),
+		Requirements: []string{"ansible-core==2.16.3"},
+	}
+	assert.Empty(t, c.Prepare())
+	if err := c.probePython(context.Background()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := os.MkdirAll(c.Path, 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	// Another Packer process creating the virtualenv.
+	lock := flock.New(c.Dir() + ".lock")
+	if _, err := lock.TryLock(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	err := c.Create(ctx, packersdk.TestUi(t), time.Second, time.Second)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	_, err = os.Stat(c.Dir())
+	assert.True(t, os.IsNotExist(err), "the virtualenv of another process should be left alone")
+
+	if err := lock.Unlock(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := c.Create(context.Background(), packersdk.TestUi(t), time.Second, time.Second); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	assert.True(t, c.Ready())
+}
+
+func TestVirtualenvConfig_CreateFailure(t *testing.T) {
+	dir := t.TempDir()
+	stub := path.Join(dir, "python3")
+	script := `#!/usr/bin/env bash
+case "$2" in
+  venv) mkdir -p "$3/bin"; cp "$0" "$3/bin/python" ;;
+  pip) echo "No matching distribution found for ansible-core==0.0.0" >&2; exit 1 ;;
+esac
+`
+	if err := os.WriteFile(stub, []byte(script), 0777); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	c := &VirtualenvConfig{
+		Path:         path.Join(dir, "venvs"),
+		Python:       stub,
+		Requirements: []string{"ansible-core==0.0.0"},
+	}
+	assert.Empty(t, c.Prepare())
+	err := c.Create(context.Background(), packersdk.TestUi(t), time.Second, time.Second)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+	assert.Contains(t, err.Error(), "No matching distribution found")
+	_, err = os.Stat(c.Dir())
+	assert.True(t, os.IsNotExist(err), "a virtualenv failing to build should be removed")
+}
+
+func TestVirtualenvConfig_CreateCancel(t *testing.T) {
+	dir := t.TempDir()
+	signals := path.Join(dir, "signals")
+	started := path.Join(dir, "started")
+	stub := path.Join(dir, "python3")
+	// pip is interrupted while a build of one of the requirements runs in
+	// the background.
+	script := fmt.Sprintf(`#!/usr/bin/env bash
+case "$2" in
+  venv) mkdir -p "$3/bin"; cp "$0" "$3/bin/python" ;;
+  pip)
+    trap 'echo INT >> %q; exit 130' INT
+    sleep 30 &
+    touch %q
+    wait
+    ;;
+esac
+`, signals, started)
+	if err := os.WriteFile(stub, []byte(script), 0777); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	c := &VirtualenvConfig{
+		Path:         path.Join(dir, "venvs"),
+		Python:       stub,
+		Requirements: []string{"ansible-core==2.16.3"},
+	}
+	assert.Empty(t, c.Prepare())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for {
+			if _, err := os.Stat(started); err == nil {
+				cancel()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- c.Create(ctx, packersdk.TestUi(t), 200*time.Millisecond, 200*time.Millisecond) }()
+	select {
+	case err := <-errCh:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(10 * time.Second):
+		t.Fatal("pip was not stopped along with its children")
+	}
+	got, _ := os.ReadFile(signals)
+	assert.Equal(t, "INT\n", string(got), "pip should be interrupted")
+	_, err := os.Stat(c.Dir())
+	assert.True(t, os.IsNotExist(err), "a cancelled virtualenv should be removed")
+}
+
+func TestProvisionerPrepare_Virtualenv(t *testing.T) {
+	dir := t.TempDir()
+	playbookFile := path.Join(dir, "site.yml")
+	if err := os.WriteFile(playbookFile, []byte("---\n"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	python := path.Join(dir, "python3")
+	config := map[string]interface{}{
+		"playbook_file":              playbookFile,
+		"ansible_version_constraint": ">= 2.15",
+		"virtualenv": map[string]interface{}{
+			"path":         path.Join(dir, "venvs"),
+			"python":       python,
+			"requirements": []string{"ansible-core==2.14.1"},
+		},
+	}
+
+	var p Provisioner
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("neither python nor the version of the virtualenv should be checked: %s", err)
+	}
+
+	writePythonStub(t, dir, "2.14.1", path.Join(dir, "pip.log"))
+	err := p.prepareVirtualenv(context.Background(), packersdk.TestUi(t))
+	if err == nil || !strings.Contains(err.Error(), "ansible-core 2.14.1 does not satisfy") {
+		t.Fatalf("the version of the virtualenv should be checked, got: %v", err)
+	}
+	venvBin := filepath.Join(p.config.Virtualenv.Dir(), "bin")
+	assert.True(t, p.config.Virtualenv.Ready())
+	assert.Equal(t, filepath.Join(venvBin, "ansible-playbook"), p.config.Command)
+	assert.Equal(t, filepath.Join(venvBin, "ansible-galaxy"), p.config.GalaxyCommand)
+
+	_, envVars := p.createCmdArgs("", "inventory", "site.yml", "")
+	assert.Contains(t, envVars, "VIRTUAL_ENV="+p.config.Virtualenv.Dir())
+}
+
+func TestVirtualenvLayout(t *testing.T) {
+	bin, python := virtualenvLayout("windows")
+	assert.Equal(t, "Scripts", bin)
+	assert.Equal(t, "python.exe", python)
+
+	bin, python = virtualenvLayout("linux")
+	assert.Equal(t, "bin", bin)
+	assert.Equal(t, "python", python)
+}